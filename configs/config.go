@@ -1,6 +1,8 @@
 package configs
 
 import (
+	"time"
+
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/kelseyhightower/envconfig"
 )
@@ -12,29 +14,80 @@ type MinioEnvs struct {
 	SecretKey string `envconfig:"secretkey"`
 	Bucket    string `envconfig:"bucket"`
 	SSL       bool   `envconfig:"ssl"`
+	// TenantIsolation is empty, "prefix" to keep the videos of a tenant under tenants/{tenant}/
+	// or "bucket" to store them in a bucket named TenantBucketPrefix + tenant.
+	TenantIsolation    string `envconfig:"tenant_isolation"`
+	TenantBucketPrefix string `envconfig:"tenant_bucket_prefix" default:"tenant-"`
 }
 
 type EnvVariables struct {
-	ServerHost                    string `envconfig:"server_host"`
-	ServerPort                    string `envconfig:"server_port"`
-	VideoSourceDir                string `envconfig:"VIDEO_SOURCE_DIRECTORY"`
-	ConvertedVideoContainerPrefix string `envconfig:"VIDEO_CONVERTED_CONTAINER_PREFIX"`
-	ConvertedVideoCodecPrefix     string `envconfig:"VIDEO_CONVERTED_CODEC_PREFIX"`
-	RtspStreamUrlPattern          string `envconfig:"RTSP_ADDRESS_PATTERN"`
-	FfmpegProtocol                string `envconfig:"FFMPEG_PROTOCOL"`
-	FfmpegConversionCodec         string `envconfig:"FFMPEG_CONVERSION_CODEC"`
-	FfmpegConversionBitrate       string `envconfig:"FFMPEG_CONVERSION_BITRATE"`
-	ExternalSetupServerUrl        string `envconfig:"EXTERNAL_SETUP_SERVER_URL"`
-	Timeout                       int    `envconfig:"TIMEOUT"`
-	WebSocketAddress              string `envconfig:"WEBSOCKET_ADDRESS"`
+	ServerHost                    string        `envconfig:"server_host"`
+	ServerPort                    string        `envconfig:"server_port"`
+	VideoSourceDir                string        `envconfig:"VIDEO_SOURCE_DIRECTORY"`
+	ConvertedVideoContainerPrefix string        `envconfig:"VIDEO_CONVERTED_CONTAINER_PREFIX"`
+	ConvertedVideoCodecPrefix     string        `envconfig:"VIDEO_CONVERTED_CODEC_PREFIX"`
+	RtspStreamUrlPattern          string        `envconfig:"RTSP_ADDRESS_PATTERN"`
+	RtspTLSCert                   string        `envconfig:"RTSP_TLS_CERT"`
+	RtspTLSKey                    string        `envconfig:"RTSP_TLS_KEY"`
+	RtspTLSCA                     string        `envconfig:"RTSP_TLS_CA"`
+	FfmpegProtocol                string        `envconfig:"FFMPEG_PROTOCOL"`
+	FfmpegConversionCodec         string        `envconfig:"FFMPEG_CONVERSION_CODEC"`
+	FfmpegConversionBitrate       string        `envconfig:"FFMPEG_CONVERSION_BITRATE"`
+	FfmpegProgressPeriod          time.Duration `envconfig:"FFMPEG_PROGRESS_PERIOD" default:"1s"`
+	FfmpegStreamAudioBitrate      string        `envconfig:"FFMPEG_STREAM_AUDIO_BITRATE" default:"96k"`
+	// conversion profiles selected per upload, see ConversionProfiles
+	ConversionProfiles       ConversionProfiles `envconfig:"CONVERSION_PROFILES"`
+	DefaultConversionProfile string             `envconfig:"DEFAULT_CONVERSION_PROFILE" default:"default"`
+	ExternalSetupServerUrl   string             `envconfig:"EXTERNAL_SETUP_SERVER_URL"`
+	Timeout                  int                `envconfig:"TIMEOUT"`
+	WebSocketAddress         string             `envconfig:"WEBSOCKET_ADDRESS"`
+	RecordSegmentDuration    time.Duration      `envconfig:"RECORD_SEGMENT_DURATION" default:"4s"`
+	DvrWindow                time.Duration      `envconfig:"DVR_WINDOW"`
+	DvrDirectory             string             `envconfig:"DVR_DIRECTORY" default:"./data/dvr"`
+	DvrCatchUpRate           float64            `envconfig:"DVR_CATCHUP_RATE" default:"1.5"`
+	MetricsBearerToken       string             `envconfig:"METRICS_BEARER_TOKEN"`
+	PublisherRoles           []string           `envconfig:"PUBLISHER_ROLES"`
+	WebSocketAllowedOrigins  []string           `envconfig:"WEBSOCKET_ALLOWED_ORIGINS"`
+	// limits, zero is unlimited
+	LimitStreams                int     `envconfig:"LIMIT_STREAMS"`
+	LimitStreamsPerUser         int     `envconfig:"LIMIT_STREAMS_PER_USER"`
+	LimitConversions            int     `envconfig:"LIMIT_CONVERSIONS"`
+	LimitConversionsPerUser     int     `envconfig:"LIMIT_CONVERSIONS_PER_USER"`
+	LimitUploadBandwidth        int     `envconfig:"LIMIT_UPLOAD_BANDWIDTH"`
+	LimitUploadBandwidthPerUser int     `envconfig:"LIMIT_UPLOAD_BANDWIDTH_PER_USER"`
+	LimitRequests               float64 `envconfig:"LIMIT_REQUESTS"`
+	LimitRequestsPerUser        float64 `envconfig:"LIMIT_REQUESTS_PER_USER"`
+	LimitRequestBurst           int     `envconfig:"LIMIT_REQUEST_BURST" default:"20"`
+	QuotaUserBytes              int64   `envconfig:"QUOTA_USER_BYTES"`
+	QuotaTenantBytes            int64   `envconfig:"QUOTA_TENANT_BYTES"`
+	HealthMinFreeBytes          int64   `envconfig:"HEALTH_MIN_FREE_BYTES" default:"536870912"`
+	// restarts of a failing stream pusher, the backoff doubles from StreamRestartBackoff
+	StreamRestartLimit      int           `envconfig:"STREAM_RESTART_LIMIT" default:"5"`
+	StreamRestartBackoff    time.Duration `envconfig:"STREAM_RESTART_BACKOFF" default:"1s"`
+	StreamRestartMaxBackoff time.Duration `envconfig:"STREAM_RESTART_MAX_BACKOFF" default:"30s"`
+	// time given to the requests, conversions and streams to end on SIGTERM
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+	// tracing, disabled without an OTLP endpoint
+	OtlpEndpoint     string  `envconfig:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OtelServiceName  string  `envconfig:"OTEL_SERVICE_NAME" default:"video-handler"`
+	TraceSampleRatio float64 `envconfig:"TRACE_SAMPLE_RATIO" default:"1"`
 }
 
 type ExternalAuthService struct {
-	VerificationEndpoint   string `envconfig:"ENDPOINT_VERIFY_TOKEN"`
-	AccessTokenCookieName  string `envconfig:"COOKIE_NAME_ACCESS_TOKEN"`
-	RefreshTokenCookieName string `envconfig:"COOKIE_NAME_REFRESH_TOKEN"`
-	LoginPageURL           string `envconfig:"PAGE_LOGIN"`
-	RegistrationPageURL    string `envconfig:"PAGE_REGISTRATION"`
+	VerificationEndpoint   string        `envconfig:"ENDPOINT_VERIFY_TOKEN"`
+	AccessTokenCookieName  string        `envconfig:"COOKIE_NAME_ACCESS_TOKEN"`
+	RefreshTokenCookieName string        `envconfig:"COOKIE_NAME_REFRESH_TOKEN"`
+	LoginPageURL           string        `envconfig:"PAGE_LOGIN"`
+	RegistrationPageURL    string        `envconfig:"PAGE_REGISTRATION"`
+	RefreshEndpoint        string        `envconfig:"ENDPOINT_REFRESH_TOKEN"`
+	JWKSSource             string        `envconfig:"JWKS"`
+	JWKSCacheTTL           time.Duration `envconfig:"JWKS_CACHE_TTL" default:"10m"`
+	JWTIssuer              string        `envconfig:"JWT_ISSUER"`
+	JWTAudience            string        `envconfig:"JWT_AUDIENCE"`
+	Timeout                time.Duration `envconfig:"TIMEOUT" default:"30s"`
+	SigningKey             string        `envconfig:"SIGNING_KEY"`
+	SessionTokenTTL        time.Duration `envconfig:"SESSION_TOKEN_TTL" default:"1m"`
+	PlaybackTokenTTL       time.Duration `envconfig:"PLAYBACK_TOKEN_TTL" default:"1h"`
 }
 
 func MustConfig() *EnvVariables {
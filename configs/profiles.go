@@ -0,0 +1,76 @@
+package configs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// DefaultProfileName is the profile made of FFMPEG_CONVERSION_CODEC and FFMPEG_CONVERSION_BITRATE
+	// when CONVERSION_PROFILES doesn't define it.
+	DefaultProfileName string = "default"
+)
+
+var (
+	profileContainers = map[string]bool{"mpegts": true, "mp4": true, "matroska": true, "webm": true}
+)
+
+// ConversionProfile is a named set of conversion settings, selected per upload.
+type ConversionProfile struct {
+	VideoCodec string `json:"video_codec"`
+	// Crf or Bitrate sets the quality
+	Crf     string `json:"crf,omitempty"`
+	Bitrate string `json:"bitrate,omitempty"`
+	// MaxHeight scales down taller videos, keeping their aspect ratio
+	MaxHeight int     `json:"max_height,omitempty"`
+	FrameRate float64 `json:"frame_rate,omitempty"`
+	// Gop is the number of frames between keyframes
+	Gop int `json:"gop,omitempty"`
+	// AudioCodec is aac by default, libopus in webm
+	AudioCodec   string `json:"audio_codec,omitempty"`
+	AudioBitrate string `json:"audio_bitrate,omitempty"`
+	// AudioChannels mixes the audio down, 2 downmixes surround to stereo
+	AudioChannels int `json:"audio_channels,omitempty"`
+	// AudioTrack is the index of the audio track kept from multi-track sources, the first one by default
+	AudioTrack int `json:"audio_track,omitempty"`
+	// Loudnorm normalises the loudness to the EBU R128 target
+	Loudnorm bool `json:"loudnorm,omitempty"`
+	// Container is mpegts, mp4, matroska or webm, mpegts by default
+	Container string `json:"container,omitempty"`
+}
+
+// ConversionProfiles decodes CONVERSION_PROFILES, a JSON object of the profiles by name, like
+// {"720p":{"video_codec":"libx264","crf":"23","max_height":720}}.
+type ConversionProfiles map[string]ConversionProfile
+
+func (cp *ConversionProfiles) Decode(value string) error {
+	profiles := map[string]ConversionProfile{}
+	if err := json.Unmarshal([]byte(value), &profiles); err != nil {
+		return err
+	}
+
+	for name, profile := range profiles {
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	*cp = profiles
+	return nil
+}
+
+func (profile ConversionProfile) validate() error {
+	switch {
+	case profile.VideoCodec == "":
+		return errors.New("no video codec")
+	case profile.Crf != "" && profile.Bitrate != "":
+		return errors.New("crf and bitrate both set")
+	case profile.MaxHeight < 0, profile.FrameRate < 0, profile.Gop < 0:
+		return errors.New("negative max height, frame rate or gop")
+	case profile.AudioChannels < 0, profile.AudioTrack < 0:
+		return errors.New("negative audio channels or audio track")
+	case profile.Container != "" && !profileContainers[profile.Container]:
+		return fmt.Errorf("unsupported container %s", profile.Container)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package configs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConversionProfileValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile ConversionProfile
+		err     string
+	}{
+		{"crf", ConversionProfile{VideoCodec: "libx264", Crf: "23"}, ""},
+		{"bitrate", ConversionProfile{VideoCodec: "libx264", Bitrate: "2M"}, ""},
+		{"every setting", ConversionProfile{VideoCodec: "libvpx-vp9", Crf: "31", MaxHeight: 720, FrameRate: 29.97, Gop: 60, AudioCodec: "libopus", AudioBitrate: "96k", AudioChannels: 2, AudioTrack: 1, Loudnorm: true, Container: "webm"}, ""},
+		{"each container", ConversionProfile{VideoCodec: "libx264", Container: "matroska"}, ""},
+		{"no video codec", ConversionProfile{Crf: "23"}, "no video codec"},
+		{"crf and bitrate both set", ConversionProfile{VideoCodec: "libx264", Crf: "23", Bitrate: "2M"}, "crf and bitrate both set"},
+		{"a negative max height", ConversionProfile{VideoCodec: "libx264", MaxHeight: -720}, "negative max height"},
+		{"a negative frame rate", ConversionProfile{VideoCodec: "libx264", FrameRate: -1}, "negative max height, frame rate"},
+		{"a negative gop", ConversionProfile{VideoCodec: "libx264", Gop: -1}, "gop"},
+		{"negative audio channels", ConversionProfile{VideoCodec: "libx264", AudioChannels: -2}, "negative audio channels"},
+		{"a negative audio track", ConversionProfile{VideoCodec: "libx264", AudioTrack: -1}, "audio track"},
+		{"an unknown container", ConversionProfile{VideoCodec: "libx264", Container: "avi"}, "unsupported container avi"},
+		{"a container in capitals", ConversionProfile{VideoCodec: "libx264", Container: "MP4"}, "unsupported container MP4"},
+	}
+
+	for _, test := range tests {
+		err := test.profile.validate()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: validate returned %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: validate returned %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestConversionProfilesDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		err   string
+	}{
+		{"profiles", `{"720p":{"video_codec":"libx264","crf":"23","max_height":720},"web":{"video_codec":"libvpx-vp9","bitrate":"1M","container":"webm"}}`, ""},
+		{"no profile", `{}`, ""},
+		{"an invalid profile", `{"720p":{"video_codec":"libx264","crf":"23","bitrate":"2M"}}`, "profile 720p: crf and bitrate both set"},
+		{"not JSON", `720p=libx264`, "invalid character"},
+		{"a list", `[{"video_codec":"libx264"}]`, "cannot unmarshal array"},
+	}
+
+	for _, test := range tests {
+		var profiles ConversionProfiles
+		err := profiles.Decode(test.value)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: Decode returned %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: Decode returned %v, want %q", test.name, err, test.err)
+		case test.err != "" && profiles != nil:
+			t.Errorf("%s: Decode kept the profiles %+v of an invalid value", test.name, profiles)
+		}
+	}
+}
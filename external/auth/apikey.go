@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ScopeVideosWrite    string = "videos:write"
+	ScopeStreamsPublish string = "streams:publish"
+	ScopeAdmin          string = "admin"
+
+	apiKeyPrefix     string = "vh_"
+	apiKeyUserPrefix string = "apikey:"
+)
+
+var (
+	ErrUnknownScope = errors.New("unknown scope")
+	ErrKeyRevoked   = errors.New("api key revoked")
+)
+
+var scopes = []string{ScopeVideosWrite, ScopeStreamsPublish, ScopeAdmin}
+
+// APIKey is a credential for automation, only the hash of its secret is stored.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Tenant    string     `json:"tenant"`
+	Hash      string     `json:"hash,omitempty"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// identity is the identity of the requests made with the key, which own what they upload.
+func (k *APIKey) identity() *Identity {
+	identity := &Identity{
+		UserID:   apiKeyUserPrefix + k.ID,
+		Username: k.Name,
+		Tenant:   k.Tenant,
+		Scopes:   k.Scopes,
+		APIKey:   true,
+	}
+	if k.hasScope(ScopeAdmin) {
+		identity.Roles = []string{RoleAdmin}
+	}
+	return identity
+}
+
+func (k *APIKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyStore persists the API keys.
+type APIKeyStore interface {
+	SaveAPIKey(ctx context.Context, key APIKey) error
+	GetAPIKey(ctx context.Context, id string) (APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+}
+
+// CreateAPIKey stores a new key and returns it with its secret, which can't be retrieved later.
+func (mr *AuthRepository) CreateAPIKey(ctx context.Context, creator *Identity, name, tenant string, keyScopes []string) (APIKey, string, error) {
+	for _, scope := range keyScopes {
+		if !validScope(scope) {
+			return APIKey{}, "", fmt.Errorf("%w: %s", ErrUnknownScope, scope)
+		}
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return APIKey{}, "", err
+	}
+	secret := hex.EncodeToString(random)
+
+	key := APIKey{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Scopes:    keyScopes,
+		Tenant:    tenant,
+		Hash:      hashSecret(secret),
+		CreatedBy: creator.UserID,
+		CreatedAt: time.Now(),
+	}
+
+	if err := mr.apiKeys.SaveAPIKey(ctx, key); err != nil {
+		return APIKey{}, "", err
+	}
+
+	key.Hash = ""
+	return key, apiKeyPrefix + key.ID + "." + secret, nil
+}
+
+// ListAPIKeys returns the keys without their hashes.
+func (mr *AuthRepository) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	keys, err := mr.apiKeys.ListAPIKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey disables a key, it stays listed for auditing.
+func (mr *AuthRepository) RevokeAPIKey(ctx context.Context, id string) error {
+	key, err := mr.apiKeys.GetAPIKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if key.RevokedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	key.RevokedAt = &now
+	return mr.apiKeys.SaveAPIKey(ctx, key)
+}
+
+// authenticateAPIKey resolves the identity of a "vh_{id}.{secret}" bearer token.
+func (mr *AuthRepository) authenticateAPIKey(ctx context.Context, token string) (*Identity, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), ".")
+	if !ok || mr.apiKeys == nil {
+		return nil, ErrInvalidCredentials
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	key, err := mr.apiKeys.GetAPIKey(ctx, id)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	if key.RevokedAt != nil {
+		return nil, ErrKeyRevoked
+	}
+
+	return key.identity(), nil
+}
+
+// activeAPIKeyIdentity returns the current identity of the key of identity, which must not be revoked.
+func (mr *AuthRepository) activeAPIKeyIdentity(ctx context.Context, identity *Identity) (*Identity, error) {
+	id, ok := strings.CutPrefix(identity.UserID, apiKeyUserPrefix)
+	if !ok || mr.apiKeys == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	key, err := mr.apiKeys.GetAPIKey(ctx, id)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if key.RevokedAt != nil {
+		return nil, ErrKeyRevoked
+	}
+
+	return key.identity(), nil
+}
+
+// the secrets are random, a plain hash is enough to protect them at rest
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
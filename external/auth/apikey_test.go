@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memoryKeyStore keeps the API keys in memory.
+type memoryKeyStore struct {
+	mutex sync.Mutex
+	keys  map[string]APIKey
+}
+
+func newMemoryKeyStore() *memoryKeyStore {
+	return &memoryKeyStore{keys: map[string]APIKey{}}
+}
+
+func (s *memoryKeyStore) SaveAPIKey(ctx context.Context, key APIKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *memoryKeyStore) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, errors.New("no such key")
+	}
+	return key, nil
+}
+
+func (s *memoryKeyStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var keys []APIKey
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+var apiKeyTokenPattern = regexp.MustCompile(`^vh_[0-9a-f-]{36}\.[0-9a-f]{64}$`)
+
+func TestCreateAPIKey(t *testing.T) {
+	store := newMemoryKeyStore()
+	repository := newTestRepository(t, "", store)
+	creator := &Identity{UserID: "admin", Roles: []string{RoleAdmin}}
+
+	key, token, err := repository.CreateAPIKey(context.Background(), creator, "ci", "acme", []string{ScopeVideosWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !apiKeyTokenPattern.MatchString(token) {
+		t.Errorf("the token %q isn't vh_{id}.{secret}", token)
+	}
+	if key.Hash != "" || key.CreatedBy != "admin" || key.Tenant != "acme" {
+		t.Errorf("the created key is %+v", key)
+	}
+
+	// only the hash of the secret is stored
+	_, secret, _ := strings.Cut(token, ".")
+	stored, _ := store.GetAPIKey(context.Background(), key.ID)
+	if stored.Hash != hashSecret(secret) || strings.Contains(stored.Hash, secret) {
+		t.Errorf("the stored hash is %q", stored.Hash)
+	}
+
+	keys, err := repository.ListAPIKeys(context.Background())
+	if err != nil || len(keys) != 1 || keys[0].Hash != "" {
+		t.Errorf("ListAPIKeys returned %+v, %v, want the key without its hash", keys, err)
+	}
+
+	if _, _, err := repository.CreateAPIKey(context.Background(), creator, "ci", "", []string{"videos:delete"}); !errors.Is(err, ErrUnknownScope) {
+		t.Errorf("a key with an unknown scope returned %v, want %v", err, ErrUnknownScope)
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	repository := newTestRepository(t, "", newMemoryKeyStore())
+	creator := &Identity{UserID: "admin"}
+
+	uploader, uploaderToken, err := repository.CreateAPIKey(context.Background(), creator, "uploader", "acme", []string{ScopeVideosWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, adminToken, err := repository.CreateAPIKey(context.Background(), creator, "ops", "", []string{ScopeAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, secret, _ := strings.Cut(strings.TrimPrefix(uploaderToken, apiKeyPrefix), ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"the token", uploaderToken, nil},
+		{"another secret", apiKeyPrefix + id + "." + strings.Repeat("0", len(secret)), ErrInvalidCredentials},
+		{"the hash as secret", apiKeyPrefix + id + "." + hashSecret(secret), ErrInvalidCredentials},
+		{"without secret", apiKeyPrefix + id, ErrInvalidCredentials},
+		{"an id which isn't a uuid", apiKeyPrefix + "uploader." + secret, ErrInvalidCredentials},
+		{"an unknown id", apiKeyPrefix + "0b7a7c2e-8a4e-4a8e-9d1c-3f7f1c2b9a10." + secret, ErrInvalidCredentials},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/video-list", nil)
+			r.Header.Set("Authorization", "Bearer "+test.token)
+
+			identity, err := repository.Authenticate(httptest.NewRecorder(), r)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Authenticate returned %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if identity.UserID != apiKeyUserPrefix+uploader.ID || identity.Tenant != "acme" || !identity.IsAPIKey() {
+				t.Errorf("the identity is %+v", identity)
+			}
+			if !identity.HasScope(ScopeVideosWrite) || identity.HasScope(ScopeStreamsPublish) || identity.HasRole(RoleAdmin) {
+				t.Errorf("the identity %+v doesn't have the scopes of the key", identity)
+			}
+		})
+	}
+
+	identity, err := repository.authenticateAPIKey(context.Background(), adminToken)
+	if err != nil || !identity.HasRole(RoleAdmin) || !identity.HasScope(ScopeStreamsPublish) {
+		t.Errorf("the admin key authenticated as %+v, %v", identity, err)
+	}
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	repository := newTestRepository(t, "", newMemoryKeyStore())
+
+	key, token, err := repository.CreateAPIKey(context.Background(), &Identity{UserID: "admin"}, "ci", "", []string{ScopeVideosWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := repository.authenticateAPIKey(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := repository.IssueSessionToken(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repository.VerifySessionToken(context.Background(), session); err != nil {
+		t.Fatalf("the session token of the key is refused: %v", err)
+	}
+
+	if err := repository.RevokeAPIKey(context.Background(), key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repository.authenticateAPIKey(context.Background(), token); !errors.Is(err, ErrKeyRevoked) {
+		t.Errorf("the revoked key returned %v, want %v", err, ErrKeyRevoked)
+	}
+
+	// the session tokens minted from the key don't outlive it
+	if _, err := repository.VerifySessionToken(context.Background(), session); !errors.Is(err, ErrKeyRevoked) {
+		t.Errorf("the session token of the revoked key returned %v, want %v", err, ErrKeyRevoked)
+	}
+
+	// revoking again keeps the first date, the key stays listed
+	keys, _ := repository.ListAPIKeys(context.Background())
+	revokedAt := *keys[0].RevokedAt
+	if err := repository.RevokeAPIKey(context.Background(), key.ID); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ = repository.ListAPIKeys(context.Background())
+	if len(keys) != 1 || !keys[0].RevokedAt.Equal(revokedAt) {
+		t.Errorf("the keys are %+v after a second revocation", keys)
+	}
+}
+
+func TestSessionTokenCantForgeAPIKey(t *testing.T) {
+	repository := newTestRepository(t, "", newMemoryKeyStore())
+
+	// a key which doesn't exist can't be claimed through a session token
+	session, err := repository.IssueSessionToken(&Identity{UserID: apiKeyUserPrefix + "0b7a7c2e-8a4e-4a8e-9d1c-3f7f1c2b9a10", Scopes: []string{ScopeAdmin}, APIKey: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity, err := repository.VerifySessionToken(context.Background(), session); err == nil {
+		t.Errorf("the session token of an unknown key authenticated %+v", identity)
+	}
+
+	// users don't need a key store
+	session, err = repository.IssueSessionToken(&Identity{UserID: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity, err := repository.VerifySessionToken(context.Background(), session); err != nil || identity.UserID != "user" {
+		t.Errorf("the session token of a user returned %+v, %v", identity, err)
+	}
+}
@@ -0,0 +1,299 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// minimal interval between two reloads triggered by an unknown key id
+	jwksMinRefreshInterval = 30 * time.Second
+	jwksLoadTimeout        = 10 * time.Second
+)
+
+var ErrUnknownKey = errors.New("unknown JWT signing key")
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// signingKey is a key of the set with the algorithms it may verify, a token signed with
+// another algorithm is rejected.
+type signingKey struct {
+	key     any
+	methods []string
+}
+
+// jwksCache loads the signing keys from a JWKS file or URL and keeps them for ttl.
+type jwksCache struct {
+	source string
+	ttl    time.Duration
+	client *http.Client
+
+	mutex    sync.Mutex
+	keys     map[string]signingKey
+	loadedAt time.Time
+	// loading is closed when the running load ends, nil when none runs
+	loading    chan struct{}
+	attemptAt  time.Time
+	attemptErr error
+}
+
+func newJwksCache(source string, ttl time.Duration, client *http.Client) *jwksCache {
+	return &jwksCache{
+		source: source,
+		ttl:    ttl,
+		client: client,
+		keys:   map[string]signingKey{},
+	}
+}
+
+// key returns the key with the given id. A stale set is reloaded in the background while its keys are
+// still served, an unknown id waits for a reload. The source is fetched without holding the lock.
+func (jc *jwksCache) key(ctx context.Context, kid string) (signingKey, error) {
+	jc.mutex.Lock()
+	key, ok := jc.lookup(kid)
+	stale := time.Since(jc.loadedAt) > jc.ttl
+	switch {
+	case ok && !stale:
+		jc.mutex.Unlock()
+		return key, nil
+
+	case ok:
+		// keep serving the previous keys while the source is reloaded or temporarily unavailable
+		jc.startLoad()
+		jc.mutex.Unlock()
+		return key, nil
+
+	case time.Since(jc.attemptAt) < jwksMinRefreshInterval && jc.loading == nil:
+		err := jc.attemptErr
+		jc.mutex.Unlock()
+		if err != nil {
+			return signingKey{}, err
+		}
+		return signingKey{}, ErrUnknownKey
+	}
+
+	loading := jc.startLoad()
+	jc.mutex.Unlock()
+
+	select {
+	case <-loading:
+	case <-ctx.Done():
+		return signingKey{}, ctx.Err()
+	}
+
+	jc.mutex.Lock()
+	defer jc.mutex.Unlock()
+
+	if key, ok := jc.lookup(kid); ok {
+		return key, nil
+	}
+	if jc.attemptErr != nil {
+		return signingKey{}, jc.attemptErr
+	}
+	return signingKey{}, ErrUnknownKey
+}
+
+// startLoad starts a reload unless one is running and returns the channel closed when it ends,
+// the lock must be held.
+func (jc *jwksCache) startLoad() chan struct{} {
+	if jc.loading != nil {
+		return jc.loading
+	}
+
+	loading := make(chan struct{})
+	jc.loading = loading
+	go func() {
+		defer close(loading)
+
+		// the load serves the following requests too, it doesn't end with the request which started it
+		ctx, cancel := context.WithTimeout(context.Background(), jwksLoadTimeout)
+		defer cancel()
+		keys, err := jc.load(ctx)
+
+		jc.mutex.Lock()
+		defer jc.mutex.Unlock()
+
+		jc.loading = nil
+		jc.attemptAt = time.Now()
+		jc.attemptErr = err
+		if err == nil {
+			jc.keys = keys
+			jc.loadedAt = jc.attemptAt
+		}
+	}()
+	return loading
+}
+
+func (jc *jwksCache) lookup(kid string) (signingKey, bool) {
+	if kid == "" && len(jc.keys) == 1 {
+		for _, key := range jc.keys {
+			return key, true
+		}
+	}
+	key, ok := jc.keys[kid]
+	return key, ok
+}
+
+func (jc *jwksCache) load(ctx context.Context) (map[string]signingKey, error) {
+	raw, err := jc.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var set jsonWebKeySet
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]signingKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode JWK %s: %w", jwk.Kid, err)
+		}
+		methods, err := jwk.methods()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode JWK %s: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = signingKey{key: key, methods: methods}
+	}
+
+	return keys, nil
+}
+
+func (jc *jwksCache) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(jc.source, "http://") && !strings.HasPrefix(jc.source, "https://") {
+		return os.ReadFile(strings.TrimPrefix(jc.source, "file://"))
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, jc.source, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := jc.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s", response.Status)
+	}
+
+	return io.ReadAll(response.Body)
+}
+
+func (jwk jsonWebKey) publicKey() (any, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(jwk.K)
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+// methods returns the algorithms the key verifies: its alg when set, which must match its type,
+// or every algorithm of its type.
+func (jwk jsonWebKey) methods() ([]string, error) {
+	var methods []string
+	switch jwk.Kty {
+	case "RSA":
+		methods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case "EC":
+		switch jwk.Crv {
+		case "P-256":
+			methods = []string{"ES256"}
+		case "P-384":
+			methods = []string{"ES384"}
+		case "P-521":
+			methods = []string{"ES512"}
+		}
+	case "oct":
+		methods = []string{"HS256", "HS384", "HS512"}
+	}
+
+	if jwk.Alg == "" {
+		return methods, nil
+	}
+	for _, method := range methods {
+		if method == jwk.Alg {
+			return []string{jwk.Alg}, nil
+		}
+	}
+	return nil, fmt.Errorf("algorithm %s doesn't match the key type %s", jwk.Alg, jwk.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
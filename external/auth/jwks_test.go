@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"video-handler/configs"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   string = "https://auth.example.com"
+	testAudience string = "video-handler"
+	testCookie   string = "access_token"
+)
+
+// jwksServer serves a JWKS which can be rotated and counts its fetches.
+type jwksServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+
+	mutex sync.Mutex
+	keys  []jsonWebKey
+}
+
+func newJwksServer(t *testing.T, keys ...jsonWebKey) *jwksServer {
+	t.Helper()
+
+	server := &jwksServer{keys: keys}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.fetches.Add(1)
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		json.NewEncoder(w).Encode(jsonWebKeySet{Keys: server.keys})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *jwksServer) rotate(keys ...jsonWebKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keys
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func rsaJWK(kid, alg string, key *rsa.PrivateKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: alg,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// newTestRepository authenticates users with the tokens of the JWKS of source and API keys with store.
+func newTestRepository(t *testing.T, source string, store APIKeyStore) *AuthRepository {
+	t.Helper()
+
+	repository, err := NewAuthRepository(&configs.ExternalAuthService{
+		AccessTokenCookieName:  testCookie,
+		RefreshTokenCookieName: "refresh_token",
+		LoginPageURL:           "/login",
+		JWKSSource:             source,
+		JWKSCacheTTL:           time.Minute,
+		JWTIssuer:              testIssuer,
+		JWTAudience:            testAudience,
+		Timeout:                5 * time.Second,
+		SigningKey:             "test signing key",
+		SessionTokenTTL:        time.Minute,
+		PlaybackTokenTTL:       time.Hour,
+	}, store, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repository
+}
+
+func validClaims(subject string) jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		Subject:   subject,
+		Issuer:    testIssuer,
+		Audience:  jwt.ClaimStrings{testAudience},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, claims jwt.Claims, key any) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// cookieRequest is a request of a browser holding the access token.
+func cookieRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/video-list", nil)
+	r.AddCookie(&http.Cookie{Name: testCookie, Value: token})
+	return r
+}
+
+func TestValidateLocally(t *testing.T) {
+	key := newRSAKey(t)
+	pinnedKey := newRSAKey(t)
+	otherKey := newRSAKey(t)
+	server := newJwksServer(t, rsaJWK("k1", "", key), rsaJWK("pinned", "RS384", pinnedKey))
+	repository := newTestRepository(t, server.URL, nil)
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := validClaims("user")
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	withoutExpiry := validClaims("user")
+	withoutExpiry.ExpiresAt = nil
+	otherIssuer := validClaims("user")
+	otherIssuer.Issuer = "https://evil.example.com"
+	otherAudience := validClaims("user")
+	otherAudience.Audience = jwt.ClaimStrings{"another-service"}
+	apiKeyUser := validClaims(apiKeyUserPrefix + "0b7a7c2e-8a4e-4a8e-9d1c-3f7f1c2b9a10")
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256 with its key", signToken(t, jwt.SigningMethodRS256, "k1", validClaims("user"), key), true},
+		{"RS512 with a key without alg", signToken(t, jwt.SigningMethodRS512, "k1", validClaims("user"), key), true},
+		{"RS384 with its pinned key", signToken(t, jwt.SigningMethodRS384, "pinned", validClaims("user"), pinnedKey), true},
+		{"RS256 with a key pinned to RS384", signToken(t, jwt.SigningMethodRS256, "pinned", validClaims("user"), pinnedKey), false},
+		{"HS256 with the RSA public key as secret", signToken(t, jwt.SigningMethodHS256, "k1", validClaims("user"), publicKey), false},
+		{"signed by another key", signToken(t, jwt.SigningMethodRS256, "k1", validClaims("user"), otherKey), false},
+		{"unknown kid", signToken(t, jwt.SigningMethodRS256, "k2", validClaims("user"), key), false},
+		{"without kid among several keys", signToken(t, jwt.SigningMethodRS256, "", validClaims("user"), key), false},
+		{"expired", signToken(t, jwt.SigningMethodRS256, "k1", expired, key), false},
+		{"without expiry", signToken(t, jwt.SigningMethodRS256, "k1", withoutExpiry, key), false},
+		{"another issuer", signToken(t, jwt.SigningMethodRS256, "k1", otherIssuer, key), false},
+		{"another audience", signToken(t, jwt.SigningMethodRS256, "k1", otherAudience, key), false},
+		{"the user id of an API key", signToken(t, jwt.SigningMethodRS256, "k1", apiKeyUser, key), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := repository.Authenticate(httptest.NewRecorder(), cookieRequest(test.token))
+			if test.ok && (err != nil || identity.UserID != "user") {
+				t.Errorf("Authenticate returned %+v, %v, want the user", identity, err)
+			}
+			if !test.ok && err == nil {
+				t.Errorf("Authenticate accepted %+v", identity)
+			}
+		})
+	}
+}
+
+func TestValidateLocallyWithoutKid(t *testing.T) {
+	key := newRSAKey(t)
+	server := newJwksServer(t, rsaJWK("only", "RS256", key))
+	repository := newTestRepository(t, server.URL, nil)
+
+	// a single key verifies the tokens without kid
+	token := signToken(t, jwt.SigningMethodRS256, "", validClaims("user"), key)
+	if identity, err := repository.Authenticate(httptest.NewRecorder(), cookieRequest(token)); err != nil || identity.UserID != "user" {
+		t.Errorf("Authenticate returned %+v, %v, want the user", identity, err)
+	}
+}
+
+func TestJwksRefreshOnUnknownKid(t *testing.T) {
+	oldKey := newRSAKey(t)
+	newKey := newRSAKey(t)
+	server := newJwksServer(t, rsaJWK("old", "", oldKey))
+	repository := newTestRepository(t, server.URL, nil)
+
+	oldToken := signToken(t, jwt.SigningMethodRS256, "old", validClaims("user"), oldKey)
+	if _, err := repository.Authenticate(httptest.NewRecorder(), cookieRequest(oldToken)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repository.Authenticate(httptest.NewRecorder(), cookieRequest(oldToken)); err != nil {
+		t.Fatal(err)
+	}
+	if fetches := server.fetches.Load(); fetches != 1 {
+		t.Fatalf("the JWKS was fetched %d times, want once for the cached key", fetches)
+	}
+
+	// the issuer rotates its key
+	server.rotate(rsaJWK("old", "", oldKey), rsaJWK("new", "", newKey))
+	newToken := signToken(t, jwt.SigningMethodRS256, "new", validClaims("user"), newKey)
+
+	// right after a load, an unknown kid doesn't hit the source again
+	if _, err := repository.jwks.key(context.Background(), "new"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("the key of the new kid returned %v, want %v", err, ErrUnknownKey)
+	}
+	if fetches := server.fetches.Load(); fetches != 1 {
+		t.Errorf("the JWKS was fetched %d times, want once within %s", fetches, jwksMinRefreshInterval)
+	}
+
+	repository.jwks.mutex.Lock()
+	repository.jwks.attemptAt = time.Now().Add(-jwksMinRefreshInterval)
+	repository.jwks.mutex.Unlock()
+
+	if identity, err := repository.Authenticate(httptest.NewRecorder(), cookieRequest(newToken)); err != nil || identity.UserID != "user" {
+		t.Errorf("Authenticate returned %+v, %v after the refresh, want the user", identity, err)
+	}
+	if fetches := server.fetches.Load(); fetches != 2 {
+		t.Errorf("the JWKS was fetched %d times, want a reload for the unknown kid", fetches)
+	}
+}
+
+func TestJwksServesStaleKeysWhileReloading(t *testing.T) {
+	key := newRSAKey(t)
+	server := newJwksServer(t, rsaJWK("k1", "", key))
+	repository := newTestRepository(t, server.URL, nil)
+
+	if _, err := repository.jwks.key(context.Background(), "k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the source goes down once the set is stale
+	server.Close()
+	repository.jwks.mutex.Lock()
+	repository.jwks.loadedAt = time.Now().Add(-2 * repository.jwks.ttl)
+	repository.jwks.mutex.Unlock()
+
+	if _, err := repository.jwks.key(context.Background(), "k1"); err != nil {
+		t.Errorf("the stale key isn't served: %v", err)
+	}
+}
+
+func TestJsonWebKeyMethods(t *testing.T) {
+	tests := []struct {
+		jwk  jsonWebKey
+		want []string
+		ok   bool
+	}{
+		{jsonWebKey{Kty: "RSA"}, []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}, true},
+		{jsonWebKey{Kty: "RSA", Alg: "PS256"}, []string{"PS256"}, true},
+		{jsonWebKey{Kty: "RSA", Alg: "HS256"}, nil, false},
+		{jsonWebKey{Kty: "EC", Crv: "P-256"}, []string{"ES256"}, true},
+		{jsonWebKey{Kty: "EC", Crv: "P-384", Alg: "ES256"}, nil, false},
+		{jsonWebKey{Kty: "oct", Alg: "RS256"}, nil, false},
+		{jsonWebKey{Kty: "oct"}, []string{"HS256", "HS384", "HS512"}, true},
+	}
+
+	for _, test := range tests {
+		methods, err := test.jwk.methods()
+		if (err == nil) != test.ok {
+			t.Errorf("methods of %+v returned %v", test.jwk, err)
+			continue
+		}
+		if len(methods) != len(test.want) {
+			t.Errorf("methods of %+v are %q, want %q", test.jwk, methods, test.want)
+			continue
+		}
+		for i := range methods {
+			if methods[i] != test.want[i] {
+				t.Errorf("methods of %+v are %q, want %q", test.jwk, methods, test.want)
+				break
+			}
+		}
+	}
+}
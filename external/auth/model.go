@@ -1,6 +1,108 @@
 package auth
 
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	RoleAdmin string = "admin"
+)
+
 type Token struct {
 	Access  string
 	Refresh string
-}
\ No newline at end of file
+}
+
+// Identity is the user resolved from the request credentials.
+type Identity struct {
+	UserID   string   `json:"user_id"`
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Roles    []string `json:"roles"`
+	Tenant   string   `json:"tenant"`
+	// Scopes limit what an API key may do, users aren't limited by scopes.
+	Scopes []string `json:"scopes,omitempty"`
+	// APIKey is set when an API key authenticated the request, it's kept in session tokens
+	APIKey bool `json:"api_key,omitempty"`
+}
+
+func (i *Identity) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAPIKey tells whether the identity was authenticated with an API key.
+func (i *Identity) IsAPIKey() bool {
+	return i.APIKey
+}
+
+// HasScope tells whether the identity may act within scope, the admin scope grants every scope.
+func (i *Identity) HasScope(scope string) bool {
+	if !i.IsAPIKey() || scope == "" {
+		return true
+	}
+	for _, s := range i.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type claims struct {
+	jwt.RegisteredClaims
+	Username          string   `json:"username"`
+	PreferredUsername string   `json:"preferred_username"`
+	Email             string   `json:"email"`
+	Roles             []string `json:"roles"`
+	Tenant            string   `json:"tenant"`
+}
+
+func (c *claims) identity() *Identity {
+	username := c.Username
+	if username == "" {
+		username = c.PreferredUsername
+	}
+
+	return &Identity{
+		UserID:   c.Subject,
+		Username: username,
+		Email:    c.Email,
+		Roles:    c.Roles,
+		Tenant:   c.Tenant,
+	}
+}
+
+// userIdentity is the identity of a user token, which can't pass for an API key.
+func (c *claims) userIdentity() (*Identity, error) {
+	return checkUserIdentity(c.identity())
+}
+
+// checkUserIdentity refuses user ids of API keys, which would give access to what the key owns.
+func checkUserIdentity(identity *Identity) (*Identity, error) {
+	if strings.HasPrefix(identity.UserID, apiKeyUserPrefix) {
+		return nil, fmt.Errorf("%w: reserved user id %s", ErrInvalidCredentials, identity.UserID)
+	}
+	return identity, nil
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the identity.
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity injected by the authenticator, if any.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok && identity != nil
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	playbackTokenType string = "playback"
+)
+
+// PlaybackGrant is what a playback token allows: reading a stream, or any stream of a video,
+// optionally from a single IP. The issuer must still be allowed to read the video when the token is used.
+type PlaybackGrant struct {
+	StreamID string    `json:"stream_id,omitempty"`
+	Video    string    `json:"video,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Issuer   *Identity `json:"issuer"`
+}
+
+// AllowsIP tells whether the grant may be used from ip.
+func (g *PlaybackGrant) AllowsIP(ip net.IP) bool {
+	return g.IP == "" || net.ParseIP(g.IP).Equal(ip)
+}
+
+type playbackToken struct {
+	Type  string         `json:"typ"`
+	Grant *PlaybackGrant `json:"grant"`
+}
+
+// IssuePlaybackToken signs grant into a token which can be embedded in playback URLs and returns its expiry.
+// ttl is capped at the configured playback token TTL, zero means the maximum.
+func (mr *AuthRepository) IssuePlaybackToken(grant *PlaybackGrant, ttl time.Duration) (string, time.Time, error) {
+	if ttl <= 0 || ttl > mr.configs.PlaybackTokenTTL {
+		ttl = mr.configs.PlaybackTokenTTL
+	}
+
+	token, err := mr.signer.Sign(playbackToken{
+		Type:  playbackTokenType,
+		Grant: grant,
+	}, ttl)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, time.Now().Add(ttl), nil
+}
+
+// VerifyPlaybackToken returns the grant of a token issued by IssuePlaybackToken.
+func (mr *AuthRepository) VerifyPlaybackToken(token string) (*PlaybackGrant, error) {
+	var playback playbackToken
+	if err := mr.signer.Verify(token, &playback); err != nil {
+		return nil, err
+	}
+	if playback.Type != playbackTokenType || playback.Grant == nil || playback.Grant.Issuer == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return playback.Grant, nil
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Policy decides who may reach a route.
+type Policy struct {
+	// Public routes are served without credentials.
+	Public bool
+	// Roles restricts the route to identities having at least one of them.
+	Roles []string
+	// Scope is required from API keys, which don't have roles.
+	Scope string
+}
+
+var (
+	PublicPolicy        = Policy{Public: true}
+	AuthenticatedPolicy = Policy{}
+	AdminPolicy         = Policy{Roles: []string{RoleAdmin}, Scope: ScopeAdmin}
+)
+
+// RolePolicy restricts a route to the given roles.
+func RolePolicy(roles ...string) Policy {
+	return Policy{Roles: roles}
+}
+
+// Allows tells whether identity satisfies the role restriction of the policy,
+// or its scope for API keys. Role restricted routes without scope are left to admin keys.
+func (p Policy) Allows(identity *Identity) bool {
+	if identity.IsAPIKey() {
+		if p.Scope == "" && len(p.Roles) > 0 {
+			return identity.HasScope(ScopeAdmin)
+		}
+		return identity.HasScope(p.Scope)
+	}
+
+	if len(p.Roles) == 0 {
+		return true
+	}
+	for _, role := range p.Roles {
+		if identity.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+type errorResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// Require returns a chi middleware enforcing the policy.
+// Browsers asking for HTML pages are redirected to the login page, API calls receive JSON 401/403 errors.
+func (mr *AuthRepository) Require(policy Policy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if policy.Public {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			identity, err := mr.Authenticate(w, r)
+			if err != nil {
+				mr.logger.Info("request is not authenticated", "path", r.URL.Path, "err", err.Error())
+				if mr.onFailure != nil && !errors.Is(err, ErrNoCredentials) {
+					mr.onFailure(r, err)
+				}
+				if wantsHTML(r) {
+					http.Redirect(w, r, mr.configs.LoginPageURL, http.StatusFound)
+					return
+				}
+				writeError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+
+			if !policy.Allows(identity) {
+				mr.logger.Info("request is forbidden", "path", r.URL.Path, "user_id", identity.UserID)
+				writeError(w, http.StatusForbidden, "access denied")
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+		})
+	}
+}
+
+// RequireBearer protects machine endpoints like /metrics with a static bearer token.
+// An empty token leaves the route public.
+func RequireBearer(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			bearer, ok := BearerToken(r)
+			if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				writeError(w, http.StatusUnauthorized, "invalid bearer token")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// BearerToken extracts the token of an "Authorization: Bearer" header.
+func BearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+func wantsHTML(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{
+		Status: status,
+		Error:  message,
+	})
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestPolicyAllows(t *testing.T) {
+	user := &Identity{UserID: "user"}
+	admin := &Identity{UserID: "admin", Roles: []string{RoleAdmin}}
+	uploader := &Identity{UserID: apiKeyUserPrefix + "uploader", Scopes: []string{ScopeVideosWrite}, APIKey: true}
+	adminKey := &Identity{UserID: apiKeyUserPrefix + "admin", Scopes: []string{ScopeAdmin}, Roles: []string{RoleAdmin}, APIKey: true}
+
+	tests := []struct {
+		name     string
+		policy   Policy
+		identity *Identity
+		want     bool
+	}{
+		{"authenticated user", AuthenticatedPolicy, user, true},
+		{"authenticated key", AuthenticatedPolicy, uploader, true},
+		{"admin route for a user", AdminPolicy, user, false},
+		{"admin route for an admin", AdminPolicy, admin, true},
+		{"admin route for a key without the scope", AdminPolicy, uploader, false},
+		{"admin route for an admin key", AdminPolicy, adminKey, true},
+		{"scoped route for a user", Policy{Scope: ScopeVideosWrite}, user, true},
+		{"scoped route for a key with the scope", Policy{Scope: ScopeVideosWrite}, uploader, true},
+		{"scoped route for a key without the scope", Policy{Scope: ScopeStreamsPublish}, uploader, false},
+		{"scoped route for an admin key", Policy{Scope: ScopeStreamsPublish}, adminKey, true},
+		{"role route for a key", RolePolicy("editor"), uploader, false},
+		{"role route for an admin key", RolePolicy("editor"), adminKey, true},
+		{"role route for a user with the role", RolePolicy("editor", "viewer"), &Identity{UserID: "user", Roles: []string{"viewer"}}, true},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.Allows(test.identity); got != test.want {
+			t.Errorf("%s: Allows returned %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	key := newRSAKey(t)
+	server := newJwksServer(t, rsaJWK("k1", "", key))
+	repository := newTestRepository(t, server.URL, nil)
+
+	var failures []error
+	repository.OnAuthenticationFailure(func(r *http.Request, err error) {
+		failures = append(failures, err)
+	})
+
+	adminClaims := &claims{RegisteredClaims: validClaims("admin"), Roles: []string{RoleAdmin}}
+	userToken := signToken(t, jwt.SigningMethodRS256, "k1", validClaims("user"), key)
+	adminToken := signToken(t, jwt.SigningMethodRS256, "k1", adminClaims, key)
+	forgedToken := signToken(t, jwt.SigningMethodRS256, "k1", validClaims("user"), newRSAKey(t))
+
+	tests := []struct {
+		name     string
+		policy   Policy
+		method   string
+		accept   string
+		token    string
+		status   int
+		location string
+		failure  bool
+	}{
+		{name: "public route without credentials", policy: PublicPolicy, method: http.MethodGet, status: http.StatusOK},
+		{name: "API call without credentials", policy: AuthenticatedPolicy, method: http.MethodGet, accept: "application/json", status: http.StatusUnauthorized},
+		{name: "page without credentials", policy: AuthenticatedPolicy, method: http.MethodGet, accept: "text/html,application/xhtml+xml", status: http.StatusFound, location: "/login"},
+		{name: "form post without credentials", policy: AuthenticatedPolicy, method: http.MethodPost, accept: "text/html", status: http.StatusUnauthorized},
+		{name: "page with a forged token", policy: AuthenticatedPolicy, method: http.MethodGet, accept: "text/html", token: forgedToken, status: http.StatusFound, location: "/login", failure: true},
+		{name: "API call with a forged token", policy: AuthenticatedPolicy, method: http.MethodGet, token: forgedToken, status: http.StatusUnauthorized, failure: true},
+		{name: "authenticated user", policy: AuthenticatedPolicy, method: http.MethodGet, token: userToken, status: http.StatusOK},
+		{name: "admin route for a user", policy: AdminPolicy, method: http.MethodGet, accept: "text/html", token: userToken, status: http.StatusForbidden},
+		{name: "admin route for an admin", policy: AdminPolicy, method: http.MethodGet, token: adminToken, status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			failures = nil
+
+			var identity *Identity
+			handler := repository.Require(test.policy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				identity, _ = IdentityFromContext(r.Context())
+			}))
+
+			r := httptest.NewRequest(test.method, "/video-list", nil)
+			if test.accept != "" {
+				r.Header.Set("Accept", test.accept)
+			}
+			if test.token != "" {
+				r.AddCookie(&http.Cookie{Name: testCookie, Value: test.token})
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("answered %d, want %d", w.Code, test.status)
+			}
+			if location := w.Header().Get("Location"); location != test.location {
+				t.Errorf("redirected to %q, want %q", location, test.location)
+			}
+			if (len(failures) > 0) != test.failure {
+				t.Errorf("reported the failures %v", failures)
+			}
+
+			switch test.status {
+			case http.StatusOK:
+				if !test.policy.Public && identity == nil {
+					t.Errorf("the handler has no identity")
+				}
+			case http.StatusUnauthorized, http.StatusForbidden:
+				var response errorResponse
+				if err := json.NewDecoder(w.Body).Decode(&response); err != nil || response.Status != test.status {
+					t.Errorf("the error is %+v, %v, want a JSON error %d", response, err, test.status)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireBearer(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		status        int
+	}{
+		{"without token configured", "", "", http.StatusOK},
+		{"without header", "s3cr3t", "", http.StatusUnauthorized},
+		{"with the token", "s3cr3t", "Bearer s3cr3t", http.StatusOK},
+		{"with a lower case scheme", "s3cr3t", "bearer s3cr3t", http.StatusOK},
+		{"with another token", "s3cr3t", "Bearer s3cr3", http.StatusUnauthorized},
+		{"with basic credentials", "s3cr3t", "Basic czNjcjN0", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := RequireBearer(test.token)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("answered %d, want %d", w.Code, test.status)
+			}
+			if test.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("the challenge is missing")
+			}
+		})
+	}
+}
+
+func TestRequireDoesNotReportMissingCredentials(t *testing.T) {
+	repository := newTestRepository(t, "", nil)
+
+	var failures []error
+	repository.OnAuthenticationFailure(func(r *http.Request, err error) {
+		failures = append(failures, err)
+	})
+
+	handler := repository.Require(AuthenticatedPolicy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/video-list", nil))
+	if len(failures) != 0 {
+		t.Errorf("a request without credentials reported %v", failures)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/video-list", nil)
+	r.Header.Set("Authorization", "Bearer "+apiKeyPrefix+"not-a-key")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if len(failures) != 1 || !errors.Is(failures[0], ErrInvalidCredentials) {
+		t.Errorf("a request with an invalid API key reported %v", failures)
+	}
+}
@@ -1,75 +1,290 @@
 package auth
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"strings"
 	"time"
 	"video-handler/configs"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrNoCredentials      = errors.New("no credentials provided")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+const (
+	sessionTokenType string = "session"
 )
 
 type Authentificatior interface {
 	VerifyCredentials(next http.Handler) http.Handler
+	Require(policy Policy) func(http.Handler) http.Handler
+	Authenticate(w http.ResponseWriter, r *http.Request) (*Identity, error)
+	IssueSessionToken(identity *Identity) (string, error)
+	VerifySessionToken(ctx context.Context, token string) (*Identity, error)
+	IssuePlaybackToken(grant *PlaybackGrant, ttl time.Duration) (string, time.Time, error)
+	VerifyPlaybackToken(token string) (*PlaybackGrant, error)
+	CreateAPIKey(ctx context.Context, creator *Identity, name, tenant string, scopes []string) (APIKey, string, error)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) error
 }
 
 type AuthRepository struct {
 	configs *configs.ExternalAuthService
+	client  *http.Client
+	jwks    *jwksCache
+	signer  *Signer
+	apiKeys APIKeyStore
 	logger  *slog.Logger
+	// onFailure is called when credentials are rejected
+	onFailure func(r *http.Request, err error)
 }
 
-func NewAuthRepository(authConfig *configs.ExternalAuthService, logger *slog.Logger) *AuthRepository {
+type sessionToken struct {
+	Type     string    `json:"typ"`
+	Identity *Identity `json:"identity"`
+}
+
+func NewAuthRepository(authConfig *configs.ExternalAuthService, apiKeys APIKeyStore, logger *slog.Logger) (*AuthRepository, error) {
+	client := &http.Client{
+		Timeout: authConfig.Timeout,
+	}
+
+	var jwks *jwksCache
+	if authConfig.JWKSSource != "" {
+		jwks = newJwksCache(authConfig.JWKSSource, authConfig.JWKSCacheTTL, client)
+	}
+
+	signer, err := NewSigner(authConfig.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	if authConfig.SigningKey == "" {
+		logger.Warn("no signing key configured, signed tokens won't survive a restart")
+	}
+
 	return &AuthRepository{
 		configs: authConfig,
+		client:  client,
+		jwks:    jwks,
+		signer:  signer,
+		apiKeys: apiKeys,
 		logger:  logger,
+	}, nil
+}
+
+// IssueSessionToken issues a short-lived token standing for identity,
+// used where cookies can't be sent like websocket handshakes from other origins.
+func (mr *AuthRepository) IssueSessionToken(identity *Identity) (string, error) {
+	return mr.signer.Sign(sessionToken{
+		Type:     sessionTokenType,
+		Identity: identity,
+	}, mr.configs.SessionTokenTTL)
+}
+
+// VerifySessionToken returns the identity of a token issued by IssueSessionToken.
+// The token of an API key is refused as soon as the key is revoked, not only once it expires.
+func (mr *AuthRepository) VerifySessionToken(ctx context.Context, token string) (*Identity, error) {
+	var session sessionToken
+	if err := mr.signer.Verify(token, &session); err != nil {
+		return nil, err
+	}
+	if session.Type != sessionTokenType || session.Identity == nil {
+		return nil, ErrInvalidCredentials
 	}
+	if session.Identity.IsAPIKey() {
+		return mr.activeAPIKeyIdentity(ctx, session.Identity)
+	}
+	return session.Identity, nil
+}
+
+// OnAuthenticationFailure registers a callback for requests whose credentials are rejected,
+// requests without credentials aren't reported.
+func (mr *AuthRepository) OnAuthenticationFailure(callback func(r *http.Request, err error)) {
+	mr.onFailure = callback
 }
 
+// VerifyCredentials lets only authenticated requests through.
 func (mr *AuthRepository) VerifyCredentials(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		verifyRequest, err := http.NewRequest(http.MethodPost, mr.configs.VerificationEndpoint, http.NoBody)
-		if err != nil {
-			mr.logger.Error("Bad!!!", "err", err)
-			return
-		}
+	return mr.Require(AuthenticatedPolicy)(next)
+}
 
-		http.Post("", "", nil)
+// Authenticate resolves the identity of the request from an API key bearer token or from its cookies.
+// The access token is validated locally when a JWKS is configured, otherwise or when the key is unknown
+// the verification endpoint decides. An expired or missing access token is refreshed with the refresh
+// cookie, and the new cookies are written to w.
+func (mr *AuthRepository) Authenticate(w http.ResponseWriter, r *http.Request) (*Identity, error) {
+	if bearer, ok := BearerToken(r); ok && strings.HasPrefix(bearer, apiKeyPrefix) {
+		return mr.authenticateAPIKey(r.Context(), bearer)
+	}
 
-		accessToken, err := r.Cookie(mr.configs.AccessTokenCookieName)
-		if err != nil {
-			mr.logger.Error("failed to get cookie access token", "err", err)
-		}
+	accessToken, _ := r.Cookie(mr.configs.AccessTokenCookieName)
+	refreshToken, _ := r.Cookie(mr.configs.RefreshTokenCookieName)
 
-		refreshToken, err := r.Cookie(mr.configs.RefreshTokenCookieName)
-		if err != nil {
-			mr.logger.Error("failed to get cookie refresh token", "err", err)
+	if accessToken != nil {
+		identity, err := mr.verifyToken(r.Context(), accessToken, refreshToken)
+		if err == nil {
+			return identity, nil
 		}
+		mr.logger.Debug("access token rejected", "err", err.Error())
+	}
 
-		if accessToken != nil {
-			verifyRequest.AddCookie(accessToken)
+	if refreshToken == nil {
+		if accessToken == nil {
+			return nil, ErrNoCredentials
 		}
+		return nil, ErrInvalidCredentials
+	}
 
-		if refreshToken != nil {
-			verifyRequest.AddCookie(refreshToken)
-		}
+	refreshedAccessToken, err := mr.refresh(r.Context(), w, refreshToken)
+	if err != nil {
+		return nil, err
+	}
 
-		verifyRequest.Header.Set("Content-Type", "application/json")
+	return mr.verifyToken(r.Context(), refreshedAccessToken, nil)
+}
 
-		client := http.Client{
-			Timeout: 30 * time.Second,
+func (mr *AuthRepository) verifyToken(ctx context.Context, accessToken, refreshToken *http.Cookie) (*Identity, error) {
+	if mr.jwks != nil {
+		identity, err := mr.validateLocally(ctx, accessToken.Value)
+		if err == nil {
+			return identity, nil
 		}
-
-		verifyResponse, err := client.Do(verifyRequest)
-		if err != nil {
-			fmt.Printf("client: error making http request: %s\n", err)
+		// only an unknown key is worth asking the auth service about, anything else is final
+		if !errors.Is(err, ErrUnknownKey) || mr.configs.VerificationEndpoint == "" {
+			return nil, err
 		}
+	}
+
+	return mr.verifyRemotely(ctx, accessToken, refreshToken)
+}
+
+func (mr *AuthRepository) validateLocally(ctx context.Context, accessToken string) (*Identity, error) {
+	options := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+	}
+	if mr.configs.JWTIssuer != "" {
+		options = append(options, jwt.WithIssuer(mr.configs.JWTIssuer))
+	}
+	if mr.configs.JWTAudience != "" {
+		options = append(options, jwt.WithAudience(mr.configs.JWTAudience))
+	}
+
+	unverified, _, err := jwt.NewParser().ParseUnverified(accessToken, &claims{})
+	if err != nil {
+		return nil, err
+	}
+	kid, _ := unverified.Header["kid"].(string)
+	key, err := mr.jwks.key(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the algorithms of the key are accepted, an RSA public key can't verify a HS256 token
+	options = append(options, jwt.WithValidMethods(key.methods))
+	var tokenClaims claims
+	_, err = jwt.ParseWithClaims(accessToken, &tokenClaims, func(token *jwt.Token) (any, error) {
+		return key.key, nil
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenClaims.userIdentity()
+}
+
+func (mr *AuthRepository) verifyRemotely(ctx context.Context, accessToken, refreshToken *http.Cookie) (*Identity, error) {
+	if mr.configs.VerificationEndpoint == "" {
+		return nil, errors.New("verification endpoint is not configured")
+	}
+
+	verifyRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, mr.configs.VerificationEndpoint, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	verifyRequest.Header.Set("Content-Type", "application/json")
+	verifyRequest.AddCookie(accessToken)
+	if refreshToken != nil {
+		verifyRequest.AddCookie(refreshToken)
+	}
+
+	verifyResponse, err := mr.client.Do(verifyRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify token: %w", err)
+	}
+	defer verifyResponse.Body.Close()
+
+	if verifyResponse.StatusCode != http.StatusOK && verifyResponse.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("%w: verification endpoint responded %s", ErrInvalidCredentials, verifyResponse.Status)
+	}
+
+	body, err := io.ReadAll(verifyResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{}
+	if err := json.Unmarshal(body, identity); err == nil && identity.UserID != "" {
+		// only authenticateAPIKey makes API key identities
+		identity.APIKey = false
+		return checkUserIdentity(identity)
+	}
+
+	// the endpoint accepted the token but didn't describe the user, trust the claims of the verified token
+	var tokenClaims claims
+	if _, _, err := jwt.NewParser().ParseUnverified(accessToken.Value, &tokenClaims); err != nil {
+		return nil, fmt.Errorf("failed to read token claims: %w", err)
+	}
+	return tokenClaims.userIdentity()
+}
+
+// refresh exchanges the refresh token for a new access token and forwards the issued cookies to the client.
+func (mr *AuthRepository) refresh(ctx context.Context, w http.ResponseWriter, refreshToken *http.Cookie) (*http.Cookie, error) {
+	if mr.configs.RefreshEndpoint == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	refreshRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, mr.configs.RefreshEndpoint, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
 
-		if !strings.Contains(verifyResponse.Status, "200") &&
-			!strings.Contains(verifyResponse.Status, "201") {
-			http.Redirect(w, r, mr.configs.LoginPageURL, http.StatusUnauthorized)
-			return
+	refreshRequest.Header.Set("Content-Type", "application/json")
+	refreshRequest.AddCookie(refreshToken)
+
+	refreshResponse, err := mr.client.Do(refreshRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh token: %w", err)
+	}
+	defer refreshResponse.Body.Close()
+
+	if refreshResponse.StatusCode != http.StatusOK && refreshResponse.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("%w: refresh endpoint responded %s", ErrInvalidCredentials, refreshResponse.Status)
+	}
+
+	var accessToken *http.Cookie
+	for _, cookie := range refreshResponse.Cookies() {
+		if w != nil {
+			http.SetCookie(w, cookie)
 		}
+		if cookie.Name == mr.configs.AccessTokenCookieName {
+			accessToken = cookie
+		}
+	}
+
+	if accessToken == nil {
+		return nil, errors.New("refresh endpoint didn't issue an access token")
+	}
 
-		next.ServeHTTP(w, r)
-	})
+	mr.logger.Debug("access token refreshed")
+	return accessToken, nil
 }
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testPayload struct {
+	UserID string `json:"user_id"`
+}
+
+// reencode replaces the envelope of token and keeps its signature.
+func reencode(t *testing.T, token string, change func(envelope *signedEnvelope)) string {
+	t.Helper()
+
+	body, signature, _ := strings.Cut(token, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope signedEnvelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		t.Fatal(err)
+	}
+
+	change(&envelope)
+	raw, err = json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw) + "." + signature
+}
+
+func TestSigner(t *testing.T) {
+	signer, err := NewSigner("signing key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSigner("another key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := signer.Sign(testPayload{UserID: "user"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := signer.Sign(testPayload{UserID: "user"}, -2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := other.Sign(testPayload{UserID: "user"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, _ := strings.Cut(token, ".")
+	_, foreignSignature, _ := strings.Cut(foreign, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"the token", token, nil},
+		{"expired", expired, ErrTokenExpired},
+		{"signed with another key", foreign, ErrTokenSignature},
+		{"another payload", reencode(t, token, func(envelope *signedEnvelope) {
+			envelope.Payload = json.RawMessage(`{"user_id":"admin"}`)
+		}), ErrTokenSignature},
+		{"a later expiry", reencode(t, expired, func(envelope *signedEnvelope) {
+			envelope.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		}), ErrTokenSignature},
+		{"a forged signature", body + "." + base64.RawURLEncoding.EncodeToString(make([]byte, 32)), ErrTokenSignature},
+		{"the signature of another token", body + "." + foreignSignature, ErrTokenSignature},
+		{"without signature", body, ErrMalformedToken},
+		{"a signature which isn't base64", body + ".not*base64", ErrMalformedToken},
+		{"empty", "", ErrMalformedToken},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var payload testPayload
+			err := signer.Verify(test.token, &payload)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Verify returned %v, want %v", err, test.err)
+			}
+			if err == nil && payload.UserID != "user" {
+				t.Errorf("the payload is %+v", payload)
+			}
+		})
+	}
+}
+
+func TestSignerWithRandomKey(t *testing.T) {
+	first, err := NewSigner("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewSigner("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tokens of a random key don't survive a restart
+	token, err := first.Sign(testPayload{UserID: "user"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Verify(token, &testPayload{}); err != nil {
+		t.Errorf("Verify returned %v", err)
+	}
+	if err := second.Verify(token, &testPayload{}); !errors.Is(err, ErrTokenSignature) {
+		t.Errorf("Verify with another random key returned %v, want %v", err, ErrTokenSignature)
+	}
+}
+
+func TestSignedTokenTypes(t *testing.T) {
+	repository := newTestRepository(t, "", nil)
+
+	session, err := repository.IssueSessionToken(&Identity{UserID: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	playback, _, err := repository.IssuePlaybackToken(&PlaybackGrant{StreamID: "stream", Issuer: &Identity{UserID: "user"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a token of a kind can't pass for the other
+	if _, err := repository.VerifyPlaybackToken(session); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("a session token verified as playback token returned %v", err)
+	}
+	if _, err := repository.VerifySessionToken(context.Background(), playback); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("a playback token verified as session token returned %v", err)
+	}
+}
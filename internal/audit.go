@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"video-handler/external/auth"
+
+	"github.com/google/uuid"
+)
+
+const (
+	AuditUpload       string = "upload"
+	AuditDelete       string = "delete"
+	AuditShare        string = "share"
+	AuditTranscode    string = "transcode"
+	AuditPublish      string = "publish"
+	AuditRemove       string = "remove"
+	AuditRecord       string = "record"
+	AuditLoginFailure string = "login-failure"
+	AuditAdmin        string = "admin"
+
+	AuditSuccess string = "success"
+	AuditDenied  string = "denied"
+	AuditFailure string = "failure"
+
+	auditCatalog   string = "audit/"
+	auditDayLayout string = "2006-01-02"
+	auditQueueSize int    = 1024
+	auditMaxLimit  int    = 1000
+	// queries don't read further back than auditMaxRange
+	auditMaxRange = 31 * 24 * time.Hour
+)
+
+// AuditEvent records who did what on which target, and how it ended.
+type AuditEvent struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	UserID   string    `json:"user_id,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// AuditFilter selects events of a query, empty fields match everything but the time range and the
+// number of events are bounded.
+type AuditFilter struct {
+	UserID string
+	Action string
+	Since  time.Time
+	Limit  int
+}
+
+func (f AuditFilter) matches(event AuditEvent) bool {
+	return (f.UserID == "" || f.UserID == event.UserID) &&
+		(f.Action == "" || f.Action == event.Action) &&
+		!event.Time.Before(f.Since)
+}
+
+// AuditLog persists the events in the catalog under audit/{day}/, written in the background
+// so that requests don't wait for the bucket.
+type AuditLog struct {
+	catalog *Catalog
+	logger  *slog.Logger
+	events  chan AuditEvent
+	// done is closed once the queued events are written after ctx ended
+	done chan struct{}
+}
+
+func NewAuditLog(ctx context.Context, catalog *Catalog, logger *slog.Logger) *AuditLog {
+	al := &AuditLog{
+		catalog: catalog,
+		logger:  logger,
+		events:  make(chan AuditEvent, auditQueueSize),
+		done:    make(chan struct{}),
+	}
+	go al.run(ctx)
+	return al
+}
+
+func (al *AuditLog) run(ctx context.Context) {
+	defer close(al.done)
+	for {
+		select {
+		case event := <-al.events:
+			al.store(event)
+		case <-ctx.Done():
+			// the events recorded until the shutdown are still written
+			for {
+				select {
+				case event := <-al.events:
+					al.store(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (al *AuditLog) store(event AuditEvent) {
+	key := fmt.Sprintf("%s%s/%d-%s.json", auditCatalog, event.Time.UTC().Format(auditDayLayout), event.Time.UnixNano(), event.ID)
+	if err := al.catalog.put(context.Background(), key, event); err != nil {
+		al.logger.Error("failed to store audit event", "action", event.Action, "user_id", event.UserID, "target", event.Target, "err", err.Error())
+	}
+}
+
+// Wait waits until the events queued when the context of the log ended are written, or until ctx ends.
+func (al *AuditLog) Wait(ctx context.Context) error {
+	select {
+	case <-al.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Record logs an action of identity on target, err is nil on success.
+func (al *AuditLog) Record(r *http.Request, identity *auth.Identity, action, target string, err error) {
+	event := AuditEvent{
+		ID:      uuid.New().String(),
+		Time:    time.Now(),
+		Action:  action,
+		Target:  target,
+		Outcome: AuditSuccess,
+	}
+	if r != nil {
+		if ip := remoteIP(r.RemoteAddr); ip != nil {
+			event.IP = ip.String()
+		}
+	}
+	if identity != nil {
+		event.UserID = identity.UserID
+		event.Username = identity.Username
+		event.Tenant = identity.Tenant
+	}
+	if err != nil {
+		event.Outcome = AuditFailure
+		if errors.Is(err, ErrForbidden) {
+			event.Outcome = AuditDenied
+		}
+		event.Error = err.Error()
+	}
+
+	al.logger.Info("audit", "action", event.Action, "user_id", event.UserID, "ip", event.IP, "target", event.Target, "outcome", event.Outcome)
+
+	select {
+	case al.events <- event:
+	default:
+		al.logger.Error("audit queue is full, event dropped", "action", event.Action, "user_id", event.UserID, "target", event.Target)
+	}
+}
+
+// Query returns the matching events, the newest first. The days are read from the newest and the
+// reading stops once Limit events match, Since is clamped to auditMaxRange ago and Limit to auditMaxLimit.
+func (al *AuditLog) Query(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	now := time.Now()
+	if oldest := now.Add(-auditMaxRange); filter.Since.Before(oldest) {
+		filter.Since = oldest
+	}
+	if filter.Limit <= 0 || filter.Limit > auditMaxLimit {
+		filter.Limit = auditMaxLimit
+	}
+
+	var events []AuditEvent
+	first := filter.Since.UTC().Truncate(24 * time.Hour)
+	for day := now.UTC().Truncate(24 * time.Hour); !day.Before(first); day = day.Add(-24 * time.Hour) {
+		keys, err := al.catalog.keys(ctx, auditCatalog+day.Format(auditDayLayout)+"/")
+		if err != nil {
+			return nil, err
+		}
+
+		// the keys start with the time of their event
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		for _, key := range keys {
+			if !strings.HasSuffix(key, ".json") {
+				continue
+			}
+			if at, ok := auditKeyTime(key); ok && at.Before(filter.Since) {
+				break
+			}
+
+			var event AuditEvent
+			if err := al.catalog.get(ctx, key, &event); err != nil {
+				return nil, err
+			}
+			if !filter.matches(event) {
+				continue
+			}
+			events = append(events, event)
+			if len(events) == filter.Limit {
+				return events, nil
+			}
+		}
+	}
+	return events, nil
+}
+
+// auditKeyTime reads the time of the event of key, audit/{day}/{unix nano}-{id}.json.
+func auditKeyTime(key string) (time.Time, bool) {
+	name := key[strings.LastIndex(key, "/")+1:]
+	nanos, _, ok := strings.Cut(name, "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
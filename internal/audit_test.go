@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+	"video-handler/external/auth"
+
+	cmdCommand "video-handler/pkg"
+)
+
+func TestAuditLogWritesQueuedEventsOnShutdown(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{Result: cmdCommand.ProbeResult{VideoCodec: "h264", Formats: "mpegts"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	auditLog := NewAuditLog(ctx, ts.videoService.Catalog(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	const events = 50
+	for i := 0; i < events; i++ {
+		auditLog.Record(nil, &auth.Identity{UserID: "user"}, AuditUpload, fmt.Sprintf("movie-%d.ts", i), nil)
+	}
+	cancel()
+
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelWait()
+	if err := auditLog.Wait(waitCtx); err != nil {
+		t.Fatal(err)
+	}
+	if keys := ts.s3.keys(testBucket, catalogPrefix+auditCatalog); len(keys) != events {
+		t.Errorf("%d audit events written, want %d", len(keys), events)
+	}
+}
+
+// newTestAuditLog is an audit log in the catalog of ts, the tests store their events directly.
+func newTestAuditLog(t *testing.T, ts *testServer) *AuditLog {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewAuditLog(ctx, ts.videoService.Catalog(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{Result: cmdCommand.ProbeResult{VideoCodec: "h264", Formats: "mpegts"}})
+	auditLog := newTestAuditLog(t, ts)
+
+	now := time.Now()
+	events := []AuditEvent{
+		{ID: "upload-alice", Time: now.Add(-time.Minute), Action: AuditUpload, UserID: "alice"},
+		{ID: "delete-alice", Time: now.Add(-time.Hour), Action: AuditDelete, UserID: "alice"},
+		{ID: "upload-bob", Time: now.Add(-2 * time.Hour), Action: AuditUpload, UserID: "bob"},
+		{ID: "upload-alice-yesterday", Time: now.Add(-30 * time.Hour), Action: AuditUpload, UserID: "alice"},
+		{ID: "share-bob-last-week", Time: now.Add(-7 * 24 * time.Hour), Action: AuditShare, UserID: "bob"},
+		{ID: "upload-alice-last-year", Time: now.Add(-365 * 24 * time.Hour), Action: AuditUpload, UserID: "alice"},
+	}
+	for _, event := range events {
+		event.Outcome = AuditSuccess
+		auditLog.store(event)
+	}
+
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		want   []string
+	}{
+		{"the last day", AuditFilter{Since: now.Add(-24 * time.Hour)}, []string{"upload-alice", "delete-alice", "upload-bob"}},
+		{"by user", AuditFilter{UserID: "alice", Since: now.Add(-48 * time.Hour)}, []string{"upload-alice", "delete-alice", "upload-alice-yesterday"}},
+		{"by action", AuditFilter{Action: AuditUpload, Since: now.Add(-48 * time.Hour)}, []string{"upload-alice", "upload-bob", "upload-alice-yesterday"}},
+		{"by user and action", AuditFilter{UserID: "bob", Action: AuditShare, Since: now.Add(-30 * 24 * time.Hour)}, []string{"share-bob-last-week"}},
+		{"the newest up to the limit", AuditFilter{Since: now.Add(-30 * 24 * time.Hour), Limit: 4}, []string{"upload-alice", "delete-alice", "upload-bob", "upload-alice-yesterday"}},
+		{"without since", AuditFilter{UserID: "alice"}, []string{"upload-alice", "delete-alice", "upload-alice-yesterday"}},
+		{"since older than the range", AuditFilter{Since: now.Add(-2 * 365 * 24 * time.Hour)}, []string{"upload-alice", "delete-alice", "upload-bob", "upload-alice-yesterday", "share-bob-last-week"}},
+		{"nothing matches", AuditFilter{UserID: "carol"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := auditLog.Query(context.Background(), test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, event := range got {
+				ids = append(ids, event.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(test.want, ",") {
+				t.Errorf("Query returned %q, want %q", ids, test.want)
+			}
+		})
+	}
+}
+
+func TestAuditLogQueryStopsAtLimit(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{Result: cmdCommand.ProbeResult{VideoCodec: "h264", Formats: "mpegts"}})
+	auditLog := newTestAuditLog(t, ts)
+
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		auditLog.store(AuditEvent{ID: fmt.Sprintf("event-%d", i), Time: now.Add(-time.Duration(i) * time.Minute), Action: AuditUpload, Outcome: AuditSuccess})
+	}
+	for i := 0; i < 5; i++ {
+		auditLog.store(AuditEvent{ID: fmt.Sprintf("old-%d", i), Time: now.Add(-10 * 24 * time.Hour), Action: AuditUpload, Outcome: AuditSuccess})
+	}
+
+	reads := ts.s3.objectReads()
+	events, err := auditLog.Query(context.Background(), AuditFilter{Since: now.Add(-30 * 24 * time.Hour), Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].ID != "event-0" || events[2].ID != "event-2" {
+		t.Errorf("Query returned %+v, want the 3 newest events", events)
+	}
+	if n := ts.s3.objectReads() - reads; n != 3 {
+		t.Errorf("Query read %d events, want only the 3 it returns", n)
+	}
+
+	// the events before since aren't read
+	reads = ts.s3.objectReads()
+	events, err = auditLog.Query(context.Background(), AuditFilter{Since: now.Add(-90 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("Query returned %d events, want the 2 of the last 90 seconds", len(events))
+	}
+	if n := ts.s3.objectReads() - reads; n != 2 {
+		t.Errorf("Query read %d events, want only the 2 it returns", n)
+	}
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"video-handler/external/auth"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	catalogPrefix  string = "catalog/"
+	apiKeysCatalog string = "api-keys/"
+)
+
+var (
+	ErrCatalogNotFound = errors.New("catalog entry not found")
+)
+
+// Catalog stores the service records as JSON documents under catalog/ in the main bucket.
+type Catalog struct {
+	service *VideoService
+}
+
+func (c *Catalog) get(ctx context.Context, key string, v any) (err error) {
+	ctx, end := startStorage(ctx, "get", c.service.MinioEnvs.Bucket, catalogPrefix+key)
+	defer func() {
+		// a missing entry is an expected answer, not a failure
+		if errors.Is(err, ErrCatalogNotFound) {
+			end(nil)
+			return
+		}
+		end(err)
+	}()
+
+	object, err := c.service.MinioClient.GetObject(ctx, c.service.MinioEnvs.Bucket, catalogPrefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return ErrCatalogNotFound
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func (c *Catalog) put(ctx context.Context, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ctx, end := startStorage(ctx, "put", c.service.MinioEnvs.Bucket, catalogPrefix+key)
+	_, err = c.service.MinioClient.PutObject(ctx, c.service.MinioEnvs.Bucket, catalogPrefix+key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "application/json",
+	})
+	end(err)
+	return err
+}
+
+func (c *Catalog) delete(ctx context.Context, key string) error {
+	ctx, end := startStorage(ctx, "remove", c.service.MinioEnvs.Bucket, catalogPrefix+key)
+	err := c.service.MinioClient.RemoveObject(ctx, c.service.MinioEnvs.Bucket, catalogPrefix+key, minio.RemoveObjectOptions{})
+	end(err)
+	return err
+}
+
+// keys lists the keys stored under prefix.
+func (c *Catalog) keys(ctx context.Context, prefix string) ([]string, error) {
+	ctx, end := startStorage(ctx, "list", c.service.MinioEnvs.Bucket, catalogPrefix+prefix)
+	objects := c.service.MinioClient.ListObjects(ctx, c.service.MinioEnvs.Bucket, minio.ListObjectsOptions{
+		Prefix:    catalogPrefix + prefix,
+		Recursive: true,
+	})
+
+	var keys []string
+	for obj := range objects {
+		if obj.Err != nil {
+			end(obj.Err)
+			return nil, obj.Err
+		}
+		keys = append(keys, strings.TrimPrefix(obj.Key, catalogPrefix))
+	}
+	end(nil)
+	return keys, nil
+}
+
+func (c *Catalog) SaveAPIKey(ctx context.Context, key auth.APIKey) error {
+	return c.put(ctx, apiKeysCatalog+key.ID+".json", key)
+}
+
+func (c *Catalog) GetAPIKey(ctx context.Context, id string) (auth.APIKey, error) {
+	var key auth.APIKey
+	err := c.get(ctx, apiKeysCatalog+id+".json", &key)
+	return key, err
+}
+
+func (c *Catalog) ListAPIKeys(ctx context.Context) ([]auth.APIKey, error) {
+	keys, err := c.keys(ctx, apiKeysCatalog)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys := make([]auth.APIKey, 0, len(keys))
+	for _, key := range keys {
+		var apiKey auth.APIKey
+		if err := c.get(ctx, key, &apiKey); err != nil {
+			return nil, err
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	return apiKeys, nil
+}
@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"video-handler/internal/rtspserver"
+)
+
+const (
+	dvrInitName      string = "init.mp4"
+	dvrSegmentFormat string = "segment_%05d.m4s"
+)
+
+var ErrDvrClosed = errors.New("dvr buffer closed")
+
+type dvrSegment struct {
+	seq       uint32
+	name      string
+	duration  time.Duration
+	createdAt time.Time
+}
+
+// dvrBuffer keeps the last window of a live stream on disk as fMP4 segments.
+type dvrBuffer struct {
+	streamID string
+	dir      string
+	window   time.Duration
+	server   *rtspserver.Server
+	writer   *h264SegmentWriter
+	logger   *slog.Logger
+
+	mutex    sync.RWMutex
+	segments []dvrSegment
+	total    time.Duration
+	notify   chan struct{}
+	closed   bool
+	// time-shift readers, the files are kept until the last one is done
+	readers int
+}
+
+func newDvrBuffer(server *rtspserver.Server, streamID, baseDir string, window, segmentDuration time.Duration, logger *slog.Logger) (*dvrBuffer, error) {
+	desc := server.Description()
+	if desc == nil {
+		return nil, fmt.Errorf("stream %s is not published yet", streamID)
+	}
+
+	dir := filepath.Join(baseDir, streamID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	dvr := &dvrBuffer{
+		streamID: streamID,
+		dir:      dir,
+		window:   window,
+		server:   server,
+		logger:   logger,
+		notify:   make(chan struct{}),
+	}
+
+	writer, err := newH264SegmentWriter(desc, segmentDuration, logger,
+		func(init []byte) error {
+			return os.WriteFile(filepath.Join(dir, dvrInitName), init, 0o644)
+		},
+		dvr.addSegment,
+	)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	dvr.writer = writer
+
+	server.AddPublishHandler("dvr", writer.handlePublish)
+	server.AddPacketHandler("dvr", writer.handlePacket)
+
+	logger.Info("DVR buffer started", "stream_id", streamID, "window", window.String(), "dir", dir)
+	return dvr, nil
+}
+
+func (dvr *dvrBuffer) addSegment(seq uint32, segment []byte, duration time.Duration) error {
+	name := fmt.Sprintf(dvrSegmentFormat, seq)
+	if err := os.WriteFile(filepath.Join(dvr.dir, name), segment, 0o644); err != nil {
+		return err
+	}
+
+	dvr.mutex.Lock()
+	defer dvr.mutex.Unlock()
+
+	dvr.segments = append(dvr.segments, dvrSegment{
+		seq:       seq,
+		name:      name,
+		duration:  duration,
+		createdAt: time.Now(),
+	})
+	dvr.total += duration
+
+	// drop the oldest segments which are out of the time-shift window
+	for len(dvr.segments) > 1 && dvr.total-dvr.segments[0].duration >= dvr.window {
+		oldest := dvr.segments[0]
+		dvr.segments = dvr.segments[1:]
+		dvr.total -= oldest.duration
+
+		if err := os.Remove(filepath.Join(dvr.dir, oldest.name)); err != nil {
+			dvr.logger.Error("failed to remove DVR segment", "segment", oldest.name, "err", err.Error())
+		}
+	}
+
+	close(dvr.notify)
+	dvr.notify = make(chan struct{})
+
+	return nil
+}
+
+// playlist renders a sliding-window HLS playlist with all the segments of the buffer,
+// query is appended to the segment URIs.
+func (dvr *dvrBuffer) playlist(segmentPrefix, query string) string {
+	dvr.mutex.RLock()
+	defer dvr.mutex.RUnlock()
+
+	targetDuration := 1.0
+	for _, segment := range dvr.segments {
+		targetDuration = math.Max(targetDuration, math.Ceil(segment.duration.Seconds()))
+	}
+
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n")
+	sb.WriteString("#EXT-X-VERSION:7\n")
+	sb.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	fmt.Fprintf(&sb, "#EXT-X-TARGETDURATION:%d\n", int(targetDuration))
+
+	if len(dvr.segments) > 0 {
+		fmt.Fprintf(&sb, "#EXT-X-MEDIA-SEQUENCE:%d\n", dvr.segments[0].seq)
+	}
+
+	fmt.Fprintf(&sb, "#EXT-X-MAP:URI=\"%s%s%s\"\n", segmentPrefix, dvrInitName, query)
+
+	for _, segment := range dvr.segments {
+		start := segment.createdAt.Add(-segment.duration)
+		fmt.Fprintf(&sb, "#EXT-X-PROGRAM-DATE-TIME:%s\n", start.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+		fmt.Fprintf(&sb, "#EXTINF:%.3f,\n", segment.duration.Seconds())
+		fmt.Fprintf(&sb, "%s%s%s\n", segmentPrefix, segment.name, query)
+	}
+
+	return sb.String()
+}
+
+// segmentPath returns the path of a file of the buffer, refusing anything which is not a segment or the init.
+func (dvr *dvrBuffer) segmentPath(name string) (string, error) {
+	if name != filepath.Base(name) || (name != dvrInitName && !strings.HasSuffix(name, ".m4s")) {
+		return "", fmt.Errorf("invalid DVR segment name: %s", name)
+	}
+
+	path := filepath.Join(dvr.dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// seekSegment finds the segment which was live offset ago.
+func (dvr *dvrBuffer) seekSegment(offset time.Duration) (uint32, error) {
+	dvr.mutex.RLock()
+	defer dvr.mutex.RUnlock()
+
+	if len(dvr.segments) == 0 {
+		return 0, errors.New("DVR buffer is empty")
+	}
+
+	var elapsed time.Duration
+	for i := len(dvr.segments) - 1; i >= 0; i-- {
+		elapsed += dvr.segments[i].duration
+		if elapsed >= offset {
+			return dvr.segments[i].seq, nil
+		}
+	}
+
+	// the requested point is older than the window, start from the oldest segment available
+	return dvr.segments[0].seq, nil
+}
+
+// nextSegment returns the first segment with a sequence number greater or equal to seq,
+// waiting for it to be written when the reader has caught up with the live edge.
+func (dvr *dvrBuffer) nextSegment(ctx context.Context, seq uint32) (dvrSegment, error) {
+	for {
+		dvr.mutex.RLock()
+		closed := dvr.closed
+		notify := dvr.notify
+		for _, segment := range dvr.segments {
+			if segment.seq >= seq {
+				dvr.mutex.RUnlock()
+				return segment, nil
+			}
+		}
+		dvr.mutex.RUnlock()
+
+		if closed {
+			return dvrSegment{}, ErrDvrClosed
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return dvrSegment{}, ctx.Err()
+		}
+	}
+}
+
+// timeShift writes the init and the segments of the buffer starting from seq to w, following the
+// live edge until ctx is cancelled. It returns io.EOF once the buffer is closed and its segments are written.
+func (dvr *dvrBuffer) timeShift(ctx context.Context, seq uint32, w io.Writer) error {
+	if err := dvr.addReader(); err != nil {
+		return err
+	}
+	defer dvr.removeReader()
+
+	init, err := os.ReadFile(filepath.Join(dvr.dir, dvrInitName))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(init); err != nil {
+		return err
+	}
+
+	for {
+		segment, err := dvr.nextSegment(ctx, seq)
+		if err != nil {
+			if errors.Is(err, ErrDvrClosed) {
+				return io.EOF
+			}
+			return err
+		}
+
+		data, err := os.ReadFile(filepath.Join(dvr.dir, segment.name))
+		if err != nil {
+			// the segment was dropped out of the window while we were behind, skip it
+			if os.IsNotExist(err) {
+				seq = segment.seq + 1
+				continue
+			}
+			return err
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		seq = segment.seq + 1
+	}
+}
+
+func (dvr *dvrBuffer) addReader() error {
+	dvr.mutex.Lock()
+	defer dvr.mutex.Unlock()
+
+	if dvr.closed {
+		return ErrDvrClosed
+	}
+	dvr.readers++
+	return nil
+}
+
+func (dvr *dvrBuffer) removeReader() {
+	dvr.mutex.Lock()
+	dvr.readers--
+	remove := dvr.closed && dvr.readers == 0
+	dvr.mutex.Unlock()
+
+	if remove {
+		dvr.removeFiles()
+	}
+}
+
+// close stops the buffer when its stream ends, the time-shift readers get the remaining segments
+// and io.EOF. The files are removed once the last reader is done.
+func (dvr *dvrBuffer) close() {
+	dvr.server.RemovePacketHandler("dvr")
+	dvr.server.RemovePublishHandler("dvr")
+
+	if err := dvr.writer.close(); err != nil {
+		dvr.logger.Error("failed to flush DVR buffer", "stream_id", dvr.streamID, "err", err.Error())
+	}
+
+	dvr.mutex.Lock()
+	if dvr.closed {
+		dvr.mutex.Unlock()
+		return
+	}
+	dvr.closed = true
+	close(dvr.notify)
+	dvr.notify = make(chan struct{})
+	remove := dvr.readers == 0
+	dvr.mutex.Unlock()
+
+	if remove {
+		dvr.removeFiles()
+	}
+}
+
+func (dvr *dvrBuffer) removeFiles() {
+	if err := os.RemoveAll(dvr.dir); err != nil {
+		dvr.logger.Error("failed to remove DVR directory", "dir", dvr.dir, "err", err.Error())
+	}
+}
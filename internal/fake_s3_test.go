@@ -0,0 +1,413 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory bucket store which speaks enough of the S3 API for minio-go: buckets, objects
+// with their metadata, multipart uploads, copies, ranged reads and listings. Signatures aren't checked.
+type fakeS3 struct {
+	server *httptest.Server
+
+	mutex   sync.Mutex
+	buckets map[string]map[string]*fakeS3Object
+	uploads map[string]*fakeS3Upload
+	// reads counts the GET requests of objects
+	reads int
+}
+
+type fakeS3Object struct {
+	data        []byte
+	contentType string
+	metadata    map[string]string
+	modified    time.Time
+}
+
+type fakeS3Upload struct {
+	bucket      string
+	key         string
+	contentType string
+	metadata    map[string]string
+	parts       map[int][]byte
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	s3 := &fakeS3{
+		buckets: map[string]map[string]*fakeS3Object{},
+		uploads: map[string]*fakeS3Upload{},
+	}
+	s3.server = httptest.NewServer(http.HandlerFunc(s3.serveHTTP))
+	t.Cleanup(s3.server.Close)
+	return s3
+}
+
+// endpoint is the host:port of the server, for minio.New.
+func (s3 *fakeS3) endpoint() string {
+	return strings.TrimPrefix(s3.server.URL, "http://")
+}
+
+// object returns a copy of the data of an object, ok is false when it doesn't exist.
+func (s3 *fakeS3) object(bucket, key string) (data []byte, metadata map[string]string, ok bool) {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+
+	object, ok := s3.buckets[bucket][key]
+	if !ok {
+		return nil, nil, false
+	}
+	return append([]byte(nil), object.data...), object.metadata, true
+}
+
+// keys lists the objects of bucket under prefix.
+func (s3 *fakeS3) keys(bucket, prefix string) []string {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+
+	var keys []string
+	for key := range s3.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// objectReads is the number of objects read so far.
+func (s3 *fakeS3) objectReads() int {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+	return s3.reads
+}
+
+func (s3 *fakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+
+	switch {
+	case query.Has("location"):
+		writeXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+			Region  string   `xml:",chardata"`
+		}{Region: "us-east-1"})
+
+	case key == "":
+		s3.serveBucket(w, r, bucket)
+
+	case s3.buckets[bucket] == nil:
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := strconv.Itoa(len(s3.uploads) + 1)
+		s3.uploads[id] = &fakeS3Upload{
+			bucket:      bucket,
+			key:         key,
+			contentType: r.Header.Get("Content-Type"),
+			metadata:    userMetadata(r.Header),
+			parts:       map[int][]byte{},
+		}
+		writeXML(w, http.StatusOK, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		upload, ok := s3.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload", key)
+			return
+		}
+		data, err := readS3Body(r)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		upload.parts[number] = data
+		w.Header().Set("ETag", etag(data))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		upload, ok := s3.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload", key)
+			return
+		}
+		delete(s3.uploads, query.Get("uploadId"))
+
+		numbers := make([]int, 0, len(upload.parts))
+		for number := range upload.parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, upload.parts[number]...)
+		}
+		s3.put(upload.bucket, upload.key, data, upload.contentType, upload.metadata)
+
+		writeXML(w, http.StatusOK, struct {
+			XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+			Location string
+			Bucket   string
+			Key      string
+			ETag     string
+		}{Bucket: bucket, Key: key, ETag: etag(data)})
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s3.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		sourceBucket, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+		object, ok := s3.buckets[sourceBucket][sourceKey]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", sourceKey)
+			return
+		}
+		contentType, metadata := object.contentType, object.metadata
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			contentType, metadata = r.Header.Get("Content-Type"), userMetadata(r.Header)
+		}
+		copied := s3.put(bucket, key, object.data, contentType, metadata)
+
+		writeXML(w, http.StatusOK, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			LastModified string
+			ETag         string
+		}{LastModified: copied.modified.Format(time.RFC3339), ETag: etag(copied.data)})
+
+	case r.Method == http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		s3.put(bucket, key, data, r.Header.Get("Content-Type"), userMetadata(r.Header))
+		w.Header().Set("ETag", etag(data))
+
+	case r.Method == http.MethodDelete:
+		delete(s3.buckets[bucket], key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if r.Method == http.MethodGet {
+			s3.reads++
+		}
+		object, ok := s3.buckets[bucket][key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		w.Header().Set("ETag", etag(object.data))
+		w.Header().Set("Content-Type", object.contentType)
+		for name, value := range object.metadata {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+		http.ServeContent(w, r, key, object.modified, bytes.NewReader(object.data))
+
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+func (s3 *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	objects, exists := s3.buckets[bucket]
+
+	switch {
+	case r.Method == http.MethodPut:
+		if !exists {
+			s3.buckets[bucket] = map[string]*fakeS3Object{}
+		}
+
+	case !exists:
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+
+	case r.Method == http.MethodHead:
+
+	case r.Method == http.MethodGet:
+		s3.list(w, r, objects)
+
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+// list answers a ListObjectsV2 in a single page.
+func (s3 *fakeS3) list(w http.ResponseWriter, r *http.Request, objects map[string]*fakeS3Object) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	encode := func(name string) string { return name }
+	if query.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		StorageClass string
+		UserMetadata struct {
+			Items []fakeS3MetadataItem
+		}
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		MaxKeys        int
+		IsTruncated    bool
+		EncodingType   string `xml:",omitempty"`
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}{Prefix: encode(prefix), MaxKeys: 1000, EncodingType: query.Get("encoding-type")}
+
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	prefixes := map[string]bool{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if !prefixes[common] {
+					prefixes[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encode(common)})
+				}
+				continue
+			}
+		}
+
+		object := objects[key]
+		c := content{
+			Key:          encode(key),
+			LastModified: object.modified.UTC().Format(time.RFC3339),
+			ETag:         etag(object.data),
+			Size:         len(object.data),
+			StorageClass: "STANDARD",
+		}
+		for name, value := range object.metadata {
+			c.UserMetadata.Items = append(c.UserMetadata.Items, fakeS3MetadataItem{XMLName: xml.Name{Local: "X-Amz-Meta-" + name}, Value: value})
+		}
+		result.Contents = append(result.Contents, c)
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+
+	writeXML(w, http.StatusOK, result)
+}
+
+type fakeS3MetadataItem struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+func (s3 *fakeS3) put(bucket, key string, data []byte, contentType string, metadata map[string]string) *fakeS3Object {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	object := &fakeS3Object{
+		data:        data,
+		contentType: contentType,
+		metadata:    metadata,
+		modified:    time.Now().Truncate(time.Second),
+	}
+	s3.buckets[bucket][key] = object
+	return object
+}
+
+// userMetadata returns the X-Amz-Meta- headers without their prefix.
+func userMetadata(header http.Header) map[string]string {
+	metadata := map[string]string{}
+	for name, values := range header {
+		if suffix, ok := strings.CutPrefix(name, "X-Amz-Meta-"); ok && len(values) > 0 {
+			metadata[suffix] = values[0]
+		}
+	}
+	return metadata
+}
+
+// readS3Body reads the body of an upload, decoding the aws-chunked encoding of streaming signatures.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("chunk size %q: %w", line, err)
+		}
+		if size == 0 {
+			return data, nil
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if _, err := reader.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, resource string) {
+	writeXML(w, status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: code, Message: code, Resource: resource})
+}
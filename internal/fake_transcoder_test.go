@@ -0,0 +1,350 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	cmdCommand "video-handler/pkg"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
+)
+
+const (
+	fakeFrameRate int = 25
+
+	fakeVideoPid   uint16 = 0x100
+	fakePmtPid     uint16 = 0x1000
+	fakeClockRate  int64  = 90000
+	tsPacketSize   int    = 188
+	tsPayloadSize  int    = tsPacketSize - 4
+	fakePayloadTyp uint8  = 96
+)
+
+var (
+	// a 352x288 H264 stream
+	fakeSPS = []byte{0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0, 0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00, 0x00, 0x03, 0x00, 0x3d, 0x08}
+	fakePPS = []byte{0x68, 0xee, 0x3c, 0x80}
+)
+
+// fakeTranscoder is a deterministic Transcoder for the tests, it needs neither the ffmpeg binaries nor
+// valid videos. It consumes its inputs, reading the http ones, probes every video as Result and generates
+// Frames frames of H264 at fakeFrameRate: MPEG-TS on pipe:1 and RTP packets published to rtsp and rtsps
+// outputs. The commands are validated and recorded.
+type fakeTranscoder struct {
+	Result cmdCommand.ProbeResult
+	Frames int
+	// TLSConfig publishes to rtsps outputs
+	TLSConfig *tls.Config
+	// Err fails every call, along with ErrOutput as the end of the ffmpeg output
+	Err       error
+	ErrOutput []byte
+
+	mutex    sync.Mutex
+	commands []cmdCommand.Ffmpeg
+}
+
+// Commands returns the commands run so far.
+func (ft *fakeTranscoder) Commands() []cmdCommand.Ffmpeg {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	return append([]cmdCommand.Ffmpeg(nil), ft.commands...)
+}
+
+func (ft *fakeTranscoder) run(command cmdCommand.Ffmpeg, video io.Reader) error {
+	if _, err := command.Args(); err != nil {
+		return err
+	}
+
+	ft.mutex.Lock()
+	ft.commands = append(ft.commands, command)
+	ft.mutex.Unlock()
+
+	if video != nil {
+		io.Copy(io.Discard, video)
+	}
+	for _, input := range command.Inputs {
+		if err := readFakeInput(input.Url); err != nil {
+			return err
+		}
+	}
+	return ft.Err
+}
+
+// readFakeInput reads an input at a http URL, like ffmpeg, to check that it's reachable.
+func readFakeInput(inputUrl string) error {
+	if !strings.HasPrefix(inputUrl, "http://") && !strings.HasPrefix(inputUrl, "https://") {
+		return nil
+	}
+
+	res, err := http.Get(inputUrl)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("fake transcoder: %s answered %s", inputUrl, res.Status)
+	}
+	return nil
+}
+
+func (ft *fakeTranscoder) Probe(ctx context.Context, video io.Reader) (cmdCommand.ProbeResult, error) {
+	io.Copy(io.Discard, video)
+	if ft.Err != nil {
+		return cmdCommand.ProbeResult{}, ft.Err
+	}
+	return ft.Result, nil
+}
+
+func (ft *fakeTranscoder) ProbeUrl(ctx context.Context, videoUrl string) (cmdCommand.ProbeResult, error) {
+	if ft.Err != nil {
+		return cmdCommand.ProbeResult{}, ft.Err
+	}
+	return ft.Result, nil
+}
+
+func (ft *fakeTranscoder) Transcode(ctx context.Context, command cmdCommand.Ffmpeg, video io.Reader, onProgress func(cmdCommand.Progress)) (io.ReadCloser, error) {
+	if err := ft.run(command, video); err != nil {
+		return nil, err
+	}
+
+	// any format is generated as MPEG-TS
+	output := command.Outputs[0]
+	if output.Url != "pipe:1" {
+		return nil, fmt.Errorf("fake transcoder: unsupported output %s", output.Url)
+	}
+
+	var buffer bytes.Buffer
+	ts := &tsWriter{w: &buffer, counters: map[uint16]byte{}}
+	ts.writeTables()
+	for frame := 0; frame < ft.Frames; frame++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ts.writeFrame(fakeTimestamp(frame), fakeAccessUnit(frame))
+
+		if onProgress != nil && (frame+1)%fakeFrameRate == 0 {
+			onProgress(fakeProgress(frame+1, false))
+		}
+	}
+	if onProgress != nil {
+		onProgress(fakeProgress(ft.Frames, true))
+	}
+
+	return io.NopCloser(&buffer), nil
+}
+
+func (ft *fakeTranscoder) Push(ctx context.Context, command cmdCommand.Ffmpeg, video io.Reader) ([]byte, error) {
+	if err := ft.run(command, video); err != nil {
+		return ft.ErrOutput, err
+	}
+
+	input := command.Inputs[0]
+	output := command.Outputs[0]
+	if !strings.HasPrefix(output.Url, "rtsp://") && !strings.HasPrefix(output.Url, "rtsps://") {
+		return nil, fmt.Errorf("fake transcoder: unsupported output %s", output.Url)
+	}
+
+	h264 := &format.H264{
+		PayloadTyp:        fakePayloadTyp,
+		PacketizationMode: 1,
+		SPS:               fakeSPS,
+		PPS:               fakePPS,
+	}
+	desc := &description.Session{
+		Medias: []*description.Media{{
+			Type:    description.MediaTypeVideo,
+			Formats: []format.Format{h264},
+		}},
+	}
+
+	client := gortsplib.Client{TLSConfig: ft.TLSConfig}
+	if strings.HasPrefix(output.Url, "rtsps://") {
+		transport := gortsplib.TransportTCP
+		client.Transport = &transport
+	}
+	if err := client.StartRecording(output.Url, desc); err != nil {
+		return []byte(err.Error()), err
+	}
+	defer client.Close()
+
+	ssrc := uint32(1)
+	sequenceNumber := uint16(0)
+	encoder := &rtph264.Encoder{
+		PayloadType:           fakePayloadTyp,
+		PacketizationMode:     1,
+		SSRC:                  &ssrc,
+		InitialSequenceNumber: &sequenceNumber,
+	}
+	if err := encoder.Init(); err != nil {
+		return nil, err
+	}
+
+	// -re and -readrate pace the frames like ffmpeg does
+	var frameDuration time.Duration
+	if input.Realtime {
+		frameDuration = time.Second / time.Duration(fakeFrameRate)
+	} else if input.ReadRate > 0 {
+		frameDuration = time.Duration(float64(time.Second) / float64(fakeFrameRate) / input.ReadRate)
+	}
+
+	var log bytes.Buffer
+	first := int(input.Seek.Seconds() * float64(fakeFrameRate))
+	for frame := first; frame < ft.Frames; frame++ {
+		packets, err := encoder.Encode(fakeAccessUnit(frame))
+		if err != nil {
+			return log.Bytes(), err
+		}
+		for _, packet := range packets {
+			packet.Timestamp = uint32(fakeTimestamp(frame))
+			if err := client.WritePacketRTP(desc.Medias[0], packet); err != nil {
+				return log.Bytes(), err
+			}
+		}
+
+		if (frame+1-first)%fakeFrameRate == 0 {
+			writeFakeStats(&log, frame+1-first)
+		}
+
+		select {
+		case <-time.After(frameDuration):
+		case <-ctx.Done():
+			return log.Bytes(), ctx.Err()
+		}
+	}
+	writeFakeStats(&log, max(0, ft.Frames-first))
+
+	return log.Bytes(), nil
+}
+
+// fakeAccessUnit is a keyframe every second, with the parameters, and a predicted frame otherwise.
+func fakeAccessUnit(frame int) [][]byte {
+	if frame%fakeFrameRate == 0 {
+		return [][]byte{fakeSPS, fakePPS, {0x65, 0x88, 0x84, byte(frame >> 8), byte(frame)}}
+	}
+	return [][]byte{{0x41, 0x9a, 0x02, byte(frame >> 8), byte(frame)}}
+}
+
+func fakeTimestamp(frame int) int64 {
+	return int64(frame) * fakeClockRate / int64(fakeFrameRate)
+}
+
+func fakeOutTime(frames int) time.Duration {
+	return time.Duration(frames) * time.Second / time.Duration(fakeFrameRate)
+}
+
+func fakeProgress(frames int, done bool) cmdCommand.Progress {
+	return cmdCommand.Progress{
+		Frame:   int64(frames),
+		Fps:     float64(fakeFrameRate),
+		OutTime: fakeOutTime(frames),
+		Speed:   1,
+		Done:    done,
+	}
+}
+
+// writeFakeStats writes a stats line of ffmpeg, which tells how far the output got.
+func writeFakeStats(w io.Writer, frames int) {
+	outTime := fakeOutTime(frames)
+	fmt.Fprintf(w, "frame=%5d fps=%d q=-1.0 size=N/A time=%02d:%02d:%05.2f bitrate=N/A speed=1x\n",
+		frames, fakeFrameRate, int(outTime.Hours()), int(outTime.Minutes())%60, (outTime % time.Minute).Seconds())
+}
+
+// tsWriter writes a MPEG-TS with a single H264 stream.
+type tsWriter struct {
+	w        io.Writer
+	counters map[uint16]byte
+}
+
+func (ts *tsWriter) writeTables() {
+	pat := []byte{
+		0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		0x00, 0x01, 0xe0 | byte(fakePmtPid>>8), byte(fakePmtPid & 0xff),
+	}
+	ts.writeSection(0, pat)
+
+	pmt := []byte{
+		0x02, 0xb0, 0x12, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		0xe0 | byte(fakeVideoPid>>8), byte(fakeVideoPid & 0xff), 0xf0, 0x00,
+		// H264 stream
+		0x1b, 0xe0 | byte(fakeVideoPid>>8), byte(fakeVideoPid & 0xff), 0xf0, 0x00,
+	}
+	ts.writeSection(fakePmtPid, pmt)
+}
+
+func (ts *tsWriter) writeSection(pid uint16, section []byte) {
+	crc := crc32Mpeg2(section)
+	payload := append([]byte{0x00}, section...)
+	payload = append(payload, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	for len(payload) < tsPayloadSize {
+		payload = append(payload, 0xff)
+	}
+	ts.writePacket(pid, true, payload)
+}
+
+func (ts *tsWriter) writeFrame(pts int64, au [][]byte) {
+	pes := []byte{
+		0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x80, 0x80, 0x05,
+		0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), byte(pts>>14)&0xfe | 0x01, byte(pts >> 7), byte(pts<<1) | 0x01,
+	}
+	for _, nalu := range au {
+		pes = append(pes, 0x00, 0x00, 0x00, 0x01)
+		pes = append(pes, nalu...)
+	}
+
+	for start := true; len(pes) > 0; start = false {
+		n := min(len(pes), tsPayloadSize)
+		ts.writePacket(fakeVideoPid, start, pes[:n])
+		pes = pes[n:]
+	}
+}
+
+// writePacket writes a packet, a short payload is preceded by an adaptation field stuffing it.
+func (ts *tsWriter) writePacket(pid uint16, start bool, payload []byte) {
+	packet := make([]byte, 0, tsPacketSize)
+	header := byte(pid>>8) & 0x1f
+	if start {
+		header |= 0x40
+	}
+	counter := ts.counters[pid]
+	ts.counters[pid] = (counter + 1) & 0x0f
+
+	if len(payload) == tsPayloadSize {
+		packet = append(packet, 0x47, header, byte(pid), 0x10|counter)
+	} else {
+		stuffing := tsPayloadSize - len(payload) - 1
+		packet = append(packet, 0x47, header, byte(pid), 0x30|counter, byte(stuffing))
+		if stuffing > 0 {
+			packet = append(packet, 0x00)
+			packet = append(packet, bytes.Repeat([]byte{0xff}, stuffing-1)...)
+		}
+	}
+	ts.w.Write(append(packet, payload...))
+}
+
+func crc32Mpeg2(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"video-handler/configs"
+
+	cmdCommand "video-handler/pkg"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden argv files of the ffmpeg commands")
+
+// checkGoldenArgs compares the arguments of command, one per line, with pkg/testdata/<name>.golden.
+func checkGoldenArgs(t *testing.T, name string, command cmdCommand.Ffmpeg) {
+	t.Helper()
+
+	args, err := command.Args()
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	got := strings.Join(args, "\n") + "\n"
+
+	path := filepath.Join("..", "pkg", "testdata", name+".golden")
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s: arguments differ from %s, run the tests with -update if it's expected\ngot:\n%s\nwant:\n%s", name, path, got, want)
+	}
+}
+
+// recordedCommand returns the single command run by the fake transcoder.
+func recordedCommand(t *testing.T, transcoder *fakeTranscoder) cmdCommand.Ffmpeg {
+	t.Helper()
+
+	commands := transcoder.Commands()
+	if len(commands) != 1 {
+		t.Fatalf("%d commands run, want 1", len(commands))
+	}
+	return commands[0]
+}
+
+func newGoldenService(transcoder cmdCommand.Transcoder) *VideoService {
+	return &VideoService{
+		Context: context.Background(),
+		Envs: &configs.EnvVariables{
+			FfmpegStreamAudioBitrate: "128k",
+			FfmpegProgressPeriod:     500 * time.Millisecond,
+		},
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Transcoder: transcoder,
+	}
+}
+
+func TestStreamVideoAsRTSPArgs(t *testing.T) {
+	tests := []struct {
+		name          string
+		videoCodec    string
+		streamAddress string
+		offset        time.Duration
+	}{
+		{name: "stream_h264", videoCodec: "h264", streamAddress: "rtsp://localhost:8554/stream"},
+		{name: "stream_hevc_resumed", videoCodec: "hevc", streamAddress: "rtsp://localhost:8554/stream", offset: 90 * time.Second},
+		{name: "stream_vp9_rtsps", videoCodec: "vp9", streamAddress: "rtsps://localhost:8322/stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the command is recorded, the push fails without publishing
+			transcoder := &fakeTranscoder{Err: errors.New("not pushed")}
+			service := newGoldenService(transcoder)
+
+			service.StreamVideoAsRTSP(context.Background(), "http://minio:9000/videos/movie.mp4?X-Amz-Signature=0", tt.videoCodec, "rtsp", tt.streamAddress, tt.offset)
+			checkGoldenArgs(t, tt.name, recordedCommand(t, transcoder))
+		})
+	}
+}
+
+func TestStreamTimeShiftAsRTSPArgs(t *testing.T) {
+	transcoder := &fakeTranscoder{Err: errors.New("not pushed")}
+	service := newGoldenService(transcoder)
+
+	service.StreamTimeShiftAsRTSP(strings.NewReader(""), "rtsp", "rtsp://localhost:8554/timeshift", 1.5)
+	checkGoldenArgs(t, "timeshift", recordedCommand(t, transcoder))
+}
+
+func TestConversionCommandArgs(t *testing.T) {
+	service := newGoldenService(nil)
+
+	tests := []struct {
+		name    string
+		profile configs.ConversionProfile
+	}{
+		{name: "conversion_default", profile: configs.ConversionProfile{VideoCodec: "libx264"}},
+		{name: "conversion_720p_mp4", profile: configs.ConversionProfile{
+			VideoCodec:    "libx264",
+			Crf:           "23",
+			MaxHeight:     720,
+			FrameRate:     29.97,
+			Gop:           60,
+			AudioBitrate:  "128k",
+			AudioChannels: 2,
+			AudioTrack:    1,
+			Loudnorm:      true,
+			Container:     "mp4",
+		}},
+		{name: "conversion_webm", profile: configs.ConversionProfile{VideoCodec: "libvpx-vp9", Bitrate: "2M", Container: "webm"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkGoldenArgs(t, tt.name, service.conversionCommand("http://minio:9000/videos/originals/movie.avi?X-Amz-Signature=0", tt.profile))
+		})
+	}
+}
+
+func TestRemuxArgs(t *testing.T) {
+	service := newGoldenService(nil)
+
+	tests := []struct {
+		name     string
+		original string
+		probe    cmdCommand.ProbeResult
+	}{
+		{name: "remux_mp4", original: "movie.mkv", probe: cmdCommand.ProbeResult{VideoCodec: "h264", AudioCodec: "pcm_s16le", Formats: "matroska,webm"}},
+		{name: "remux_webm", original: "movie.avi", probe: cmdCommand.ProbeResult{VideoCodec: "vp8", AudioCodec: "vorbis", Formats: "avi"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, ok := remuxProfile(tt.probe)
+			if !ok {
+				t.Fatalf("%s can't be remuxed", tt.probe.VideoCodec)
+			}
+			checkGoldenArgs(t, tt.name, service.conversionCommand("http://minio:9000/videos/originals/"+tt.original+"?X-Amz-Signature=0", profile))
+		})
+	}
+}
+
+func TestRTSPtoHLSArgs(t *testing.T) {
+	checkGoldenArgs(t, "rtsp_to_hls", rtspToHLSCommand("rtsp://localhost:8554/stream"))
+}
@@ -1,175 +1,191 @@
 package internal
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"log/slog"
 	"mime/multipart"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"video-handler/configs"
+	"video-handler/external/auth"
+	"video-handler/internal/tracing"
 
 	cmdCommand "video-handler/pkg"
 
-	"github.com/minio/minio-go/v7"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-const (
-	supportedCodecs string = "H265,H264,VP9,VP8"
-)
-
-func (service *VideoService) processVideoContainer(video multipart.File, videoInfo *multipart.FileHeader) (bool, error) {
-	var conversionNeed bool
-
-	videoCodec, err := service.getVideoCodec(video)
+// the bitstream filters which turn the codecs of ffprobe from their MP4 form into the Annex B form of
+// RTP, the other codecs are copied as they are
+var annexBFilters = map[string]string{"h264": "h264_mp4toannexb", "hevc": "hevc_mp4toannexb"}
+
+// processVideoContainer starts the conversion of a video in an unsupported codec, or of any video when
+// a profile is requested, and returns its job, nil when the video can be stored as is. A video in a
+// supported codec but in a container which can't be streamed is remuxed instead. A converted video is
+// kept under originals/.
+func (service *VideoService) processVideoContainer(ctx context.Context, identity *auth.Identity, video multipart.File, videoInfo *multipart.FileHeader, shared bool, requestedProfile string) (conversion *Job, err error) {
+	ctx, span := tracing.Start(ctx, "process video container", attribute.String("video.name", videoInfo.Filename))
+	defer func() {
+		span.SetAttributes(attribute.Bool("video.conversion_needed", conversion != nil))
+		tracing.End(span, err)
+	}()
+
+	profileName, profile, err := service.conversionProfile(requestedProfile)
 	if err != nil {
-		service.Logger.Error("error getting video codec", "err", err.Error())
-		return conversionNeed, err
+		return nil, err
 	}
 
-	if videoCodec == "" || !strings.Contains(strings.ToLower(supportedCodecs), strings.ToLower(videoCodec)) {
-		errChan := make(chan error)
-		go func() {
-			defer close(errChan)
-			video.Seek(0, 0)
-			outputVideo, err := service.ConvertVideoCodec(video, service.Envs.FfmpegConversionCodec, service.Envs.FfmpegConversionBitrate)
-			if err != nil {
-				service.Logger.Error(ErrorExecutingFfmpegCommand, "err", err.Error())
-			}
-
-			uploadInfo, err := service.UploadVideo(outputVideo, videoInfo.Filename)
-			if err != nil {
-				errChan <- err
-			}
-
-			service.Logger.Info("video uploaded successfully", "video_name", uploadInfo.Key, "video_size", uploadInfo.Size)
-
-			errChan <- nil
-		}()
-
-		go func() {
-			err := <-errChan
-			if err != nil {
-				service.Logger.Error("error converting video", "err", err.Error())
-			}
-		}()
-
-		conversionNeed = true
+	probe, err := service.probeVideo(ctx, video)
+	if err != nil {
+		service.Logger.ErrorContext(ctx, "error getting video codec", "err", err.Error())
+		return nil, err
 	}
-
-	return conversionNeed, nil
-}
-
-func (service *VideoService) StreamVideoAsRTSP(video *minio.Object, protocol, streamAddress string) ([]byte, error) {
-	rtspVideoStreamCommand := cmdCommand.CmdCommand{
-		App: "ffmpeg",
-		Args: []string{
-			"-re",
-			"-i", "pipe:0",
-			"-c:v", "libx264",
-			"-c", "copy",
-			"-b:v", "1M",
-			"-bsf:v", "h264_mp4toannexb",
-			"-preset", "medium",
-			"-tune", "zerolatency",
-			"-f", protocol,
-			streamAddress,
-		},
-		Pipe:   video,
-		Logger: *service.Logger,
+	videoCodec := probe.VideoCodec
+
+	span.SetAttributes(attribute.String("video.codec", videoCodec), attribute.String("video.container", probe.Formats))
+	if requestedProfile == "" && supportedCodec(videoCodec) {
+		streamable, err := streamableContainer(probe, video)
+		if err != nil {
+			return nil, err
+		}
+		if streamable {
+			return nil, nil
+		}
+
+		// only the container is the problem, the streams are copied without loss
+		if remux, ok := remuxProfile(probe); ok {
+			profileName, profile = remuxProfileName, remux
+			span.SetAttributes(attribute.Bool("video.remux", true))
+			service.Logger.InfoContext(ctx, "video remuxed", "containers", probe.Formats, "container", remux.Container, "audio_codec", remux.AudioCodec)
+		}
 	}
 
-	stdout, err := rtspVideoStreamCommand.ExecuteCommand()
-	if err != nil {
-		rtspVideoStreamCommand.Logger.Error("error starting video as rtsp stream", "error msg", err.Error())
+	// the original isn't stored when its rendition can't be
+	if err := service.checkRendition(ctx, identity, renditionName(videoInfo.Filename, profileName, profile), originalsPrefix+videoInfo.Filename); err != nil {
 		return nil, err
 	}
 
-	service.Logger.Info("video steram started", "stdout", string(stdout))
-	return stdout, nil
-}
-
-func (service *VideoService) ConvertVideoCodec(video io.ReadSeekCloser, outputVideoCodec, bitrate string) (io.Reader, error) {
-	videoCodecConvertingCommand := cmdCommand.CmdCommand{
-		App:    "ffmpeg",
-		Args:   []string{"-i", "pipe:0", "-c:v", outputVideoCodec, "-crf", bitrate, "-f", "mpegts", "pipe:1"},
-		Pipe:   video,
-		Logger: *service.Logger,
+	release, err := service.limits.acquire(limitConversions, identity)
+	if err != nil {
+		return nil, err
 	}
 
-	ffmpegStdout, err := videoCodecConvertingCommand.ExecuteWithPipeCreation()
+	originalName, err := service.storeOriginal(ctx, identity, video, videoInfo, shared, probe.Duration)
 	if err != nil {
-		videoCodecConvertingCommand.Logger.Error("error converting videocodec", "msg", err.Error())
+		release()
 		return nil, err
 	}
 
-	return ffmpegStdout, nil
+	return service.startConversion(ctx, identity, originalName, shared, profileName, profile, probe.Duration, release)
 }
 
-func (service *VideoService) getVideoCodec(video io.ReadSeekCloser) (string, error) {
-	videoCodecDefinictionCommand := cmdCommand.CmdCommand{
-		App:    "ffprobe",
-		Args:   []string{"-v", "error", "-select_streams", "v:0", "-show_entries", "stream=codec_name", "-of", "default=noprint_wrappers=1:nokey=1", "pipe:0"},
-		Pipe:   video,
-		Logger: *service.Logger,
-	}
-
-	stdout, err := videoCodecDefinictionCommand.ExecuteCommand()
+// StreamVideoAsRTSP pushes the video at videoUrl, which ffmpeg must be able to seek in, to the RTSP
+// server from offset until its end, and returns the end of the ffmpeg output which tells how far it
+// got and why it stopped. videoCodec is the codec of the video named by ffprobe.
+func (service *VideoService) StreamVideoAsRTSP(ctx context.Context, videoUrl, videoCodec, protocol, streamAddress string, offset time.Duration) ([]byte, error) {
+	destination := rtspOutput(protocol, streamAddress)
+	destination.Maps = []cmdCommand.FfmpegMap{{Stream: "V:0"}, {Stream: "a:0", Optional: true}}
+	destination.VideoCodec = cmdCommand.CodecCopy
+	destination.VideoBitstreamFilter = annexBFilters[strings.ToLower(videoCodec)]
+	// WebRTC plays Opus, which is always sampled at 48 kHz
+	destination.AudioCodec = "libopus"
+	destination.AudioBitrate = service.Envs.FfmpegStreamAudioBitrate
+	destination.AudioChannels = 2
+	destination.AudioSampleRate = 48000
+
+	output, err := service.Transcoder.Push(ctx, cmdCommand.Ffmpeg{
+		Inputs: []cmdCommand.FfmpegInput{{
+			Url:      videoUrl,
+			Realtime: true,
+			// a restarted pusher resumes where the previous one stopped
+			Seek: offset,
+		}},
+		Outputs: []cmdCommand.FfmpegOutput{destination},
+	}, nil)
 	if err != nil {
-		videoCodecDefinictionCommand.Logger.Error("error getting video codec", "msg", err.Error())
-		return "", err
-	}
-	if stdout == nil {
-		service.Logger.Error("couldn't get video codec", "codec_value", string(stdout))
-		return "", fmt.Errorf("cudn't get video codec")
+		service.Logger.ErrorContext(ctx, "error streaming video as rtsp stream", "error msg", err.Error())
+		return output, err
 	}
 
-	videoCodec := string(stdout)
-
-	videoCodecDefinictionCommand.Logger.Info("video codec received", "value", videoCodec)
-
-	return videoCodec, nil
+	service.Logger.InfoContext(ctx, "video stream finished", "offset", offset.String())
+	return output, nil
 }
 
-func (service *VideoService) getVideoContainers(video io.ReadSeekCloser) (string, error) {
-	videoContainerDefenitionCommand := cmdCommand.CmdCommand{
-		App:    "ffprobe",
-		Args:   []string{"-v", "quiet", "-show_entries", "format=format_name", "-of", "default=noprint_wrappers=1:nokey=1", "pipe:0"},
-		Pipe:   video,
-		Logger: *service.Logger,
-	}
+var ffmpegProgressTime = regexp.MustCompile(`time=(\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
 
-	ffmpegStdout, err := videoContainerDefenitionCommand.ExecuteCommand()
-	if err != nil {
-		return "", err
+// ffmpegProgress returns the last output time reported by ffmpeg in its output.
+func ffmpegProgress(output []byte) time.Duration {
+	matches := ffmpegProgressTime.FindAllSubmatch(output, -1)
+	if len(matches) == 0 {
+		return 0
 	}
 
-	videoContainers := string(ffmpegStdout)
+	last := matches[len(matches)-1]
+	hours, _ := strconv.Atoi(string(last[1]))
+	minutes, _ := strconv.Atoi(string(last[2]))
+	seconds, _ := strconv.ParseFloat(string(last[3]), 64)
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second))
+}
 
-	service.Logger.Info("video containers was got", "containers", videoContainers)
+// StreamTimeShiftAsRTSP pushes an fMP4 stream to the RTSP server, reading it faster than realtime
+// so that a time-shifted viewer catches up with the live edge.
+func (service *VideoService) StreamTimeShiftAsRTSP(video io.Reader, protocol, streamAddress string, readRate float64) ([]byte, error) {
+	destination := rtspOutput(protocol, streamAddress)
+	destination.Codec = cmdCommand.CodecCopy
+
+	output, err := service.Transcoder.Push(service.Context, cmdCommand.Ffmpeg{
+		Inputs: []cmdCommand.FfmpegInput{{
+			Url:      "pipe:0",
+			Format:   "mp4",
+			ReadRate: readRate,
+		}},
+		Outputs: []cmdCommand.FfmpegOutput{destination},
+	}, video)
+	if err != nil {
+		service.Logger.Error("error starting time-shift rtsp stream", "error msg", err.Error())
+		return output, err
+	}
 
-	return videoContainers, nil
+	service.Logger.Info("time-shift stream finished")
+	return output, nil
 }
 
-func (service *VideoService) ConvertVideoExtension(inputVideo io.ReadSeekCloser) (io.ReadCloser, error) {
-	convertVideoExtentionCommand := cmdCommand.CmdCommand{
-		App:    "ffmpeg",
-		Args:   []string{"-i", "pipe:0", "-f", "mpegts", "pipe:1"},
-		Pipe:   inputVideo,
-		Logger: *service.Logger,
+// ConvertVideoCodec converts the video at videoUrl with profile, onProgress receives the progress reports
+// of ffmpeg every FFMPEG_PROGRESS_PERIOD, it may be nil.
+func (service *VideoService) ConvertVideoCodec(ctx context.Context, videoUrl string, profile configs.ConversionProfile, onProgress func(cmdCommand.Progress)) (io.Reader, error) {
+	output, err := service.Transcoder.Transcode(ctx, service.conversionCommand(videoUrl, profile), nil, onProgress)
+	if err != nil {
+		service.Logger.Error("error converting videocodec", "msg", err.Error())
+		return nil, err
 	}
 
-	ffmpegStdout, err := convertVideoExtentionCommand.ExecuteWithPipeCreation()
+	return output, nil
+}
+
+// probeVideo returns the codec, container and duration of the video.
+func (service *VideoService) probeVideo(ctx context.Context, video io.ReadSeekCloser) (cmdCommand.ProbeResult, error) {
+	probe, err := service.Transcoder.Probe(ctx, video)
 	if err != nil {
-		convertVideoExtentionCommand.Logger.Error("error converting video extension", "msg", err.Error())
-		return nil, err
+		service.Logger.Error("error probing video", "msg", err.Error())
+		return probe, err
 	}
 
-	return ffmpegStdout, nil
+	service.Logger.Info("video probed", "codec", probe.VideoCodec, "containers", probe.Formats, "duration", probe.Duration.String())
+	return probe, nil
 }
 
 func RTSPtoHLSconverter(rtspUrl string, logger *slog.Logger) ([]byte, error) {
+	args, err := rtspToHLSCommand(rtspUrl).Args()
+	if err != nil {
+		return nil, err
+	}
+
 	convertVideoExtentionCommand := cmdCommand.CmdCommand{
 		App:    "ffmpeg",
-		Args:   []string{"-i", rtspUrl, "-c:v", "copy", "-c:a", "copy", "-hls_time", "2", "-hls_list_size", "10", "-hls_flags", "delete_segments", "-start_number", "1", "output.m3u8"},
+		Args:   args,
 		Logger: *logger,
 	}
 
@@ -181,3 +197,21 @@ func RTSPtoHLSconverter(rtspUrl string, logger *slog.Logger) ([]byte, error) {
 
 	return stdout, err
 }
+
+// rtspToHLSCommand copies the stream at rtspUrl into a sliding HLS playlist.
+func rtspToHLSCommand(rtspUrl string) cmdCommand.Ffmpeg {
+	return cmdCommand.Ffmpeg{
+		Inputs: []cmdCommand.FfmpegInput{{Url: rtspUrl}},
+		Outputs: []cmdCommand.FfmpegOutput{{
+			Url:        "output.m3u8",
+			VideoCodec: cmdCommand.CodecCopy,
+			AudioCodec: cmdCommand.CodecCopy,
+			Options: []cmdCommand.FfmpegOption{
+				{Name: "hls_time", Value: "2"},
+				{Name: "hls_list_size", Value: "10"},
+				{Name: "hls_flags", Value: "delete_segments"},
+				{Name: "start_number", Value: "1"},
+			},
+		}},
+	}
+}
@@ -0,0 +1,800 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"video-handler/configs"
+	"video-handler/external/auth"
+
+	cmdCommand "video-handler/pkg"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/go-chi/chi"
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const testBucket string = "videos"
+
+// testServer runs the whole service on a fake bucket and a fake transcoder, its requests are
+// authenticated with an API key.
+type testServer struct {
+	url             string
+	apiKey          string
+	s3              *fakeS3
+	transcoder      *fakeTranscoder
+	authRepository  *auth.AuthRepository
+	repository      *WebrtcRepository
+	videoService    *VideoService
+	streamerService *StreamerService
+}
+
+func newTestServer(t *testing.T, transcoder *fakeTranscoder) *testServer {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s3 := newFakeS3(t)
+
+	envs := &configs.EnvVariables{
+		RtspStreamUrlPattern:     "rtsp://localhost",
+		FfmpegProtocol:           "rtsp",
+		FfmpegConversionCodec:    "libx264",
+		FfmpegProgressPeriod:     time.Second,
+		FfmpegStreamAudioBitrate: "96k",
+		DefaultConversionProfile: configs.DefaultProfileName,
+		RecordSegmentDuration:    time.Second,
+		LimitRequestBurst:        20,
+		StreamRestartLimit:       0,
+		StreamRestartBackoff:     time.Second,
+		StreamRestartMaxBackoff:  time.Second,
+	}
+	minioEnvs := &configs.MinioEnvs{
+		Endpoint:  s3.endpoint(),
+		AccessKey: "access",
+		SecretKey: "secret",
+		Bucket:    testBucket,
+	}
+
+	videoService, err := NewVideoService(ctx, envs, minioEnvs, transcoder, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := videoService.CreateBucket(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	authRepository, err := auth.NewAuthRepository(&configs.ExternalAuthService{Timeout: time.Second}, videoService.Catalog(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, apiKey, err := authRepository.CreateAPIKey(ctx, &auth.Identity{UserID: "admin"}, "tests", "", []string{auth.ScopeVideosWrite, auth.ScopeStreamsPublish})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamerService, err := NewStreamerService(videoService, authRepository, envs, logger, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(streamerService.Close)
+
+	// the metrics middleware registers its collectors once per registry
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+
+	r := chi.NewRouter()
+	repository := NewWebrtcRepository(r, streamerService, videoService, authRepository, NewAuditLog(ctx, videoService.Catalog(), logger), envs, logger, ctx)
+	handler, err := repository.SetupHandler(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return &testServer{
+		url:             server.URL,
+		apiKey:          apiKey,
+		s3:              s3,
+		transcoder:      transcoder,
+		authRepository:  authRepository,
+		repository:      repository,
+		videoService:    videoService,
+		streamerService: streamerService,
+	}
+}
+
+// newAPIKey creates the API key of another user, with scopes.
+func (ts *testServer) newAPIKey(t *testing.T, scopes ...string) string {
+	t.Helper()
+
+	_, apiKey, err := ts.authRepository.CreateAPIKey(context.Background(), &auth.Identity{UserID: "admin"}, "tests", "", scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apiKey
+}
+
+// request sends a request with apiKey and returns the status and the body of the answer.
+func (ts *testServer) request(t *testing.T, apiKey, method, path, contentType string, body io.Reader) (int, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ts.url+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	data, _ := io.ReadAll(res.Body)
+	return res.StatusCode, data
+}
+
+// do sends a request with the API key of the server and decodes its answer into v.
+func (ts *testServer) do(t *testing.T, method, path, contentType string, body io.Reader, v any) {
+	t.Helper()
+
+	status, data := ts.request(t, ts.apiKey, method, path, contentType, body)
+	if status != http.StatusOK {
+		t.Fatalf("%s %s: %d %s", method, path, status, data)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("%s %s: %v in %s", method, path, err, data)
+	}
+}
+
+// upload posts a file like the upload form does.
+func (ts *testServer) upload(t *testing.T, fileName string, data []byte) Response {
+	t.Helper()
+
+	form, contentType := uploadForm(t, fileName, data)
+	var response Response
+	ts.do(t, http.MethodPost, "/upload", contentType, form, &response)
+	return response
+}
+
+func uploadForm(t *testing.T, fileName string, data []byte) (io.Reader, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("video", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(data)
+	form.Close()
+
+	return &body, form.FormDataContentType()
+}
+
+// waitForJob polls the jobs of the API key until the job of video ends.
+func (ts *testServer) waitForJob(t *testing.T, video string) Job {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var jobs []Job
+		ts.do(t, http.MethodGet, "/jobs", "", nil, &Response{Result: &jobs})
+
+		for _, job := range jobs {
+			if job.Video == video && job.Status != JobRunning {
+				return job
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("the job of %s didn't end", video)
+	return Job{}
+}
+
+func TestUploadFlow(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{
+		Result: cmdCommand.ProbeResult{VideoCodec: "h264", AudioCodec: "aac", Formats: "mpegts", Duration: 2 * time.Second},
+	})
+
+	video := []byte("an MPEG-TS in H264")
+	response := ts.upload(t, "movie.ts", video)
+	if response.Status != http.StatusOK || response.Error != "" {
+		t.Fatalf("upload answered %+v", response)
+	}
+
+	// a streamable video is stored as is, without conversion
+	stored, metadata, ok := ts.s3.object(testBucket, "movie.ts")
+	if !ok {
+		t.Fatalf("movie.ts isn't stored, the bucket has %q", ts.s3.keys(testBucket, ""))
+	}
+	if !bytes.Equal(stored, video) {
+		t.Errorf("movie.ts is %q, want %q", stored, video)
+	}
+	if metadataValue(metadata, metadataOwner) == "" {
+		t.Errorf("movie.ts has no owner in %v", metadata)
+	}
+	if commands := ts.transcoder.Commands(); len(commands) != 0 {
+		t.Errorf("%d ffmpeg commands run, want none", len(commands))
+	}
+
+	var videos []string
+	ts.do(t, http.MethodGet, "/video-list", "", nil, &videos)
+	if len(videos) != 1 || videos[0] != "movie.ts" {
+		t.Errorf("the video list is %q, want [movie.ts]", videos)
+	}
+}
+
+func TestUploadRefusesToOverwriteAnotherUser(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{
+		Result: cmdCommand.ProbeResult{VideoCodec: "h264", AudioCodec: "aac", Formats: "mpegts", Duration: 2 * time.Second},
+	})
+
+	video := []byte("the MPEG-TS of user A")
+	ts.upload(t, "movie.ts", video)
+
+	// user B picks the same name
+	other := ts.newAPIKey(t, auth.ScopeVideosWrite)
+	form, contentType := uploadForm(t, "movie.ts", []byte("the MPEG-TS of user B"))
+	if status, data := ts.request(t, other, http.MethodPost, "/upload", contentType, form); status != http.StatusForbidden {
+		t.Errorf("the upload of user B answered %d %s, want 403", status, data)
+	}
+
+	stored, _, _ := ts.s3.object(testBucket, "movie.ts")
+	if !bytes.Equal(stored, video) {
+		t.Errorf("movie.ts is %q, want the video of user A", stored)
+	}
+
+	// the owner may still replace it
+	replaced := []byte("the new MPEG-TS of user A")
+	ts.upload(t, "movie.ts", replaced)
+	if stored, _, _ := ts.s3.object(testBucket, "movie.ts"); !bytes.Equal(stored, replaced) {
+		t.Errorf("movie.ts is %q, want the new video of user A", stored)
+	}
+}
+
+func TestConvertFlow(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{
+		Result: cmdCommand.ProbeResult{VideoCodec: "mpeg4", AudioCodec: "mp3", Formats: "avi", Duration: 2 * time.Second},
+		Frames: 2 * fakeFrameRate,
+	})
+
+	original := []byte("an AVI in MPEG-4 part 2")
+	response := ts.upload(t, "movie.avi", original)
+	if response.Status != http.StatusOK || response.Error != "" {
+		t.Fatalf("upload answered %+v", response)
+	}
+
+	job := ts.waitForJob(t, "movie.ts")
+	if job.Status != JobSucceeded {
+		t.Fatalf("the conversion ended with %s: %s", job.Status, job.Error)
+	}
+	if job.Progress == nil || job.Progress.Frame != int64(2*fakeFrameRate) {
+		t.Errorf("the last progress is %+v, want %d frames", job.Progress, 2*fakeFrameRate)
+	}
+
+	// the original is kept and the rendition is the output of ffmpeg
+	stored, _, ok := ts.s3.object(testBucket, originalsPrefix+"movie.avi")
+	if !ok || !bytes.Equal(stored, original) {
+		t.Errorf("the original is %q, want %q", stored, original)
+	}
+	rendition, metadata, ok := ts.s3.object(testBucket, "movie.ts")
+	if !ok {
+		t.Fatalf("movie.ts isn't stored, the bucket has %q", ts.s3.keys(testBucket, ""))
+	}
+	if len(rendition) == 0 || len(rendition)%tsPacketSize != 0 || rendition[0] != 0x47 {
+		t.Errorf("movie.ts isn't a MPEG-TS of %d bytes", len(rendition))
+	}
+	if metadataValue(metadata, "profile") != configs.DefaultProfileName {
+		t.Errorf("movie.ts has the metadata %v, want the default profile", metadata)
+	}
+
+	commands := ts.transcoder.Commands()
+	if len(commands) != 1 {
+		t.Fatalf("%d ffmpeg commands run, want 1", len(commands))
+	}
+	if output := commands[0].Outputs[0]; output.VideoCodec != "libx264" || output.Format != "mpegts" {
+		t.Errorf("the conversion writes %s in %s, want libx264 in mpegts", output.VideoCodec, output.Format)
+	}
+
+	// ffmpeg reads the original from a seekable URL of the bucket rather than a pipe
+	if input := commands[0].Inputs[0]; !strings.HasPrefix(input.Url, "http://"+ts.s3.endpoint()+"/"+testBucket+"/"+originalsPrefix+"movie.avi?") {
+		t.Errorf("the conversion reads %s, want a presigned URL of the original", input.Url)
+	}
+}
+
+func TestConvertRefusesToReplaceAnotherRendition(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{
+		Result: cmdCommand.ProbeResult{VideoCodec: "mpeg4", AudioCodec: "mp3", Formats: "avi", Duration: 2 * time.Second},
+		Frames: 2 * fakeFrameRate,
+	})
+
+	ts.upload(t, "movie.avi", []byte("an AVI in MPEG-4 part 2"))
+	if job := ts.waitForJob(t, "movie.ts"); job.Status != JobSucceeded {
+		t.Fatalf("the conversion ended with %s: %s", job.Status, job.Error)
+	}
+
+	// movie.mkv would become movie.ts too
+	response := ts.upload(t, "movie.mkv", []byte("a MKV in MPEG-4 part 2"))
+	if response.Status != http.StatusConflict {
+		t.Errorf("the upload of movie.mkv answered %+v, want 409", response)
+	}
+	if _, _, ok := ts.s3.object(testBucket, originalsPrefix+"movie.mkv"); ok {
+		t.Errorf("the original of a refused conversion is stored")
+	}
+	if _, metadata, _ := ts.s3.object(testBucket, "movie.ts"); metadataValue(metadata, metadataOriginal) != originalsPrefix+"movie.avi" {
+		t.Errorf("movie.ts has the metadata %v, want the rendition of movie.avi", metadata)
+	}
+	if commands := ts.transcoder.Commands(); len(commands) != 1 {
+		t.Errorf("%d ffmpeg commands run, want 1", len(commands))
+	}
+
+	// the original of movie.ts may still be converted again into it
+	var job Job
+	ts.do(t, http.MethodPost, "/transcode?video=movie.ts", "", nil, &Response{Result: &job})
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status == JobRunning && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		var jobs []Job
+		ts.do(t, http.MethodGet, "/jobs", "", nil, &Response{Result: &jobs})
+		for _, other := range jobs {
+			if other.ID == job.ID {
+				job = other
+			}
+		}
+	}
+	if job.Status != JobSucceeded {
+		t.Errorf("the new conversion of movie.avi ended with %s: %s", job.Status, job.Error)
+	}
+}
+
+func TestStreamFlow(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{
+		Result: cmdCommand.ProbeResult{VideoCodec: "h264", Formats: "mov,mp4,m4a,3gp,3g2,mj2", Duration: 10 * time.Second},
+		Frames: 10 * fakeFrameRate,
+	})
+
+	identity := &auth.Identity{UserID: "viewer"}
+	if _, err := ts.videoService.UploadVideo(context.Background(), identity, strings.NewReader("a MP4 in H264"), "movie.mp4", "video/mp4", false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := ts.streamerService.createVideoStream(ctx, identity, "movie.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.server.WaitForPublisher(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader of the stream receives the H264 pushed by the pusher
+	u, err := base.ParseURL(stream.readUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := gortsplib.Client{}
+	if err := reader.Start(u.Scheme, u.Host); err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	desc, _, err := reader.Describe(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forma *format.H264
+	if desc.FindFormat(&forma) == nil {
+		t.Fatalf("the stream has no H264 media: %+v", desc.Medias)
+	}
+	if err := reader.SetupAll(desc.BaseURL, desc.Medias); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan struct{}, 1)
+	reader.OnPacketRTPAny(func(medi *description.Media, forma format.Format, pkt *rtp.Packet) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	})
+	if _, err := reader.Play(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-received:
+	case <-ctx.Done():
+		t.Fatal("no packet received from the stream")
+	}
+
+	// the pusher reads the video from a seekable URL of the bucket
+	commands := ts.transcoder.Commands()
+	if len(commands) != 1 {
+		t.Fatalf("%d ffmpeg commands run, want 1", len(commands))
+	}
+	input, output := commands[0].Inputs[0], commands[0].Outputs[0]
+	if !strings.HasPrefix(input.Url, "http://"+ts.s3.endpoint()+"/"+testBucket+"/movie.mp4?") {
+		t.Errorf("the pusher reads %s, want a presigned URL of movie.mp4", input.Url)
+	}
+	if output.VideoBitstreamFilter != "h264_mp4toannexb" {
+		t.Errorf("the pusher filters the video with %q, want h264_mp4toannexb", output.VideoBitstreamFilter)
+	}
+}
+
+func TestCloseStopsPushersBeforeServers(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{
+		Result: cmdCommand.ProbeResult{VideoCodec: "h264", Formats: "mpegts", Duration: time.Minute},
+		Frames: 60 * fakeFrameRate,
+	})
+	ts.streamerService.Envs.StreamRestartLimit = 5
+	ts.streamerService.Envs.StreamRestartBackoff = 10 * time.Millisecond
+	ts.streamerService.Envs.StreamRestartMaxBackoff = 10 * time.Millisecond
+
+	identity := &auth.Identity{UserID: "viewer"}
+	if _, err := ts.videoService.UploadVideo(context.Background(), identity, strings.NewReader("a MPEG-TS in H264"), "movie.ts", "video/mp2t", false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := ts.streamerService.createVideoStream(ctx, identity, "movie.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.server.WaitForPublisher(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pusher is gone when Close returns, it isn't restarted against the closed server
+	ts.streamerService.Close()
+	time.Sleep(100 * time.Millisecond)
+	if commands := ts.transcoder.Commands(); len(commands) != 1 {
+		t.Errorf("%d ffmpeg commands run, want the pusher only once", len(commands))
+	}
+	if !stream.finished() {
+		t.Errorf("the stream is %s after Close", stream.currentState().State)
+	}
+	if _, err := ts.streamerService.getStream(stream.ID); err == nil {
+		t.Errorf("the stream is still listed")
+	}
+
+	// the stream is ended once
+	ts.streamerService.endStream(stream)
+	if _, err := ts.streamerService.createVideoStream(ctx, identity, "movie.ts"); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("a stream created after Close returned %v, want %v", err, ErrShuttingDown)
+	}
+}
+
+// dialWebsocket opens the websocket with apiKey and answers the offers of the server like the player does,
+// the other messages it receives are sent to the returned channel.
+func (ts *testServer) dialWebsocket(t *testing.T, apiKey string) (*threadSafeWriter, <-chan websocketMessage) {
+	t.Helper()
+
+	return ts.openWebsocket(t, "/websocket", http.Header{"Authorization": {"Bearer " + apiKey}})
+}
+
+// openWebsocket opens the websocket of path with header, like dialWebsocket.
+func (ts *testServer) openWebsocket(t *testing.T, path string, header http.Header) (*threadSafeWriter, <-chan websocketMessage) {
+	t.Helper()
+
+	unsafeConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.url, "http")+path, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &threadSafeWriter{Conn: unsafeConn}
+	t.Cleanup(func() { conn.Close() })
+
+	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peerConnection.Close() })
+
+	messages := make(chan websocketMessage, 64)
+	go func() {
+		defer close(messages)
+		for {
+			var message websocketMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+
+			if message.Event == "offer" {
+				if err := answerOffer(peerConnection, conn, message.Data); err != nil {
+					return
+				}
+				continue
+			}
+
+			select {
+			case messages <- message:
+			default:
+			}
+		}
+	}()
+	return conn, messages
+}
+
+func answerOffer(peerConnection *webrtc.PeerConnection, conn *threadSafeWriter, data string) error {
+	var offer webrtc.SessionDescription
+	if err := json.Unmarshal([]byte(data), &offer); err != nil {
+		return err
+	}
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	answerString, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	return conn.WriteJSON(websocketMessage{Event: "answer", Data: string(answerString)})
+}
+
+// sentTracks returns the IDs of the tracks sent to the peers of the user.
+func (ts *testServer) sentTracks(userID string) map[string]bool {
+	return ts.peerTracks(func(peer peerConnectionState) bool {
+		return peer.identity != nil && peer.identity.UserID == userID
+	})
+}
+
+// peerTracks returns the IDs of the tracks sent to the peers matching match.
+func (ts *testServer) peerTracks(match func(peer peerConnectionState) bool) map[string]bool {
+	ts.repository.listLock.RLock()
+	defer ts.repository.listLock.RUnlock()
+
+	tracks := map[string]bool{}
+	for _, peer := range ts.repository.peerConnections {
+		if !match(peer) {
+			continue
+		}
+		for _, sender := range peer.peerConnection.GetSenders() {
+			if sender.Track() != nil {
+				tracks[sender.Track().ID()] = true
+			}
+		}
+	}
+	return tracks
+}
+
+func TestWebrtcTracksOfPrivateStreams(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{
+		Result: cmdCommand.ProbeResult{VideoCodec: "h264", Formats: "mpegts", Duration: 10 * time.Second},
+		Frames: 10 * fakeFrameRate,
+	})
+	ts.upload(t, "movie.ts", []byte("the private MPEG-TS of user A"))
+
+	owner, err := ts.authRepository.Authenticate(httptest.NewRecorder(), authorizedRequest(ts.apiKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerKey := ts.newAPIKey(t)
+	viewer, err := ts.authRepository.Authenticate(httptest.NewRecorder(), authorizedRequest(viewerKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ownerConn, ownerMessages := ts.dialWebsocket(t, ts.apiKey)
+	ts.dialWebsocket(t, viewerKey)
+
+	if err := ownerConn.WriteJSON(websocketMessage{Event: "publish", Data: "movie.ts"}); err != nil {
+		t.Fatal(err)
+	}
+	for message := range ownerMessages {
+		if message.Event == "error" {
+			t.Fatalf("the publish failed: %s", message.Data)
+		}
+		if message.Event == "stream" {
+			break
+		}
+	}
+
+	// the owner receives the video and the audio, the other user nothing
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ts.sentTracks(owner.UserID)) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tracks := ts.sentTracks(owner.UserID); len(tracks) != 2 {
+		t.Fatalf("the owner receives %d tracks, want 2", len(tracks))
+	}
+	for end := time.Now().Add(time.Second); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		if tracks := ts.sentTracks(viewer.UserID); len(tracks) != 0 {
+			t.Fatalf("the other user receives the tracks %v of a private stream", tracks)
+		}
+	}
+}
+
+func authorizedRequest(apiKey string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	return req
+}
+
+// publish starts a stream of video on the websocket and returns it.
+func (ts *testServer) publish(t *testing.T, conn *threadSafeWriter, messages <-chan websocketMessage, video string) *videoStream {
+	t.Helper()
+
+	if err := conn.WriteJSON(websocketMessage{Event: "publish", Data: video}); err != nil {
+		t.Fatal(err)
+	}
+	for message := range messages {
+		if message.Event == "error" {
+			t.Fatalf("the publish failed: %s", message.Data)
+		}
+		if message.Event != "stream" {
+			continue
+		}
+
+		var info StreamInfo
+		if err := json.Unmarshal([]byte(message.Data), &info); err != nil {
+			t.Fatal(err)
+		}
+		stream, err := ts.streamerService.getStream(info.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stream
+	}
+
+	t.Fatal("the websocket closed before the stream started")
+	return nil
+}
+
+func TestPlaybackTokenOnEachPath(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{
+		Result: cmdCommand.ProbeResult{VideoCodec: "h264", Formats: "mpegts", Duration: 10 * time.Second},
+		Frames: 10 * fakeFrameRate,
+	})
+	ts.streamerService.Envs.DvrWindow = 10 * time.Second
+	ts.streamerService.Envs.DvrDirectory = t.TempDir()
+	ts.upload(t, "movie.ts", []byte("the private MPEG-TS of user A"))
+
+	ownerConn, ownerMessages := ts.dialWebsocket(t, ts.apiKey)
+	granted := ts.publish(t, ownerConn, ownerMessages, "movie.ts")
+	other := ts.publish(t, ownerConn, ownerMessages, "movie.ts")
+
+	var playback PlaybackTokenInfo
+	ts.do(t, http.MethodPost, "/playback-tokens?stream="+granted.ID, "", nil, &Response{Result: &playback})
+	if playback.Token == "" {
+		t.Fatal("no playback token issued")
+	}
+
+	t.Run("hls", func(t *testing.T) {
+		playlist := func(stream *videoStream, token string) int {
+			status, _ := ts.request(t, "", http.MethodGet, "/streams/"+stream.ID+"/dvr.m3u8?token="+url.QueryEscape(token), "", nil)
+			return status
+		}
+
+		// the DVR starts with the pusher
+		deadline := time.Now().Add(5 * time.Second)
+		for playlist(granted, playback.Token) != http.StatusOK && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if status := playlist(granted, playback.Token); status != http.StatusOK {
+			t.Errorf("the playlist of the granted stream answered %d, want 200", status)
+		}
+		if status := playlist(other, playback.Token); status != http.StatusForbidden {
+			t.Errorf("the playlist of another stream answered %d, want 403", status)
+		}
+		if status := playlist(granted, playback.Token+"x"); status != http.StatusUnauthorized {
+			t.Errorf("the playlist with a forged token answered %d, want 401", status)
+		}
+	})
+
+	t.Run("rtsp", func(t *testing.T) {
+		// gortsplib answers the challenge with Digest like ffmpeg, the token goes in the query
+		read := func(stream *videoStream, token string) error {
+			rtspUrl, err := base.ParseURL(stream.RtspUrl + "?token=" + url.QueryEscape(token))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader := gortsplib.Client{}
+			if err := reader.Start(rtspUrl.Scheme, rtspUrl.Host); err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			desc, _, err := reader.Describe(rtspUrl)
+			if err != nil {
+				return err
+			}
+			if err := reader.SetupAll(desc.BaseURL, desc.Medias); err != nil {
+				return err
+			}
+			_, err = reader.Play(nil)
+			return err
+		}
+
+		if err := read(granted, playback.Token); err != nil {
+			t.Errorf("reading the granted stream failed: %v", err)
+		}
+		if err := read(other, playback.Token); err == nil {
+			t.Errorf("another stream is read with the token")
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		viewerConn, viewerMessages := ts.openWebsocket(t, "/websocket?token="+url.QueryEscape(playback.Token), nil)
+		isViewer := func(peer peerConnectionState) bool { return peer.grant != nil }
+
+		// the viewer receives the video and the audio of the granted stream only
+		ts.repository.listLock.RLock()
+		grantedTracks := map[string]bool{}
+		for trackID, stream := range ts.repository.trackStreams {
+			if stream == granted {
+				grantedTracks[trackID] = true
+			}
+		}
+		ts.repository.listLock.RUnlock()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(ts.peerTracks(isViewer)) != len(grantedTracks) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		tracks := ts.peerTracks(isViewer)
+		if len(grantedTracks) != 2 || len(tracks) != 2 {
+			t.Fatalf("the viewer receives %d tracks, want the 2 of the granted stream", len(tracks))
+		}
+		for trackID := range tracks {
+			if !grantedTracks[trackID] {
+				t.Errorf("the viewer receives the track %s of another stream", trackID)
+			}
+		}
+
+		// the token only allows watching
+		if err := viewerConn.WriteJSON(websocketMessage{Event: "publish", Data: "movie.ts"}); err != nil {
+			t.Fatal(err)
+		}
+		for message := range viewerMessages {
+			if message.Event == "stream" {
+				t.Fatalf("the viewer started the stream %s", message.Data)
+			}
+			if message.Event == "error" {
+				break
+			}
+		}
+
+		_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.url, "http")+"/websocket?token="+url.QueryEscape(playback.Token+"x"), nil)
+		if err == nil || res == nil || res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("the handshake with a forged token returned %v", err)
+		}
+	})
+}
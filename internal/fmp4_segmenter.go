@@ -0,0 +1,468 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtpsimpleaudio"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/opus"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4/seekablebuffer"
+	"github.com/pion/rtp"
+)
+
+const (
+	fmp4TimeScale      = 90000
+	fmp4AudioTimeScale = 48000
+	fmp4VideoTrackID   = 1
+	fmp4AudioTrackID   = 2
+	fmp4DefaultSegment = 4 * time.Second
+)
+
+func durationGoToMP4(v time.Duration, timeScale int) int64 {
+	return int64(v.Seconds() * float64(timeScale))
+}
+
+type pendingSample struct {
+	sample *fmp4.PartSample
+	dts    time.Duration
+}
+
+// fmp4Segmenter muxes H264 access units, and Opus packets when opus is set, into fragmented MP4 segments.
+// A new segment is started on the first IDR after segmentDuration elapsed,
+// so every segment can be decoded on its own once the init segment is known.
+type fmp4Segmenter struct {
+	segmentDuration time.Duration
+	onInit          func(init []byte) error
+	onSegment       func(seq uint32, segment []byte, duration time.Duration) error
+
+	sps          []byte
+	pps          []byte
+	initialized  bool
+	dtsExtractor *h264.DTSExtractor
+	startDTS     time.Duration
+	segmentStart time.Duration
+	lastDuration time.Duration
+	seq          uint32
+	samples      []*fmp4.PartSample
+	pending      *pendingSample
+
+	// the audio track of the init segment, nil without audio
+	opus         *fmp4.CodecOpus
+	audioStart   time.Duration
+	audioSamples []*fmp4.PartSample
+	audioPending *pendingSample
+}
+
+func newFmp4Segmenter(
+	segmentDuration time.Duration,
+	sps, pps []byte,
+	onInit func(init []byte) error,
+	onSegment func(seq uint32, segment []byte, duration time.Duration) error,
+) *fmp4Segmenter {
+	if segmentDuration <= 0 {
+		segmentDuration = fmp4DefaultSegment
+	}
+
+	return &fmp4Segmenter{
+		segmentDuration: segmentDuration,
+		onInit:          onInit,
+		onSegment:       onSegment,
+		sps:             sps,
+		pps:             pps,
+	}
+}
+
+// writeH264 adds an access unit to the current segment.
+func (s *fmp4Segmenter) writeH264(au [][]byte, pts time.Duration) error {
+	var filteredAU [][]byte
+
+	nonIDRPresent := false
+	idrPresent := false
+
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS:
+			s.sps = nalu
+			continue
+
+		case h264.NALUTypePPS:
+			s.pps = nalu
+			continue
+
+		case h264.NALUTypeAccessUnitDelimiter:
+			continue
+
+		case h264.NALUTypeIDR:
+			idrPresent = true
+
+		case h264.NALUTypeNonIDR:
+			nonIDRPresent = true
+		}
+
+		filteredAU = append(filteredAU, nalu)
+	}
+
+	if filteredAU == nil || (!nonIDRPresent && !idrPresent) {
+		return nil
+	}
+
+	// add SPS and PPS before every access unit that contains an IDR
+	if idrPresent {
+		filteredAU = append([][]byte{s.sps, s.pps}, filteredAU...)
+	}
+
+	if s.dtsExtractor == nil {
+		// skip samples silently until we find one with a IDR
+		if !idrPresent {
+			return nil
+		}
+		if s.sps == nil || s.pps == nil {
+			return fmt.Errorf("SPS or PPS not received yet")
+		}
+
+		if !s.initialized {
+			err := s.writeInit()
+			if err != nil {
+				return err
+			}
+			s.initialized = true
+		}
+
+		// the stream, or the one of a publisher after a discontinuity, goes on where the segments ended
+		s.dtsExtractor = h264.NewDTSExtractor()
+		s.startDTS = pts - s.segmentStart
+	}
+
+	dts, err := s.dtsExtractor.Extract(filteredAU, pts)
+	if err != nil {
+		return err
+	}
+
+	// timestamps are relative to the first IDR of the stream
+	dts -= s.startDTS
+	pts -= s.startDTS
+
+	if s.pending != nil {
+		s.lastDuration = dts - s.pending.dts
+		s.pending.sample.Duration = uint32(durationGoToMP4(s.lastDuration, fmp4TimeScale))
+		s.samples = append(s.samples, s.pending.sample)
+		s.pending = nil
+	}
+
+	if idrPresent && len(s.samples) > 0 && dts-s.segmentStart >= s.segmentDuration {
+		err := s.flushSegment(dts)
+		if err != nil {
+			return err
+		}
+	}
+
+	sample, err := fmp4.NewPartSampleH26x(int32(durationGoToMP4(pts-dts, fmp4TimeScale)), idrPresent, filteredAU)
+	if err != nil {
+		return err
+	}
+
+	s.pending = &pendingSample{
+		sample: sample,
+		dts:    dts,
+	}
+
+	return nil
+}
+
+// writeOpus adds an Opus packet to the current segment. The packets before the first IDR are dropped
+// like the video, so that both tracks start together.
+func (s *fmp4Segmenter) writeOpus(packet []byte, pts time.Duration) {
+	if s.opus == nil || s.dtsExtractor == nil {
+		return
+	}
+
+	// the first packet can't start before the IDR, the next ones before their predecessor
+	pts -= s.startDTS
+	if (s.audioPending == nil && pts < s.segmentStart) || (s.audioPending != nil && pts <= s.audioPending.dts) {
+		return
+	}
+
+	// a packet lasts until the next one, which covers the lost packets
+	s.flushAudioPending(pts)
+	s.audioPending = &pendingSample{
+		sample: &fmp4.PartSample{Payload: packet},
+		dts:    pts,
+	}
+}
+
+// flushAudioPending adds the pending Opus packet to the current segment, it ends at next or after its
+// own duration when next isn't after it.
+func (s *fmp4Segmenter) flushAudioPending(next time.Duration) {
+	if s.audioPending == nil {
+		return
+	}
+
+	duration := next - s.audioPending.dts
+	if duration <= 0 {
+		duration = opus.PacketDuration(s.audioPending.sample.Payload)
+	}
+	s.audioPending.sample.Duration = uint32(durationGoToMP4(duration, fmp4AudioTimeScale))
+
+	if len(s.audioSamples) == 0 {
+		s.audioStart = s.audioPending.dts
+	}
+	s.audioSamples = append(s.audioSamples, s.audioPending.sample)
+	s.audioPending = nil
+}
+
+// close writes the remaining samples as the last segment.
+func (s *fmp4Segmenter) close() error {
+	s.flushAudioPending(0)
+
+	if s.pending == nil {
+		s.audioSamples = nil
+		return nil
+	}
+
+	duration := s.lastDuration
+	if duration <= 0 {
+		duration = time.Second / 30
+	}
+
+	s.pending.sample.Duration = uint32(durationGoToMP4(duration, fmp4TimeScale))
+	s.samples = append(s.samples, s.pending.sample)
+	end := s.pending.dts + duration
+	s.pending = nil
+
+	return s.flushSegment(end)
+}
+
+// discontinuity ends the current segment, the timestamps of the next IDR start the following one.
+// The init segment is kept: SPS and PPS are repeated before every IDR.
+func (s *fmp4Segmenter) discontinuity() error {
+	err := s.close()
+	s.dtsExtractor = nil
+	return err
+}
+
+func (s *fmp4Segmenter) writeInit() error {
+	init := fmp4.Init{
+		Tracks: []*fmp4.InitTrack{{
+			ID:        fmp4VideoTrackID,
+			TimeScale: fmp4TimeScale,
+			Codec: &fmp4.CodecH264{
+				SPS: s.sps,
+				PPS: s.pps,
+			},
+		}},
+	}
+	if s.opus != nil {
+		init.Tracks = append(init.Tracks, &fmp4.InitTrack{
+			ID:        fmp4AudioTrackID,
+			TimeScale: fmp4AudioTimeScale,
+			Codec:     s.opus,
+		})
+	}
+
+	var buf seekablebuffer.Buffer
+	err := init.Marshal(&buf)
+	if err != nil {
+		return err
+	}
+
+	return s.onInit(buf.Bytes())
+}
+
+func (s *fmp4Segmenter) flushSegment(end time.Duration) error {
+	s.seq++
+
+	part := fmp4.Part{
+		SequenceNumber: s.seq,
+		Tracks: []*fmp4.PartTrack{{
+			ID:       fmp4VideoTrackID,
+			BaseTime: uint64(durationGoToMP4(s.segmentStart, fmp4TimeScale)),
+			Samples:  s.samples,
+		}},
+	}
+	if len(s.audioSamples) > 0 {
+		part.Tracks = append(part.Tracks, &fmp4.PartTrack{
+			ID:       fmp4AudioTrackID,
+			BaseTime: uint64(durationGoToMP4(s.audioStart, fmp4AudioTimeScale)),
+			Samples:  s.audioSamples,
+		})
+	}
+
+	var buf seekablebuffer.Buffer
+	err := part.Marshal(&buf)
+	if err != nil {
+		return err
+	}
+
+	duration := end - s.segmentStart
+	s.samples = nil
+	s.audioSamples = nil
+	s.segmentStart = end
+
+	return s.onSegment(s.seq, buf.Bytes(), duration)
+}
+
+// h264SegmentWriter feeds the H264 media of a published stream, and its Opus media, into a fmp4Segmenter.
+// Audio in other codecs isn't segmented.
+type h264SegmentWriter struct {
+	media        *description.Media
+	decoder      *rtph264.Decoder
+	audioMedia   *description.Media
+	audioDecoder *rtpsimpleaudio.Decoder
+	segmenter    *fmp4Segmenter
+	mutex        sync.Mutex
+	logger       *slog.Logger
+}
+
+func newH264SegmentWriter(
+	desc *description.Session,
+	segmentDuration time.Duration,
+	logger *slog.Logger,
+	onInit func(init []byte) error,
+	onSegment func(seq uint32, segment []byte, duration time.Duration) error,
+) (*h264SegmentWriter, error) {
+	var forma *format.H264
+	media := desc.FindFormat(&forma)
+	if media == nil {
+		return nil, errors.New("only H264 streams can be segmented")
+	}
+
+	decoder, err := forma.CreateDecoder()
+	if err != nil {
+		return nil, err
+	}
+
+	sps, pps := forma.SafeParams()
+
+	w := &h264SegmentWriter{
+		media:     media,
+		decoder:   decoder,
+		segmenter: newFmp4Segmenter(segmentDuration, sps, pps, onInit, onSegment),
+		logger:    logger,
+	}
+	w.setAudio(desc)
+	return w, nil
+}
+
+// setAudio segments the Opus media of desc. Once the init segment is written its audio track is fixed,
+// the audio of a publisher which doesn't match it is dropped.
+func (w *h264SegmentWriter) setAudio(desc *description.Session) {
+	w.audioMedia = nil
+	w.audioDecoder = nil
+
+	var forma *format.Opus
+	media := desc.FindFormat(&forma)
+
+	if !w.segmenter.initialized {
+		w.segmenter.opus = nil
+		if media != nil {
+			w.segmenter.opus = &fmp4.CodecOpus{ChannelCount: forma.ChannelCount}
+		}
+	}
+
+	if media == nil {
+		for _, medi := range desc.Medias {
+			if medi.Type == description.MediaTypeAudio {
+				w.logger.Warn("only Opus audio is segmented, the audio of the stream is dropped", "codec", medi.Formats[0].Codec())
+				break
+			}
+		}
+		return
+	}
+
+	if w.segmenter.opus == nil || w.segmenter.opus.ChannelCount != forma.ChannelCount {
+		w.logger.Warn("the audio of the republished stream doesn't match the segments, it's dropped", "channels", forma.ChannelCount)
+		return
+	}
+
+	decoder, err := forma.CreateDecoder()
+	if err != nil {
+		w.logger.Error("failed to decode the audio of the stream", "err", err.Error())
+		return
+	}
+
+	w.audioMedia = media
+	w.audioDecoder = decoder
+}
+
+// handlePacket implements rtspserver.PacketHandler.
+func (w *h264SegmentWriter) handlePacket(medi *description.Media, forma format.Format, pkt *rtp.Packet, pts time.Duration) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	switch medi {
+	case w.media:
+		au, err := w.decoder.Decode(pkt)
+		if err != nil {
+			// most of the times the decoder is waiting for the rest of a fragmented NALU
+			return
+		}
+
+		if err := w.segmenter.writeH264(au, pts); err != nil {
+			w.logger.Error("failed to write fMP4 segment", "err", err.Error())
+		}
+
+	case w.audioMedia:
+		packet, err := w.audioDecoder.Decode(pkt)
+		if err != nil {
+			return
+		}
+
+		w.segmenter.writeOpus(packet, pts)
+	}
+}
+
+// handlePublish implements rtspserver.PublishHandler, it follows a publisher which announced the stream
+// again: the packets of its new H264 and Opus medias are segmented after the ones of the previous publisher.
+func (w *h264SegmentWriter) handlePublish(desc *description.Session) {
+	var forma *format.H264
+	media := desc.FindFormat(&forma)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if media == w.media {
+		return
+	}
+
+	if err := w.segmenter.discontinuity(); err != nil {
+		w.logger.Error("failed to write fMP4 segment", "err", err.Error())
+	}
+
+	if media == nil {
+		w.media = nil
+		w.audioMedia = nil
+		w.logger.Error("the stream was published again without H264, it isn't segmented anymore")
+		return
+	}
+
+	decoder, err := forma.CreateDecoder()
+	if err != nil {
+		w.media = nil
+		w.audioMedia = nil
+		w.logger.Error("failed to decode the republished stream", "err", err.Error())
+		return
+	}
+
+	w.media = media
+	w.decoder = decoder
+	w.setAudio(desc)
+}
+
+func (w *h264SegmentWriter) close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.segmenter.close()
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+)
+
+// a 20 ms CELT fullband Opus packet
+var fakeOpusPacket = []byte{0xf8, 0xff, 0xfe}
+
+func TestFmp4SegmenterMuxesOpus(t *testing.T) {
+	var init []byte
+	var segments [][]byte
+	segmenter := newFmp4Segmenter(time.Second, fakeSPS, fakePPS,
+		func(b []byte) error {
+			init = b
+			return nil
+		},
+		func(seq uint32, segment []byte, duration time.Duration) error {
+			segments = append(segments, segment)
+			return nil
+		},
+	)
+	segmenter.opus = &fmp4.CodecOpus{ChannelCount: 2}
+
+	// the stream starts at 10s, the audio before the first IDR is dropped
+	start := 10 * time.Second
+	segmenter.writeOpus(fakeOpusPacket, start-20*time.Millisecond)
+
+	frameDuration := time.Second / time.Duration(fakeFrameRate)
+	for frame := 0; frame < 2*fakeFrameRate; frame++ {
+		pts := start + time.Duration(frame)*frameDuration
+		if err := segmenter.writeH264(fakeAccessUnit(frame), pts); err != nil {
+			t.Fatal(err)
+		}
+		segmenter.writeOpus(fakeOpusPacket, pts)
+		segmenter.writeOpus(fakeOpusPacket, pts+20*time.Millisecond)
+	}
+	if err := segmenter.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var initSegment fmp4.Init
+	if err := initSegment.Unmarshal(bytes.NewReader(init)); err != nil {
+		t.Fatal(err)
+	}
+	if len(initSegment.Tracks) != 2 {
+		t.Fatalf("the init segment has %d tracks, want the video and the audio", len(initSegment.Tracks))
+	}
+	if codec, ok := initSegment.Tracks[1].Codec.(*fmp4.CodecOpus); !ok || codec.ChannelCount != 2 || initSegment.Tracks[1].TimeScale != fmp4AudioTimeScale {
+		t.Errorf("the audio track is %+v, want stereo Opus at 48 kHz", initSegment.Tracks[1])
+	}
+
+	if len(segments) != 2 {
+		t.Fatalf("%d segments written, want 2", len(segments))
+	}
+
+	// the audio track goes on from segment to segment without gaps
+	var audioEnd uint64
+	audioSamples := 0
+	for i, segment := range segments {
+		var parts fmp4.Parts
+		if err := parts.Unmarshal(segment); err != nil {
+			t.Fatal(err)
+		}
+
+		var audio *fmp4.PartTrack
+		for _, track := range parts[0].Tracks {
+			if track.ID == fmp4AudioTrackID {
+				audio = track
+			}
+		}
+		if audio == nil {
+			t.Fatalf("segment %d has no audio", i)
+		}
+		if audio.BaseTime != audioEnd {
+			t.Errorf("the audio of segment %d starts at %d, want %d", i, audio.BaseTime, audioEnd)
+		}
+		for _, sample := range audio.Samples {
+			if sample.Duration != 960 || !bytes.Equal(sample.Payload, fakeOpusPacket) {
+				t.Errorf("the audio of segment %d has a sample of %d ticks, want 960", i, sample.Duration)
+			}
+			audioEnd += uint64(sample.Duration)
+		}
+		audioSamples += len(audio.Samples)
+	}
+	if audioSamples != 4*fakeFrameRate {
+		t.Errorf("%d Opus packets muxed, want %d", audioSamples, 4*fakeFrameRate)
+	}
+}
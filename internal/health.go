@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	cmdCommand "video-handler/pkg"
+)
+
+const (
+	HealthOK     string = "ok"
+	HealthFailed string = "failed"
+
+	healthCheckTimeout  = 5 * time.Second
+	listenerDialTimeout = time.Second
+)
+
+var (
+	errDiskUnsupported = errors.New("free disk space isn't available on this platform")
+)
+
+// DependencyStatus is the result of the check of a dependency.
+type DependencyStatus struct {
+	Status   string         `json:"status"`
+	Error    string         `json:"error,omitempty"`
+	Details  map[string]any `json:"details,omitempty"`
+	Duration string         `json:"duration"`
+}
+
+type dependencyCheck func(ctx context.Context) (map[string]any, error)
+
+// readiness checks the dependencies concurrently, the service is ready when none failed.
+func (wr *WebrtcRepository) readiness(ctx context.Context) ReadinessReport {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	checks := map[string]dependencyCheck{
+		"minio":   wr.videoService.checkStorage,
+		"ffmpeg":  checkProcess("ffmpeg"),
+		"ffprobe": checkProcess("ffprobe"),
+		"disk":    wr.checkDisk,
+		"rtsp":    wr.streamerService.checkListeners,
+	}
+
+	report := ReadinessReport{
+		Status: HealthOK,
+		Checks: make(map[string]DependencyStatus, len(checks)+1),
+	}
+	if wr.draining.Load() {
+		report.Status = HealthFailed
+		report.Checks["shutdown"] = DependencyStatus{Status: HealthFailed, Error: ErrShuttingDown.Error()}
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check dependencyCheck) {
+			defer wg.Done()
+
+			start := time.Now()
+			details, err := check(ctx)
+			status := DependencyStatus{
+				Status:   HealthOK,
+				Details:  details,
+				Duration: time.Since(start).String(),
+			}
+			if err != nil {
+				status.Status = HealthFailed
+				status.Error = err.Error()
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			report.Checks[name] = status
+			if err != nil {
+				report.Status = HealthFailed
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// checkStorage checks that the main bucket is reachable.
+func (service *VideoService) checkStorage(ctx context.Context) (map[string]any, error) {
+	details := map[string]any{"bucket": service.MinioEnvs.Bucket}
+
+	exists, err := service.MinioClient.BucketExists(ctx, service.MinioEnvs.Bucket)
+	if err != nil {
+		return details, err
+	}
+	if !exists {
+		return details, fmt.Errorf("bucket %s doesn't exist", service.MinioEnvs.Bucket)
+	}
+	return details, nil
+}
+
+func checkProcess(app string) dependencyCheck {
+	return func(ctx context.Context) (map[string]any, error) {
+		version, err := cmdCommand.Version(ctx, app)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"version": version}, nil
+	}
+}
+
+// checkDisk checks the free space of the directories where videos are buffered.
+func (wr *WebrtcRepository) checkDisk(ctx context.Context) (map[string]any, error) {
+	dirs := []string{os.TempDir()}
+	if wr.envs.DvrWindow > 0 {
+		dirs = append(dirs, wr.envs.DvrDirectory)
+	}
+
+	details := map[string]any{"min_free_bytes": wr.envs.HealthMinFreeBytes}
+	var errs []error
+	for _, dir := range dirs {
+		free, err := freeDiskSpace(existingParent(dir))
+		if errors.Is(err, errDiskUnsupported) {
+			return nil, nil
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dir, err))
+			continue
+		}
+
+		details[dir] = free
+		if free < uint64(wr.envs.HealthMinFreeBytes) {
+			errs = append(errs, fmt.Errorf("%s: %d bytes free", dir, free))
+		}
+	}
+	return details, errors.Join(errs...)
+}
+
+// existingParent returns dir or its closest existing parent, the DVR directory is created on demand.
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// checkListeners checks that a RTSP listener can be opened for a new stream and that the listeners
+// of the running streams accept connections.
+func (service *StreamerService) checkListeners(ctx context.Context) (map[string]any, error) {
+	if _, err := findFreePort(); err != nil {
+		return nil, fmt.Errorf("no port available for new streams: %w", err)
+	}
+
+	service.streamsLock.RLock()
+	urls := make(map[string]string, len(service.streams))
+	for id, stream := range service.streams {
+		urls[id] = stream.RtspUrl
+	}
+	service.streamsLock.RUnlock()
+
+	details := map[string]any{"streams": len(urls)}
+	var errs []error
+	dialer := net.Dialer{Timeout: listenerDialTimeout}
+	for id, rawUrl := range urls {
+		rtspUrl, err := url.Parse(rawUrl)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stream %s: %w", id, err))
+			continue
+		}
+
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort("localhost", rtspUrl.Port()))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stream %s: %w", id, err))
+			continue
+		}
+		conn.Close()
+	}
+	return details, errors.Join(errs...)
+}
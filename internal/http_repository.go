@@ -5,16 +5,23 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"video-handler/configs"
 	"video-handler/external/auth"
+	"video-handler/internal/metrics"
+	"video-handler/internal/tracing"
 
 	chiprometheus "github.com/766b/chi-prometheus"
 	"github.com/bluenviron/gortsplib/v4"
@@ -28,6 +35,7 @@ import (
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type WebrtcRepository struct {
@@ -35,12 +43,17 @@ type WebrtcRepository struct {
 	listLock        sync.RWMutex
 	peerConnections []peerConnectionState
 	trackLocals     map[string]*webrtc.TrackLocalStaticRTP
+	trackOwners     map[string]*auth.Identity
+	trackStreams    map[string]*videoStream
 	streamerService *StreamerService
 	videoService    *VideoService
 	authService     auth.Authentificatior
+	audit           *AuditLog
 	envs            *configs.EnvVariables
 	logger          *slog.Logger
 	ctx             context.Context
+	// set once the service is shutting down, uploads and publishes are refused
+	draining atomic.Bool
 }
 
 func NewWebrtcRepository(
@@ -49,20 +62,21 @@ func NewWebrtcRepository(
 	streamerService *StreamerService,
 	videoService *VideoService,
 	authService auth.Authentificatior,
+	audit *AuditLog,
 	envs *configs.EnvVariables,
 	logger *slog.Logger,
 	ctx context.Context,
 
 ) *WebrtcRepository {
 
-	return &WebrtcRepository{
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool { return true },
-		},
+	wr := &WebrtcRepository{
 		listLock:        sync.RWMutex{},
 		peerConnections: make([]peerConnectionState, 0),
 		trackLocals:     map[string]*webrtc.TrackLocalStaticRTP{},
+		trackOwners:     map[string]*auth.Identity{},
+		trackStreams:    map[string]*videoStream{},
 		authService:     authService,
+		audit:           audit,
 		streamerService: streamerService,
 		videoService:    videoService,
 		envs:            envs,
@@ -70,22 +84,82 @@ func NewWebrtcRepository(
 		logger: logger,
 		ctx:    ctx,
 	}
+	wr.upgrader = websocket.Upgrader{
+		CheckOrigin: wr.checkOrigin,
+	}
+	streamerService.OnStateChange(wr.broadcastStreamState)
+	videoService.OnJobChange(wr.sendJobProgress)
+
+	return wr
 }
 
 func (wr *WebrtcRepository) SetupHandler(r chi.Router) (http.Handler, error) {
 	m := chiprometheus.NewMiddleware("rtsp-streamer")
-	r.Use(m)
-	r.Handle("/metrics", promhttp.Handler())
+	r.Use(m, tracing.Middleware)
 
-	r.Post("/upload", wr.upload)
-	r.Delete("/delete", wr.deleteVideo)
-	r.Get("/video-list", wr.videoList)
-	r.HandleFunc("/websocket", wr.websocketHandler)
+	// scraped by Prometheus, which can't log in
+	r.With(auth.RequireBearer(wr.envs.MetricsBearerToken)).Handle("/metrics", promhttp.Handler())
 
-	if workDir, err := os.Getwd(); err == nil {
-		filesDir := http.Dir(filepath.Join(workDir, "/static"))
-		FileServer(r, "/static", filesDir)
-	}
+	// probed by the orchestrator, which can't log in either
+	r.Get("/healthz", wr.healthz)
+	r.Get("/readyz", wr.readyz)
+
+	r.Group(func(r chi.Router) {
+		r.Use(wr.authService.Require(auth.PublicPolicy), wr.rateLimit)
+
+		// authenticated during the handshake, with the cookies or a session token
+		r.HandleFunc("/websocket", wr.websocketHandler)
+
+		if workDir, err := os.Getwd(); err == nil {
+			filesDir := http.Dir(filepath.Join(workDir, "/static"))
+			FileServer(r, "/static", filesDir)
+		}
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(wr.authService.Require(auth.Policy{Scope: auth.ScopeVideosWrite}), wr.rateLimit)
+
+		r.With(wr.refuseWhenDraining, wr.checkStorageQuota, wr.limitUploadBandwidth).Post("/upload", wr.upload)
+		r.Delete("/delete", wr.deleteVideo)
+		r.Put("/share", wr.shareVideo)
+		r.With(wr.refuseWhenDraining).Post("/transcode", wr.transcodeVideo)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(wr.authService.Require(auth.AuthenticatedPolicy), wr.rateLimit)
+
+		IndexPage(r)
+		r.Get("/video-list", wr.videoList)
+		r.Get("/usage", wr.usage)
+		r.Get("/jobs", wr.jobList)
+		r.Get("/conversion-profiles", wr.conversionProfiles)
+		r.Get("/streams", wr.streamList)
+		r.Get("/websocket/token", wr.websocketToken)
+		r.Post("/playback-tokens", wr.issuePlaybackToken)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(wr.requirePlayback, wr.rateLimit)
+
+		r.Get("/streams/{id}/dvr.m3u8", wr.dvrPlaylist)
+		r.Get("/streams/{id}/dvr/{segment}", wr.dvrSegment)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(wr.authService.Require(wr.publisherPolicy()), wr.rateLimit)
+
+		r.Post("/streams/{id}/record", wr.startRecording)
+		r.Delete("/streams/{id}/record", wr.stopRecording)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(wr.authService.Require(auth.AdminPolicy), wr.rateLimit)
+
+		r.Post("/admin/api-keys", wr.createAPIKey)
+		r.Get("/admin/api-keys", wr.listAPIKeys)
+		r.Delete("/admin/api-keys/{id}", wr.revokeAPIKey)
+		r.Get("/audit", wr.auditEvents)
+	})
 
 	go func() {
 		for range time.NewTicker(time.Second * 3).C {
@@ -93,7 +167,7 @@ func (wr *WebrtcRepository) SetupHandler(r chi.Router) (http.Handler, error) {
 		}
 	}()
 
-	return wr.authService.VerifyCredentials(r), nil
+	return r, nil
 }
 
 func (wr *WebrtcRepository) upload(w http.ResponseWriter, r *http.Request) {
@@ -110,11 +184,15 @@ func (wr *WebrtcRepository) upload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer buffer.Close()
 
-	conversionNeed, err := wr.videoService.processVideoContainer(buffer, handler)
+	identity, _ := auth.IdentityFromContext(r.Context())
+	shared := r.FormValue("shared") == "true"
+
+	conversion, err := wr.videoService.processVideoContainer(r.Context(), identity, buffer, handler, shared, r.FormValue("profile"))
 	if err != nil {
+		wr.audit.Record(r, identity, AuditUpload, handler.Filename, err)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(Response{
-			Status:       http.StatusBadRequest,
+			Status:       errorStatus(err),
 			IsConverting: false,
 			Error:        err.Error(),
 		})
@@ -123,10 +201,12 @@ func (wr *WebrtcRepository) upload(w http.ResponseWriter, r *http.Request) {
 
 	buffer.Seek(0, 0)
 
-	if !conversionNeed {
-		uploadInfo, err := wr.videoService.UploadVideo(buffer, handler.Filename)
+	if conversion == nil {
+		uploadInfo, err := wr.videoService.UploadVideo(r.Context(), identity, buffer, handler.Filename, uploadContentType(handler), shared, nil)
+		wr.audit.Record(r, identity, AuditUpload, handler.Filename, err)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
 		}
 		wr.logger.Info("video doesn't need conversion and was updloaded successfully", "video_name", uploadInfo.Key, "video_size", uploadInfo.Size)
 		w.Header().Set("Content-Type", "application/json")
@@ -138,19 +218,24 @@ func (wr *WebrtcRepository) upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	wr.audit.Record(r, identity, AuditUpload, handler.Filename, nil)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(Response{
 		Status:       http.StatusOK,
 		IsConverting: false,
-		Result:       "vide uploaded successfully",
+		Result:       conversion,
 	})
 }
 
 func (wr *WebrtcRepository) deleteVideo(w http.ResponseWriter, r *http.Request) {
 	videoName := r.URL.Query().Get("video")
-	err := wr.videoService.DeleteVideo(videoName)
+	identity, _ := auth.IdentityFromContext(r.Context())
+
+	err := wr.videoService.DeleteVideo(r.Context(), identity, videoName)
+	wr.audit.Record(r, identity, AuditDelete, videoName, err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
 	}
 
 	json.NewEncoder(w).Encode(Response{
@@ -159,8 +244,46 @@ func (wr *WebrtcRepository) deleteVideo(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+func (wr *WebrtcRepository) shareVideo(w http.ResponseWriter, r *http.Request) {
+	videoName := r.URL.Query().Get("video")
+	shared := r.URL.Query().Get("shared") != "false"
+	identity, _ := auth.IdentityFromContext(r.Context())
+
+	err := wr.videoService.ShareVideo(r.Context(), identity, videoName, shared)
+	wr.audit.Record(r, identity, AuditShare, videoName, err)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: fmt.Sprintf("video sharing updated: %s", videoName),
+	})
+}
+
+func (wr *WebrtcRepository) transcodeVideo(w http.ResponseWriter, r *http.Request) {
+	videoName := r.URL.Query().Get("video")
+	identity, _ := auth.IdentityFromContext(r.Context())
+
+	job, err := wr.videoService.TranscodeVideo(r.Context(), identity, videoName, r.URL.Query().Get("profile"))
+	wr.audit.Record(r, identity, AuditTranscode, videoName, err)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: job,
+	})
+}
+
 func (wr *WebrtcRepository) videoList(w http.ResponseWriter, r *http.Request) {
-	videos, err := wr.videoService.GetVideoList()
+	identity, _ := auth.IdentityFromContext(r.Context())
+
+	videos, err := wr.videoService.GetVideoList(r.Context(), identity)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
@@ -168,15 +291,479 @@ func (wr *WebrtcRepository) videoList(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(videos)
 }
 
+func (wr *WebrtcRepository) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": HealthOK})
+}
+
+func (wr *WebrtcRepository) readyz(w http.ResponseWriter, r *http.Request) {
+	report := wr.readiness(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != HealthOK {
+		wr.logger.WarnContext(r.Context(), "service not ready", "checks", report.Checks)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func (wr *WebrtcRepository) jobList(w http.ResponseWriter, r *http.Request) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+
+	jobs, err := wr.videoService.jobs.list(r.Context(), identity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: jobs,
+	})
+}
+
+func (wr *WebrtcRepository) conversionProfiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: wr.videoService.ConversionProfiles(),
+	})
+}
+
+func (wr *WebrtcRepository) streamList(w http.ResponseWriter, r *http.Request) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wr.streamerService.listStreams(r.Context(), identity))
+}
+
+func (wr *WebrtcRepository) startRecording(w http.ResponseWriter, r *http.Request) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+
+	recording, err := wr.streamerService.startRecording(identity, chi.URLParam(r, "id"))
+	wr.audit.Record(r, identity, AuditRecord, "stream:"+chi.URLParam(r, "id"), err)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: recording,
+	})
+}
+
+func (wr *WebrtcRepository) stopRecording(w http.ResponseWriter, r *http.Request) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+
+	uploadInfo, err := wr.streamerService.stopRecording(identity, chi.URLParam(r, "id"))
+	wr.audit.Record(r, identity, AuditRecord, "stream:"+chi.URLParam(r, "id"), err)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	wr.logger.Info("recording uploaded successfully", "video_name", uploadInfo.Key, "video_size", uploadInfo.Size)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: uploadInfo,
+	})
+}
+
+func (wr *WebrtcRepository) dvrPlaylist(w http.ResponseWriter, r *http.Request) {
+	dvr, err := wr.streamerService.getDvr(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// players don't keep the query of the playlist, hand the playback token down to the segments
+	var query string
+	if token := r.URL.Query().Get("token"); token != "" {
+		query = "?token=" + url.QueryEscape(token)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(dvr.playlist("dvr/", query)))
+}
+
+func (wr *WebrtcRepository) dvrSegment(w http.ResponseWriter, r *http.Request) {
+	dvr, err := wr.streamerService.getDvr(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	segmentPath, err := dvr.segmentPath(chi.URLParam(r, "segment"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeFile(w, r, segmentPath)
+}
+
+// issuePlaybackToken signs a token giving access to a stream (stream=) or the streams of a video (video=),
+// for ttl= at most and optionally from a single ip=.
+func (wr *WebrtcRepository) issuePlaybackToken(w http.ResponseWriter, r *http.Request) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+	query := r.URL.Query()
+
+	grant := &auth.PlaybackGrant{
+		StreamID: query.Get("stream"),
+		Video:    query.Get("video"),
+		IP:       query.Get("ip"),
+		Issuer:   identity,
+	}
+
+	if (grant.StreamID == "") == (grant.Video == "") {
+		http.Error(w, "either stream or video is required", http.StatusBadRequest)
+		return
+	}
+	if grant.IP != "" && net.ParseIP(grant.IP) == nil {
+		http.Error(w, "invalid ip: "+grant.IP, http.StatusBadRequest)
+		return
+	}
+
+	var ttl time.Duration
+	if rawTTL := query.Get("ttl"); rawTTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(rawTTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if grant.StreamID != "" {
+		stream, err := wr.streamerService.getStream(grant.StreamID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := wr.videoService.CanReadStream(r.Context(), identity, stream); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	} else if err := wr.videoService.CanReadVideo(r.Context(), identity, grant.Video); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	token, expiresAt, err := wr.authService.IssuePlaybackToken(grant, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: PlaybackTokenInfo{
+			Token:     token,
+			ExpiresAt: expiresAt,
+		},
+	})
+}
+
+// requirePlayback accepts a playback token of the stream in the token query parameter,
+// or falls back to the session authentication of a user who may watch the stream.
+func (wr *WebrtcRepository) requirePlayback(next http.Handler) http.Handler {
+	authenticated := wr.authService.Require(auth.AuthenticatedPolicy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := auth.IdentityFromContext(r.Context())
+
+		stream, err := wr.streamerService.getStream(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := wr.videoService.CanReadStream(r.Context(), identity, stream); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			authenticated.ServeHTTP(w, r)
+			return
+		}
+
+		grant, err := wr.authService.VerifyPlaybackToken(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		stream, err := wr.streamerService.getStream(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err := checkPlaybackGrant(r.Context(), wr.videoService, grant, stream, remoteIP(r.RemoteAddr)); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// publisherPolicy restricts starting streams and recordings to PublisherRoles, or to keys with the streams:publish scope.
+func (wr *WebrtcRepository) publisherPolicy() auth.Policy {
+	return auth.Policy{
+		Roles: wr.envs.PublisherRoles,
+		Scope: auth.ScopeStreamsPublish,
+	}
+}
+
+func (wr *WebrtcRepository) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+
+	var request apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if request.Tenant == "" {
+		request.Tenant = identity.Tenant
+	}
+
+	key, secret, err := wr.authService.CreateAPIKey(r.Context(), identity, request.Name, request.Tenant, request.Scopes)
+	wr.audit.Record(r, identity, AuditAdmin, "api-key:create:"+request.Name, err)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	wr.logger.Info("api key created", "key_id", key.ID, "name", key.Name, "scopes", key.Scopes, "user_id", identity.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: createdAPIKey{
+			APIKey: key,
+			Secret: secret,
+		},
+	})
+}
+
+func (wr *WebrtcRepository) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := wr.authService.ListAPIKeys(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: keys,
+	})
+}
+
+func (wr *WebrtcRepository) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+	keyID := chi.URLParam(r, "id")
+
+	err := wr.authService.RevokeAPIKey(r.Context(), keyID)
+	wr.audit.Record(r, identity, AuditAdmin, "api-key:revoke:"+keyID, err)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	wr.logger.Info("api key revoked", "key_id", keyID, "user_id", identity.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: fmt.Sprintf("api key revoked: %s", keyID),
+	})
+}
+
+// auditEvents lists the audit events filtered by user=, action= and since= (RFC 3339 time or duration ago,
+// the last 24 hours by default), as JSON or as JSON lines with format=jsonl.
+func (wr *WebrtcRepository) auditEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := AuditFilter{
+		UserID: query.Get("user"),
+		Action: query.Get("action"),
+		Since:  time.Now().Add(-24 * time.Hour),
+		Limit:  auditMaxLimit,
+	}
+
+	if since := query.Get("since"); since != "" {
+		if t, err := time.Parse(time.RFC3339, since); err == nil {
+			filter.Since = t
+		} else if d, err := time.ParseDuration(since); err == nil {
+			filter.Since = time.Now().Add(-d)
+		} else {
+			http.Error(w, "invalid since: "+since, http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+
+	events, err := wr.audit.Query(r.Context(), filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if query.Get("format") == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		encoder := json.NewEncoder(w)
+		for _, event := range events {
+			encoder.Encode(event)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: events,
+	})
+}
+
+// refuseWhenDraining refuses new work once the service is shutting down.
+func (wr *WebrtcRepository) refuseWhenDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wr.draining.Load() {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimit limits the requests of the user, or of the client IP on public routes.
+func (wr *WebrtcRepository) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := auth.IdentityFromContext(r.Context())
+
+		if err := wr.videoService.limits.allowRequest(limitKey(identity, remoteIP(r.RemoteAddr).String())); err != nil {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkStorageQuota refuses uploads exceeding the storage quotas before reading the body,
+// and cuts bodies of unknown length at the remaining quota.
+func (wr *WebrtcRepository) checkStorageQuota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := auth.IdentityFromContext(r.Context())
+
+		if err := wr.videoService.checkQuota(r.Context(), identity, r.ContentLength); err != nil {
+			wr.audit.Record(r, identity, AuditUpload, "", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		if r.ContentLength < 0 {
+			remaining, err := wr.videoService.remainingQuota(r.Context(), identity)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if remaining >= 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, remaining+multipartOverhead)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (wr *WebrtcRepository) usage(w http.ResponseWriter, r *http.Request) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+
+	report, err := wr.videoService.GetUsage(r.Context(), identity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: report,
+	})
+}
+
+// limitUploadBandwidth throttles the request body to the upload bandwidth of the user.
+func (wr *WebrtcRepository) limitUploadBandwidth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := auth.IdentityFromContext(r.Context())
+
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{
+			Reader: wr.videoService.limits.uploadReader(r.Context(), limitKey(identity, remoteIP(r.RemoteAddr).String()), r.Body),
+			Closer: r.Body,
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrStorageQuotaExceeded):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrVideoNotFound), errors.Is(err, ErrCatalogNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrShuttingDown):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrRenditionConflict):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
 // Add to list of tracks and fire renegotation for all PeerConnections
-func (wr *WebrtcRepository) addTrack(t *webrtc.TrackLocalStaticRTP) error {
+func (wr *WebrtcRepository) addTrack(tracks ...*webrtc.TrackLocalStaticRTP) error {
 	wr.listLock.Lock()
 	defer func() {
 		wr.listLock.Unlock()
 		wr.signalPeerConnections()
 	}()
 
-	wr.trackLocals[t.ID()] = t
+	for _, t := range tracks {
+		wr.trackLocals[t.ID()] = t
+	}
 	return nil
 }
 
@@ -188,11 +775,64 @@ func (wr *WebrtcRepository) removeTrack(trackID string) {
 		wr.signalPeerConnections()
 	}()
 
-	delete(wr.trackLocals, trackID)
+	// the audio track of a stream goes away with its video track
+	for id, t := range wr.trackLocals {
+		if id == trackID || t.StreamID() == trackID {
+			delete(wr.trackLocals, id)
+			delete(wr.trackOwners, id)
+			delete(wr.trackStreams, id)
+		}
+	}
 }
 
-// signalPeerConnections updates each PeerConnection so that it is getting all the expected media tracks
+// readableTracks returns the tracks every PeerConnection may receive: the ones of the streams its
+// identity may watch. The access is checked outside of listLock, once per identity and stream.
+func (wr *WebrtcRepository) readableTracks() map[*webrtc.PeerConnection]map[string]bool {
+	wr.listLock.RLock()
+	peers := append([]peerConnectionState(nil), wr.peerConnections...)
+	trackStreams := make(map[string]*videoStream, len(wr.trackStreams))
+	for trackID, stream := range wr.trackStreams {
+		trackStreams[trackID] = stream
+	}
+	wr.listLock.RUnlock()
+
+	type access struct {
+		userID   string
+		streamID string
+	}
+	allowed := map[access]bool{}
+
+	readable := make(map[*webrtc.PeerConnection]map[string]bool, len(peers))
+	for _, peer := range peers {
+		readable[peer.peerConnection] = map[string]bool{}
+		if peer.identity == nil && peer.grant == nil {
+			continue
+		}
+
+		for trackID, stream := range trackStreams {
+			// the viewers of a playback token are checked one by one, their grants differ
+			if peer.grant != nil {
+				readable[peer.peerConnection][trackID] = peer.canWatch(wr.ctx, wr.videoService, stream) == nil
+				continue
+			}
+
+			key := access{peer.identity.UserID, stream.ID}
+			ok, checked := allowed[key]
+			if !checked {
+				ok = peer.canWatch(wr.ctx, wr.videoService, stream) == nil
+				allowed[key] = ok
+			}
+			readable[peer.peerConnection][trackID] = ok
+		}
+	}
+	return readable
+}
+
+// signalPeerConnections updates each PeerConnection so that it is getting the media tracks of the
+// streams its identity may watch
 func (wr *WebrtcRepository) signalPeerConnections() {
+	readable := wr.readableTracks()
+
 	wr.listLock.Lock()
 	defer func() {
 		wr.listLock.Unlock()
@@ -216,8 +856,9 @@ func (wr *WebrtcRepository) signalPeerConnections() {
 
 				existingSenders[sender.Track().ID()] = true
 
-				// If we have a RTPSender that doesn't map to a existing track remove and signal
-				if _, ok := wr.trackLocals[sender.Track().ID()]; !ok {
+				// If we have a RTPSender that doesn't map to a existing track, or to one the peer may not watch anymore, remove and signal
+				allowed, checked := readable[wr.peerConnections[i].peerConnection][sender.Track().ID()]
+				if _, ok := wr.trackLocals[sender.Track().ID()]; !ok || (checked && !allowed) {
 					if err := wr.peerConnections[i].peerConnection.RemoveTrack(sender); err != nil {
 						return true
 					}
@@ -233,9 +874,9 @@ func (wr *WebrtcRepository) signalPeerConnections() {
 				existingSenders[receiver.Track().ID()] = true
 			}
 
-			// Add all track we aren't sending yet to the PeerConnection
+			// Add all track we aren't sending yet, of the streams the peer may watch, to the PeerConnection
 			for trackID := range wr.trackLocals {
-				if _, ok := existingSenders[trackID]; !ok {
+				if _, ok := existingSenders[trackID]; !ok && readable[wr.peerConnections[i].peerConnection][trackID] {
 
 					if _, err := wr.peerConnections[i].peerConnection.AddTransceiverFromTrack(wr.trackLocals[trackID], webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
 						return true
@@ -304,8 +945,234 @@ func (wr *WebrtcRepository) dispatchKeyFrame() {
 	}
 }
 
+// websocketToken issues a short-lived token to open the websocket with ?token= where cookies can't be sent.
+func (wr *WebrtcRepository) websocketToken(w http.ResponseWriter, r *http.Request) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+
+	token, err := wr.authService.IssueSessionToken(identity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Status: http.StatusOK,
+		Result: token,
+	})
+}
+
+// checkOrigin accepts the configured origins, or the origins of the same host when none are configured.
+func (wr *WebrtcRepository) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if len(wr.envs.WebSocketAllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, allowed := range wr.envs.WebSocketAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	wr.logger.Warn("websocket origin rejected", "origin", origin)
+	return false
+}
+
+// authenticateWebsocket resolves the user of the handshake from a session token or the cookies. A playback
+// token in ?token= is accepted too, its viewer only receives the tracks of the granted streams.
+func (wr *WebrtcRepository) authenticateWebsocket(w http.ResponseWriter, r *http.Request) (*auth.Identity, *auth.PlaybackGrant, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		identity, err := wr.authService.Authenticate(w, r)
+		return identity, nil, err
+	}
+
+	if grant, err := wr.authService.VerifyPlaybackToken(token); err == nil {
+		return nil, grant, wr.checkPlaybackHandshake(r, grant)
+	}
+	identity, err := wr.authService.VerifySessionToken(r.Context(), token)
+	return identity, nil, err
+}
+
+// checkPlaybackHandshake refuses a playback token used from another ip, or whose stream can't be watched.
+func (wr *WebrtcRepository) checkPlaybackHandshake(r *http.Request, grant *auth.PlaybackGrant) error {
+	ip := remoteIP(r.RemoteAddr)
+	if !grant.AllowsIP(ip) {
+		return ErrForbidden
+	}
+	if grant.StreamID == "" {
+		return wr.videoService.CanReadVideo(r.Context(), grant.Issuer, grant.Video)
+	}
+
+	stream, err := wr.streamerService.getStream(grant.StreamID)
+	if err != nil {
+		return err
+	}
+	return checkPlaybackGrant(r.Context(), wr.videoService, grant, stream, ip)
+}
+
+// authorizePublish checks that identity may start a stream of the video.
+func (wr *WebrtcRepository) authorizePublish(ctx context.Context, identity *auth.Identity, videoName string) error {
+	if !wr.publisherPolicy().Allows(identity) {
+		return ErrForbidden
+	}
+	return wr.videoService.CanReadVideo(ctx, identity, videoName)
+}
+
+// authorizeRemove checks that identity published the track or is an admin.
+func (wr *WebrtcRepository) authorizeRemove(identity *auth.Identity, trackID string) error {
+	wr.listLock.RLock()
+	owner, ok := wr.trackOwners[trackID]
+	wr.listLock.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("track %s not found", trackID)
+	}
+	if isAdmin(identity) || (owner != nil && owner.UserID == identity.UserID) {
+		return nil
+	}
+	return ErrForbidden
+}
+
+// acceptWebsocketWork refuses publishes and seeks over the rate limit or during the shutdown.
+func (wr *WebrtcRepository) acceptWebsocketWork(identity *auth.Identity) error {
+	if wr.draining.Load() {
+		return ErrShuttingDown
+	}
+	return wr.videoService.limits.allowRequest(limitKey(identity, ""))
+}
+
+// broadcastStreamState tells the websocket clients who may watch a stream that its pusher started,
+// restarts or stopped.
+func (wr *WebrtcRepository) broadcastStreamState(stream *videoStream) {
+	info := wr.streamerService.streamInfo(stream)
+	data, err := json.Marshal(info)
+	if err != nil {
+		wr.logger.Error("", "err", err.Error())
+		return
+	}
+
+	// the access is checked outside the lock, it may ask the bucket
+	wr.listLock.RLock()
+	peers := append([]peerConnectionState(nil), wr.peerConnections...)
+	wr.listLock.RUnlock()
+
+	for _, state := range peers {
+		if state.canWatch(wr.videoService.Context, wr.videoService, stream) != nil {
+			continue
+		}
+		if err := state.websocket.WriteJSON(&websocketMessage{
+			Event: "stream-state",
+			Data:  string(data),
+		}); err != nil {
+			wr.logger.Error("failed to send stream state", "stream_id", info.ID, "err", err.Error())
+		}
+	}
+}
+
+// sendJobProgress sends the progress of a job to the websockets of its user.
+func (wr *WebrtcRepository) sendJobProgress(job Job) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		wr.logger.Error("", "err", err.Error())
+		return
+	}
+
+	wr.listLock.RLock()
+	defer wr.listLock.RUnlock()
+
+	for _, state := range wr.peerConnections {
+		if job.UserID != "" && (state.identity == nil || state.identity.UserID != job.UserID) {
+			continue
+		}
+		if err := state.websocket.WriteJSON(&websocketMessage{
+			Event: "conversion-progress",
+			Data:  string(data),
+		}); err != nil {
+			wr.logger.Error("failed to send conversion progress", "job_id", job.ID, "err", err.Error())
+		}
+	}
+}
+
+// StopAccepting refuses new uploads, websockets and publishes, and tells the connected
+// websocket clients that the service is shutting down.
+func (wr *WebrtcRepository) StopAccepting() {
+	if wr.draining.Swap(true) {
+		return
+	}
+
+	wr.listLock.RLock()
+	defer wr.listLock.RUnlock()
+
+	for _, state := range wr.peerConnections {
+		if err := state.websocket.WriteJSON(&websocketMessage{
+			Event: "shutdown",
+			Data:  ErrShuttingDown.Error(),
+		}); err != nil {
+			wr.logger.Error("failed to send shutdown event", "err", err.Error())
+		}
+	}
+}
+
+// Shutdown waits for the running conversions until ctx ends, then closes the streams,
+// the peer connections and the websockets.
+func (wr *WebrtcRepository) Shutdown(ctx context.Context) error {
+	wr.StopAccepting()
+
+	err := wr.videoService.DrainJobs(ctx)
+	if err != nil {
+		wr.logger.Error("conversions didn't finish before the shutdown deadline", "err", err.Error())
+	}
+
+	wr.streamerService.Close()
+
+	wr.listLock.RLock()
+	peerConnections := append([]peerConnectionState(nil), wr.peerConnections...)
+	wr.listLock.RUnlock()
+
+	for _, state := range peerConnections {
+		if closeErr := state.peerConnection.Close(); closeErr != nil {
+			wr.logger.Error("failed to close peer connection", "err", closeErr.Error())
+		}
+		state.websocket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ErrShuttingDown.Error()), time.Now().Add(time.Second))
+		state.websocket.Close()
+	}
+
+	return err
+}
+
+func (wr *WebrtcRepository) sendError(c *threadSafeWriter, err error) {
+	if writeErr := c.WriteJSON(&websocketMessage{
+		Event: "error",
+		Data:  err.Error(),
+	}); writeErr != nil {
+		wr.logger.Error("failed to send error event", "err", writeErr.Error())
+	}
+}
+
 // Handle incoming websockets
 func (wr *WebrtcRepository) websocketHandler(w http.ResponseWriter, r *http.Request) {
+	identity, grant, err := wr.authenticateWebsocket(w, r)
+	if err != nil {
+		if !errors.Is(err, auth.ErrNoCredentials) {
+			wr.audit.Record(r, nil, AuditLoginFailure, r.URL.Path, err)
+		}
+		wr.logger.Info("websocket handshake is not authenticated", "err", err.Error())
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	if wr.draining.Load() {
+		http.Error(w, ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	// Upgrade HTTP request to Websocket
 	unsafeConn, err := wr.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -328,9 +1195,15 @@ func (wr *WebrtcRepository) websocketHandler(w http.ResponseWriter, r *http.Requ
 	// When this frame returns close the PeerConnection
 	defer peerConnection.Close() //nolint
 
+	// the gauge follows the connection state, closed connections leave it. pion runs each callback
+	// in its own goroutine
+	peerState := webrtc.PeerConnectionStateNew
+	var peerStateLock sync.Mutex
+	metrics.PeerConnections.WithLabelValues(peerState.String()).Inc()
+
 	// Add our new PeerConnection to global list
 	wr.listLock.Lock()
-	wr.peerConnections = append(wr.peerConnections, peerConnectionState{peerConnection, c})
+	wr.peerConnections = append(wr.peerConnections, peerConnectionState{peerConnection, c, identity, grant, remoteIP(r.RemoteAddr)})
 	wr.listLock.Unlock()
 
 	// Trickle ICE. Emit server candidate to client
@@ -355,6 +1228,14 @@ func (wr *WebrtcRepository) websocketHandler(w http.ResponseWriter, r *http.Requ
 
 	// If PeerConnection is closed remove it from global list
 	peerConnection.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
+		peerStateLock.Lock()
+		metrics.PeerConnections.WithLabelValues(peerState.String()).Dec()
+		if p != webrtc.PeerConnectionStateClosed {
+			metrics.PeerConnections.WithLabelValues(p.String()).Inc()
+		}
+		peerState = p
+		peerStateLock.Unlock()
+
 		switch p {
 		case webrtc.PeerConnectionStateFailed:
 			if err := peerConnection.Close(); err != nil {
@@ -397,6 +1278,12 @@ func (wr *WebrtcRepository) websocketHandler(w http.ResponseWriter, r *http.Requ
 			return
 		}
 
+		// the viewers of a playback token only watch
+		if identity == nil && (message.Event == "publish" || message.Event == "seek" || message.Event == "remove") {
+			wr.sendError(c, ErrForbidden)
+			continue
+		}
+
 		switch message.Event {
 		case "candidate":
 			candidate := webrtc.ICECandidateInit{}
@@ -416,28 +1303,125 @@ func (wr *WebrtcRepository) websocketHandler(w http.ResponseWriter, r *http.Requ
 				return
 			}
 
-			if err := peerConnection.SetRemoteDescription(answer); err != nil {
+			// the offers are made under the lock, pion doesn't guard the descriptions between them
+			wr.listLock.Lock()
+			err := peerConnection.SetRemoteDescription(answer)
+			wr.listLock.Unlock()
+			if err != nil {
 				wr.logger.Error("", "err", err.Error())
 				return
 			}
 		case "publish":
 			videoName := strings.Replace(message.Data, "\"", "", -1)
-			wr.logger.Debug("video name received", "data", videoName)
+			ctx, span := tracing.Start(r.Context(), "websocket publish",
+				attribute.String("video.name", videoName),
+				attribute.String("user.id", identity.UserID),
+			)
+			wr.logger.DebugContext(ctx, "video name received", "data", videoName, "user_id", identity.UserID)
+
+			if err := wr.acceptWebsocketWork(identity); err != nil {
+				tracing.End(span, err)
+				wr.sendError(c, err)
+				continue
+			}
+
+			if err := wr.authorizePublish(ctx, identity, videoName); err != nil {
+				wr.logger.InfoContext(ctx, "publish rejected", "video_name", videoName, "user_id", identity.UserID, "err", err.Error())
+				wr.audit.Record(r, identity, AuditPublish, videoName, err)
+				tracing.End(span, err)
+				wr.sendError(c, err)
+				continue
+			}
 
-			rtspUrl, err := wr.streamerService.createVideoStream(videoName)
+			stream, err := wr.streamerService.createVideoStream(ctx, identity, videoName)
+			wr.audit.Record(r, identity, AuditPublish, videoName, err)
+			if err != nil {
+				wr.logger.ErrorContext(ctx, "failed to create video stream", "video_name", videoName, "err", err.Error())
+				tracing.End(span, err)
+				wr.sendError(c, err)
+				continue
+			}
+			span.SetAttributes(attribute.String("stream.id", stream.ID))
+
+			time.Sleep(1 * time.Second)
+
+			err = wr.publishNewStream(stream, identity)
+			if err != nil {
+				wr.logger.ErrorContext(ctx, "failed to publish video-stream", "err", err.Error())
+				tracing.End(span, err)
+				return
+			}
+
+			streamInfo, err := json.Marshal(wr.streamerService.streamInfo(stream))
+			if err != nil {
+				wr.logger.ErrorContext(ctx, "", "err", err.Error())
+				tracing.End(span, err)
+				return
+			}
+
+			err = c.WriteJSON(&websocketMessage{
+				Event: "stream",
+				Data:  string(streamInfo),
+			})
 			if err != nil {
+				wr.logger.ErrorContext(ctx, "", "err", err.Error())
+			}
+			tracing.End(span, err)
+		case "seek":
+			seek := seekRequest{}
+			if err := json.Unmarshal([]byte(message.Data), &seek); err != nil {
 				wr.logger.Error("", "err", err.Error())
 				return
 			}
 
+			if err := wr.acceptWebsocketWork(identity); err != nil {
+				wr.sendError(c, err)
+				continue
+			}
+
+			if !wr.publisherPolicy().Allows(identity) {
+				wr.audit.Record(r, identity, AuditPublish, "stream:"+seek.StreamID, ErrForbidden)
+				wr.sendError(c, ErrForbidden)
+				continue
+			}
+
+			stream, err := wr.streamerService.createTimeShiftStream(r.Context(), identity, seek.StreamID, time.Duration(seek.Offset*float64(time.Second)))
+			wr.audit.Record(r, identity, AuditPublish, "stream:"+seek.StreamID, err)
+			if err != nil {
+				wr.logger.Error("failed to create time-shift stream", "stream_id", seek.StreamID, "err", err.Error())
+				wr.sendError(c, err)
+				continue
+			}
+
 			time.Sleep(1 * time.Second)
 
-			err = wr.publishNewStream(rtspUrl)
+			err = wr.publishNewStream(stream, identity)
+			if err != nil {
+				wr.logger.Error("failed to publish time-shift stream", "err", err.Error())
+				return
+			}
+
+			streamInfo, err := json.Marshal(wr.streamerService.streamInfo(stream))
 			if err != nil {
-				wr.logger.Error("failed to publish video-stream", "err", err.Error())
+				wr.logger.Error("", "err", err.Error())
 				return
 			}
+
+			if err := c.WriteJSON(&websocketMessage{
+				Event: "stream",
+				Data:  string(streamInfo),
+			}); err != nil {
+				wr.logger.Error("", "err", err.Error())
+			}
 		case "remove":
+			err := wr.authorizeRemove(identity, message.Data)
+			wr.audit.Record(r, identity, AuditRemove, "track:"+message.Data, err)
+			if err != nil {
+				wr.logger.Info("remove rejected", "track_id", message.Data, "user_id", identity.UserID, "err", err.Error())
+				wr.sendError(c, err)
+				continue
+			}
+
 			wr.removeTrack(message.Data)
 		}
 	}
@@ -456,14 +1440,26 @@ func (t *threadSafeWriter) WriteJSON(v interface{}) error {
 	return t.Conn.WriteJSON(v)
 }
 
-func (wr *WebrtcRepository) publishNewStream(rtspUrl string) error {
+func (wr *WebrtcRepository) publishNewStream(stream *videoStream, owner *auth.Identity) error {
 	trackUUID := uuid.New().String()
 	rtpTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, trackUUID, trackUUID)
 	if err != nil {
 		return err
 	}
+	// the audio track shares the media stream of the video track, so that the players play both
+	audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, uuid.New().String(), trackUUID)
+	if err != nil {
+		return err
+	}
 
-	err = wr.addTrack(rtpTrack)
+	wr.listLock.Lock()
+	wr.trackOwners[rtpTrack.ID()] = owner
+	wr.trackOwners[audioTrack.ID()] = owner
+	wr.trackStreams[rtpTrack.ID()] = stream
+	wr.trackStreams[audioTrack.ID()] = stream
+	wr.listLock.Unlock()
+
+	err = wr.addTrack(rtpTrack, audioTrack)
 	if err != nil {
 		return err
 	}
@@ -471,66 +1467,101 @@ func (wr *WebrtcRepository) publishNewStream(rtspUrl string) error {
 	time.Sleep(100 * time.Millisecond)
 
 	go func() {
-		err := wr.rtspConsumer(rtpTrack, rtspUrl)
-		if err != nil {
-			wr.logger.Error(err.Error())
-			return
+		// the consumer reconnects while the pusher restarts, the track goes away with the stream
+		defer wr.removeTrack(rtpTrack.ID())
+
+		for {
+			err := wr.rtspConsumer(rtpTrack, audioTrack, stream.readUrl())
+			if err != nil {
+				wr.logger.Error("RTSP consumer stopped", "stream_id", stream.ID, "err", err.Error())
+			}
+			if stream.finished() {
+				return
+			}
+
+			select {
+			case <-time.After(consumerRetryDelay):
+			case <-wr.ctx.Done():
+				return
+			}
 		}
 	}()
 	return nil
 }
 
-func (wr *WebrtcRepository) rtspConsumer(track *webrtc.TrackLocalStaticRTP, rtspUrl string) error {
-	c := gortsplib.Client{}
+// rtspConsumer forwards the H264 packets of the RTSP stream to videoTrack and its Opus packets to audioTrack.
+func (wr *WebrtcRepository) rtspConsumer(videoTrack, audioTrack *webrtc.TrackLocalStaticRTP, rtspUrl string) error {
+	c := gortsplib.Client{
+		TLSConfig: wr.streamerService.rtspTLS.clientConfig(),
+	}
 
 	// parse URL
 	u, err := base.ParseURL(rtspUrl)
 	if err != nil {
-		wr.logger.Error("failed to parse url", "RTSP_URL", rtspUrl, "err", err.Error())
-		panic(err)
+		return fmt.Errorf("failed to parse RTSP url %s: %w", redactUrl(rtspUrl), err)
 	}
 
 	// connect to the server
 	err = c.Start(u.Scheme, u.Host)
 	if err != nil {
-		wr.logger.Error(err.Error())
-		panic(err)
+		return err
 	}
 	defer c.Close()
 
-	// find available medias
+	// find available medias, not found while the pusher restarts
 	desc, _, err := c.Describe(u)
 	if err != nil {
-		wr.logger.Error("failed to describe url", "RTSP_URL", rtspUrl, "err", err.Error())
-		panic(err)
+		return fmt.Errorf("failed to describe RTSP url %s: %w", redactUrl(rtspUrl), err)
 	}
 
 	// setup all medias
 	err = c.SetupAll(desc.BaseURL, desc.Medias)
 	if err != nil {
-		wr.logger.Error(err.Error())
-		panic(err)
+		return err
+	}
+
+	type trackPacket struct {
+		track *webrtc.TrackLocalStaticRTP
+		pkt   *rtp.Packet
 	}
 
-	packetChan := make(chan *rtp.Packet, 100)
+	packetChan := make(chan trackPacket, 100)
 	// called when an RTP packet arrives
 	c.OnPacketRTPAny(func(medi *description.Media, forma format.Format, pkt *rtp.Packet) {
+		var track *webrtc.TrackLocalStaticRTP
+		switch forma.(type) {
+		case *format.H264:
+			track = videoTrack
+		case *format.Opus:
+			track = audioTrack
+		default:
+			// WebRTC can't play the other codecs
+			return
+		}
+
 		select {
-		case packetChan <- pkt:
+		case packetChan <- trackPacket{track, pkt}:
 			//success
 		default:
+			metrics.PacketsDropped.WithLabelValues(metrics.PathWebrtc).Inc()
 			log.Println("Packet dropped due to full buffer")
 		}
 	})
 
 	go func() {
-		defer close(packetChan)
-		for pkt := range packetChan {
-			if err := track.WriteRTP(pkt); err != nil {
+		for packet := range packetChan {
+			if err := packet.track.WriteRTP(packet.pkt); err != nil {
 				log.Printf("Error writing RTP packet: %v", err)
+				continue
 			}
+			metrics.PacketsForwarded.WithLabelValues(metrics.PathWebrtc).Inc()
 		}
 	}()
+	// no packet arrives once the client is closed
+	defer func() {
+		c.Close()
+		close(packetChan)
+	}()
 
 	// start playing
 	_, err = c.Play(nil)
@@ -541,17 +1572,22 @@ func (wr *WebrtcRepository) rtspConsumer(track *webrtc.TrackLocalStaticRTP, rtsp
 	log.Println("RTSP stream started successfully")
 
 	// Monitor context cancellation
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		<-wr.ctx.Done()
-		log.Println("RTSP consumer shutting down")
-		c.Close()
+		select {
+		case <-wr.ctx.Done():
+			log.Println("RTSP consumer shutting down")
+			c.Close()
+		case <-done:
+		}
 	}()
 
 	// Wait until a fatal error or context cancellation
-	if err = c.Wait(); err != nil && !errors.Is(err, context.Canceled) {
-		wr.logger.Error("RTSP stream encountered an error", "err", err)
+	if err = c.Wait(); err != nil && !errors.Is(err, context.Canceled) && wr.ctx.Err() == nil {
+		return fmt.Errorf("RTSP stream encountered an error: %w", err)
 	}
 
-	wr.logger.Info("consumer started successfully")
+	wr.logger.Info("RTSP consumer stopped")
 	return nil
 }
@@ -27,13 +27,6 @@ func FileServer(r chi.Router, path string, root http.FileSystem) {
 		fs := http.StripPrefix(pathPrefix, http.FileServer(root))
 		fs.ServeHTTP(w, r)
 	})
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		indexHTML, err := os.ReadFile("./static/index.html")
-		if err != nil {
-			w.Write([]byte(err.Error()))
-		}
-		w.Write(indexHTML)
-	})
 	r.Get("/static/script.js", func(w http.ResponseWriter, r *http.Request) {
 		scriptJS, err := os.ReadFile("./static/script.js")
 		if err != nil {
@@ -46,3 +39,13 @@ func FileServer(r chi.Router, path string, root http.FileSystem) {
 		}
 	})
 }
+
+func IndexPage(r chi.Router) {
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		indexHTML, err := os.ReadFile("./static/index.html")
+		if err != nil {
+			w.Write([]byte(err.Error()))
+		}
+		w.Write(indexHTML)
+	})
+}
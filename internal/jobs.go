@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+	"video-handler/external/auth"
+
+	cmdCommand "video-handler/pkg"
+
+	"github.com/google/uuid"
+)
+
+const (
+	JobConversion string = "conversion"
+
+	JobRunning   string = "running"
+	JobSucceeded string = "succeeded"
+	JobFailed    string = "failed"
+
+	jobsCatalog string = "jobs/"
+)
+
+var (
+	ErrShuttingDown = errors.New("service is shutting down")
+)
+
+// Job is a background task started by a user, like the conversion of an upload.
+type Job struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	UserID     string     `json:"user_id,omitempty"`
+	Tenant     string     `json:"tenant,omitempty"`
+	Video      string     `json:"video"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Progress is the last progress report of the ffmpeg process of the job
+	Progress *JobProgress `json:"progress,omitempty"`
+}
+
+// JobProgress is a progress report of a conversion, Percent is left out when the duration
+// of the video is unknown.
+type JobProgress struct {
+	Percent float64 `json:"percent,omitempty"`
+	Frame   int64   `json:"frame"`
+	Fps     float64 `json:"fps"`
+	Bitrate string  `json:"bitrate,omitempty"`
+	OutTime float64 `json:"out_time"`
+	Speed   float64 `json:"speed"`
+}
+
+func newJobProgress(progress cmdCommand.Progress, duration time.Duration) JobProgress {
+	jobProgress := JobProgress{
+		Frame:   progress.Frame,
+		Fps:     progress.Fps,
+		Bitrate: progress.Bitrate,
+		OutTime: progress.OutTime.Seconds(),
+		Speed:   progress.Speed,
+	}
+	if duration > 0 {
+		jobProgress.Percent = min(100, math.Round(float64(progress.OutTime)/float64(duration)*1000)/10)
+	}
+	return jobProgress
+}
+
+// jobRegistry tracks the running jobs so that a shutdown can wait for them, and keeps them
+// in the catalog under jobs/.
+type jobRegistry struct {
+	catalog *Catalog
+	logger  *slog.Logger
+
+	// ctx of the jobs, cancelled when a shutdown stops waiting for them
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex       sync.Mutex
+	running     map[string]*Job
+	interrupted map[string]bool
+	draining    bool
+	wg          sync.WaitGroup
+
+	// onChange receives the jobs on every progress report and when they finish
+	onChange func(job Job)
+}
+
+func newJobRegistry(catalog *Catalog, logger *slog.Logger) *jobRegistry {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobRegistry{
+		catalog:     catalog,
+		logger:      logger,
+		ctx:         ctx,
+		cancel:      cancel,
+		running:     map[string]*Job{},
+		interrupted: map[string]bool{},
+	}
+}
+
+// start registers a job of identity, it runs with the returned context and must be finished.
+func (jr *jobRegistry) start(kind string, identity *auth.Identity, video string) (*Job, context.Context, error) {
+	job := &Job{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		Video:     video,
+		Status:    JobRunning,
+		StartedAt: time.Now(),
+	}
+	if identity != nil {
+		job.UserID = identity.UserID
+		job.Tenant = identity.Tenant
+	}
+
+	jr.mutex.Lock()
+	if jr.draining {
+		jr.mutex.Unlock()
+		return nil, nil, ErrShuttingDown
+	}
+	jr.running[job.ID] = job
+	jr.wg.Add(1)
+	saved := *job
+	jr.mutex.Unlock()
+
+	jr.save(saved)
+	return job, jr.ctx, nil
+}
+
+// finish records the outcome of a job, err is nil on success.
+func (jr *jobRegistry) finish(job *Job, err error) {
+	defer jr.wg.Done()
+
+	jr.mutex.Lock()
+	delete(jr.running, job.ID)
+	// the shutdown already recorded why it failed
+	if jr.interrupted[job.ID] {
+		delete(jr.interrupted, job.ID)
+		jr.mutex.Unlock()
+		return
+	}
+	complete(job, err)
+	saved := *job
+	jr.mutex.Unlock()
+
+	jr.save(saved)
+	jr.notify(saved)
+}
+
+// progress records the last progress report of a running job, it's kept in memory only.
+func (jr *jobRegistry) progress(job *Job, progress JobProgress) {
+	jr.mutex.Lock()
+	if _, ok := jr.running[job.ID]; !ok {
+		jr.mutex.Unlock()
+		return
+	}
+	job.Progress = &progress
+	saved := *job
+	jr.mutex.Unlock()
+
+	jr.notify(saved)
+}
+
+func (jr *jobRegistry) notify(job Job) {
+	if jr.onChange != nil {
+		jr.onChange(job)
+	}
+}
+
+func complete(job *Job, err error) {
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Status = JobSucceeded
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+	if job.Status == JobSucceeded && job.Progress != nil && job.Progress.Percent > 0 {
+		progress := *job.Progress
+		progress.Percent = 100
+		job.Progress = &progress
+	}
+}
+
+func (jr *jobRegistry) save(job Job) {
+	if err := jr.catalog.put(context.Background(), jobsCatalog+job.ID+".json", job); err != nil {
+		jr.logger.Error("failed to store job", "job_id", job.ID, "kind", job.Kind, "status", job.Status, "err", err.Error())
+	}
+}
+
+// drain refuses new jobs and waits for the running ones until ctx ends, then cancels them
+// and records them as failed.
+func (jr *jobRegistry) drain(ctx context.Context) error {
+	jr.mutex.Lock()
+	jr.draining = true
+	jr.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		jr.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	jr.mutex.Lock()
+	interrupted := make([]Job, 0, len(jr.running))
+	for id, job := range jr.running {
+		jr.interrupted[id] = true
+		complete(job, fmt.Errorf("%w: interrupted after %s", ErrShuttingDown, time.Since(job.StartedAt).Round(time.Second)))
+		interrupted = append(interrupted, *job)
+	}
+	jr.mutex.Unlock()
+
+	jr.cancel()
+	for _, job := range interrupted {
+		jr.logger.Warn("job interrupted by the shutdown", "job_id", job.ID, "kind", job.Kind, "video", job.Video, "user_id", job.UserID)
+		jr.save(job)
+		jr.notify(job)
+	}
+	return fmt.Errorf("%d jobs interrupted", len(interrupted))
+}
+
+// list returns the jobs of identity, or of everyone for admins, the newest first. The running
+// jobs come with their last progress report.
+func (jr *jobRegistry) list(ctx context.Context, identity *auth.Identity) ([]Job, error) {
+	keys, err := jr.catalog.keys(ctx, jobsCatalog)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]Job, 0, len(keys))
+	for _, key := range keys {
+		var job Job
+		if err := jr.catalog.get(ctx, key, &job); err != nil {
+			return nil, err
+		}
+		jr.mutex.Lock()
+		if running, ok := jr.running[job.ID]; ok {
+			job = *running
+		}
+		jr.mutex.Unlock()
+		if !isAdmin(identity) && (identity == nil || job.UserID != identity.UserID) {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.After(jobs[j].StartedAt)
+	})
+	return jobs, nil
+}
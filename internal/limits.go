@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"video-handler/configs"
+	"video-handler/external/auth"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	limitStreams     string = "streams"
+	limitConversions string = "conversions"
+
+	// uploads are throttled in chunks of at most this size
+	uploadChunkSize int = 32 * 1024
+
+	// the limiters of the users and clients unseen for this long are swept once their bucket refilled
+	limiterIdleTimeout = 10 * time.Minute
+)
+
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrRateLimited   = errors.New("too many requests")
+)
+
+// limits enforces the per-user and global quotas, zero limits are unlimited.
+type limits struct {
+	envs *configs.EnvVariables
+
+	mutex   sync.Mutex
+	running map[string]map[string]int
+	total   map[string]int
+
+	requests *keyedLimiters
+	uploads  *keyedLimiters
+
+	globalRequests *rate.Limiter
+	globalUploads  *rate.Limiter
+}
+
+func newLimits(envs *configs.EnvVariables) *limits {
+	return &limits{
+		envs:           envs,
+		running:        map[string]map[string]int{limitStreams: {}, limitConversions: {}},
+		total:          map[string]int{},
+		requests:       newKeyedLimiters(),
+		uploads:        newKeyedLimiters(),
+		globalRequests: newLimiter(envs.LimitRequests, envs.LimitRequestBurst),
+		globalUploads:  newLimiter(float64(envs.LimitUploadBandwidth), uploadChunkSize),
+	}
+}
+
+func newLimiter(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+func (l *limits) quota(kind string) (perUser, global int) {
+	switch kind {
+	case limitStreams:
+		return l.envs.LimitStreamsPerUser, l.envs.LimitStreams
+	case limitConversions:
+		return l.envs.LimitConversionsPerUser, l.envs.LimitConversions
+	}
+	return 0, 0
+}
+
+// acquire reserves a concurrent stream or conversion for identity, release must be called when it ends.
+func (l *limits) acquire(kind string, identity *auth.Identity) (func(), error) {
+	userID := limitKey(identity, "")
+	perUser, global := l.quota(kind)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if global > 0 && l.total[kind] >= global {
+		return nil, fmt.Errorf("%w: %d concurrent %s on the server", ErrQuotaExceeded, global, kind)
+	}
+	if perUser > 0 && l.running[kind][userID] >= perUser {
+		return nil, fmt.Errorf("%w: %d concurrent %s per user", ErrQuotaExceeded, perUser, kind)
+	}
+
+	l.total[kind]++
+	l.running[kind][userID]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+
+			l.total[kind]--
+			l.running[kind][userID]--
+			if l.running[kind][userID] <= 0 {
+				delete(l.running[kind], userID)
+			}
+		})
+	}, nil
+}
+
+// allowRequest consumes a request of key, usually the user or the client IP.
+// The limiter of key is checked first, so that a client over its own limit doesn't use up the server's.
+func (l *limits) allowRequest(key string) error {
+	limiter := l.userLimiter(l.requests, key, l.envs.LimitRequestsPerUser, l.envs.LimitRequestBurst)
+	if limiter != nil && !limiter.Allow() {
+		return ErrRateLimited
+	}
+
+	if l.globalRequests != nil && !l.globalRequests.Allow() {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// uploadReader throttles reader to the upload bandwidth of key and of the server.
+func (l *limits) uploadReader(ctx context.Context, key string, reader io.Reader) io.Reader {
+	limiters := []*rate.Limiter{}
+	if l.globalUploads != nil {
+		limiters = append(limiters, l.globalUploads)
+	}
+	if limiter := l.userLimiter(l.uploads, key, float64(l.envs.LimitUploadBandwidthPerUser), uploadChunkSize); limiter != nil {
+		limiters = append(limiters, limiter)
+	}
+
+	if len(limiters) == 0 {
+		return reader
+	}
+	return &throttledReader{ctx: ctx, reader: reader, limiters: limiters}
+}
+
+func (l *limits) userLimiter(limiters *keyedLimiters, key string, perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	limiters.sweep(now)
+
+	entry, ok := limiters.entries[key]
+	if !ok {
+		entry = &keyedLimiter{limiter: newLimiter(perSecond, burst)}
+		limiters.entries[key] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter
+}
+
+// keyedLimiters are the limiters of the users and clients, the idle ones are evicted.
+type keyedLimiters struct {
+	entries map[string]*keyedLimiter
+	sweptAt time.Time
+}
+
+type keyedLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newKeyedLimiters() *keyedLimiters {
+	return &keyedLimiters{entries: map[string]*keyedLimiter{}, sweptAt: time.Now()}
+}
+
+// sweep removes, at most once per limiterIdleTimeout, the limiters unseen for limiterIdleTimeout.
+// A limiter whose bucket isn't full yet is kept, a new one would hand out its tokens again.
+func (kl *keyedLimiters) sweep(now time.Time) {
+	if now.Sub(kl.sweptAt) < limiterIdleTimeout {
+		return
+	}
+	kl.sweptAt = now
+
+	for key, entry := range kl.entries {
+		if now.Sub(entry.lastSeen) >= limiterIdleTimeout && entry.limiter.TokensAt(now) >= float64(entry.limiter.Burst()) {
+			delete(kl.entries, key)
+		}
+	}
+}
+
+func limitKey(identity *auth.Identity, ip string) string {
+	if identity != nil && identity.UserID != "" {
+		return "user:" + identity.UserID
+	}
+	return "ip:" + ip
+}
+
+type throttledReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	limiters []*rate.Limiter
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > uploadChunkSize {
+		p = p[:uploadChunkSize]
+	}
+
+	n, err := tr.reader.Read(p)
+	for _, limiter := range tr.limiters {
+		if waitErr := limiter.WaitN(tr.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
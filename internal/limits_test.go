@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"video-handler/configs"
+	"video-handler/external/auth"
+)
+
+func TestLimitsAcquireConcurrently(t *testing.T) {
+	tests := []struct {
+		kind   string
+		envs   configs.EnvVariables
+		users  int
+		want   int
+		perMax int
+	}{
+		{limitStreams, configs.EnvVariables{LimitStreams: 10, LimitStreamsPerUser: 3}, 4, 10, 3},
+		{limitStreams, configs.EnvVariables{LimitStreamsPerUser: 3}, 4, 12, 3},
+		{limitConversions, configs.EnvVariables{LimitConversions: 5}, 4, 5, 5},
+		{limitConversions, configs.EnvVariables{LimitConversions: 20, LimitConversionsPerUser: 2}, 4, 8, 2},
+		{limitConversions, configs.EnvVariables{}, 4, 100, 25},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %+v", test.kind, test.envs), func(t *testing.T) {
+			l := newLimits(&test.envs)
+
+			var mutex sync.Mutex
+			var releases []func()
+			acquired := map[string]int{}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 100; i++ {
+				identity := &auth.Identity{UserID: fmt.Sprintf("user-%d", i%test.users)}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					release, err := l.acquire(test.kind, identity)
+					if err != nil {
+						if !errors.Is(err, ErrQuotaExceeded) {
+							t.Errorf("acquire returned %v, want %v", err, ErrQuotaExceeded)
+						}
+						return
+					}
+					mutex.Lock()
+					defer mutex.Unlock()
+					releases = append(releases, release)
+					acquired[identity.UserID]++
+				}()
+			}
+			wg.Wait()
+
+			if len(releases) != test.want {
+				t.Errorf("%d %s acquired, want %d", len(releases), test.kind, test.want)
+			}
+			for userID, n := range acquired {
+				if n > test.perMax {
+					t.Errorf("%s acquired %d %s, want at most %d", userID, n, test.kind, test.perMax)
+				}
+			}
+
+			// a release is counted once however many times it's called
+			for _, release := range releases {
+				release()
+				release()
+			}
+			if l.total[test.kind] != 0 || len(l.running[test.kind]) != 0 {
+				t.Errorf("%d %s still counted after their release, per user %v", l.total[test.kind], test.kind, l.running[test.kind])
+			}
+		})
+	}
+}
+
+func TestLimitsCountKindsApart(t *testing.T) {
+	l := newLimits(&configs.EnvVariables{LimitStreamsPerUser: 1, LimitConversionsPerUser: 1})
+	identity := &auth.Identity{UserID: "user"}
+
+	if _, err := l.acquire(limitStreams, identity); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(limitConversions, identity); err != nil {
+		t.Errorf("a conversion next to a stream returned %v", err)
+	}
+	if _, err := l.acquire(limitStreams, identity); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("a second stream returned %v, want %v", err, ErrQuotaExceeded)
+	}
+}
+
+func TestLimitsAllowRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		envs configs.EnvVariables
+		// tokens taken from the limiter of user:a alone before the requests
+		taken int
+		// keys of the requests in order, and whether each is allowed
+		keys    []string
+		allowed []bool
+	}{
+		{
+			"unlimited",
+			configs.EnvVariables{LimitRequestBurst: 1},
+			0,
+			[]string{"user:a", "user:a", "user:a"},
+			[]bool{true, true, true},
+		},
+		{
+			"per user burst",
+			configs.EnvVariables{LimitRequestsPerUser: 0.001, LimitRequestBurst: 3},
+			0,
+			[]string{"user:a", "user:a", "user:a", "user:a", "user:b", "ip:10.0.0.1"},
+			[]bool{true, true, true, false, true, true},
+		},
+		{
+			"global burst",
+			configs.EnvVariables{LimitRequests: 0.001, LimitRequestBurst: 3},
+			0,
+			[]string{"user:a", "user:b", "ip:10.0.0.1", "user:c"},
+			[]bool{true, true, true, false},
+		},
+		{
+			"the users share the global burst",
+			configs.EnvVariables{LimitRequests: 0.001, LimitRequestsPerUser: 0.001, LimitRequestBurst: 2},
+			0,
+			[]string{"user:a", "user:a", "user:a", "user:a", "user:a", "user:b"},
+			[]bool{true, true, false, false, false, false},
+		},
+		{
+			"a user over its limit doesn't use the global tokens",
+			configs.EnvVariables{LimitRequests: 0.001, LimitRequestsPerUser: 0.001, LimitRequestBurst: 2},
+			1,
+			[]string{"user:a", "user:a", "user:a", "user:b"},
+			[]bool{true, false, false, true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newLimits(&test.envs)
+			if test.taken > 0 {
+				l.userLimiter(l.requests, "user:a", test.envs.LimitRequestsPerUser, test.envs.LimitRequestBurst).AllowN(time.Now(), test.taken)
+			}
+			for i, key := range test.keys {
+				err := l.allowRequest(key)
+				if (err == nil) != test.allowed[i] {
+					t.Errorf("request %d of %s returned %v, want allowed %v", i, key, err, test.allowed[i])
+				}
+				if err != nil && !errors.Is(err, ErrRateLimited) {
+					t.Errorf("request %d of %s returned %v, want %v", i, key, err, ErrRateLimited)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	namespace string = "video_handler"
+
+	// packet paths
+	PathRtspServer string = "rtsp_server"
+	PathWebrtc     string = "webrtc"
+)
+
+var (
+	ActiveStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rtsp_streams_active",
+		Help:      "RTSP streams whose pusher is running.",
+	})
+
+	PusherRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtsp_pusher_restarts_total",
+		Help:      "Restarts of the ffmpeg processes pushing videos to the RTSP servers, by failure.",
+	}, []string{"failure"})
+
+	PeerConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "webrtc_peer_connections",
+		Help:      "WebRTC peer connections by state.",
+	}, []string{"state"})
+
+	PacketsForwarded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtp_packets_forwarded_total",
+		Help:      "RTP packets forwarded to the readers of the RTSP servers or to the WebRTC tracks.",
+	}, []string{"path"})
+
+	PacketsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtp_packets_dropped_total",
+		Help:      "RTP packets dropped because the forwarding buffer was full.",
+	}, []string{"path"})
+
+	ConversionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "conversion_duration_seconds",
+		Help:      "Duration of the video conversions, including the upload of the output.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	ConversionFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "conversion_failures_total",
+		Help:      "Video conversions which failed.",
+	})
+
+	UploadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_bytes_total",
+		Help:      "Bytes of the videos stored in the bucket.",
+	})
+
+	StorageLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Latency of the MinIO operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+// ObserveStorage records the latency of a storage operation started at start, meant to be deferred.
+func ObserveStorage(operation string, start time.Time) {
+	StorageLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
@@ -1,6 +1,12 @@
 package internal
 
-import "github.com/pion/webrtc/v4"
+import (
+	"net"
+	"time"
+	"video-handler/external/auth"
+
+	"github.com/pion/webrtc/v4"
+)
 
 type Response struct {
 	Status       int
@@ -14,7 +20,62 @@ type websocketMessage struct {
 	Data  string `json:"data"`
 }
 
+type seekRequest struct {
+	StreamID string  `json:"stream_id"`
+	Offset   float64 `json:"offset"`
+}
+
 type peerConnectionState struct {
 	peerConnection *webrtc.PeerConnection
 	websocket      *threadSafeWriter
+	identity       *auth.Identity
+	// grant is set instead of identity for the viewers of a playback token, connected from ip
+	grant *auth.PlaybackGrant
+	ip    net.IP
+}
+
+type StreamInfo struct {
+	ID        string    `json:"id"`
+	VideoName string    `json:"video_name"`
+	RtspUrl   string    `json:"rtsp_url"`
+	StartedAt time.Time `json:"started_at"`
+	Recording bool      `json:"recording"`
+	Dvr       bool      `json:"dvr"`
+	SourceID  string    `json:"source_id,omitempty"`
+	State     string    `json:"state"`
+	Restarts  int       `json:"restarts"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type RecordingInfo struct {
+	ID        string    `json:"id"`
+	StreamID  string    `json:"stream_id"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type PlaybackTokenInfo struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ReadinessReport struct {
+	Status string                      `json:"status"`
+	Checks map[string]DependencyStatus `json:"checks"`
+}
+
+type UsageReport struct {
+	Users   []Usage `json:"users"`
+	Tenants []Usage `json:"tenants"`
+}
+
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Tenant string   `json:"tenant"`
+	Scopes []string `json:"scopes"`
+}
+
+type createdAPIKey struct {
+	auth.APIKey
+	// Secret is only returned on creation, it is the bearer token of the key.
+	Secret string `json:"secret"`
 }
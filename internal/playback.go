@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"video-handler/external/auth"
+)
+
+// checkPlaybackGrant tells whether a playback token gives access to the stream from ip.
+func checkPlaybackGrant(ctx context.Context, videoService *VideoService, grant *auth.PlaybackGrant, stream *videoStream, ip net.IP) error {
+	if grant.StreamID != "" && grant.StreamID != stream.ID {
+		return ErrForbidden
+	}
+	if grant.Video != "" && grant.Video != stream.VideoName {
+		return ErrForbidden
+	}
+	if !grant.AllowsIP(ip) {
+		return ErrForbidden
+	}
+
+	// the issuer may have lost access to the video since the token was issued
+	return videoService.CanReadStream(ctx, grant.Issuer, stream)
+}
+
+// canWatch tells whether the peer may watch the stream, as its user or with its playback token.
+func (state peerConnectionState) canWatch(ctx context.Context, videoService *VideoService, stream *videoStream) error {
+	if state.grant != nil {
+		return checkPlaybackGrant(ctx, videoService, state.grant, stream, state.ip)
+	}
+	return videoService.CanReadStream(ctx, state.identity, stream)
+}
+
+// CanReadStream tells whether identity may watch the stream: its owner, or a reader of its video
+// in the tenant of its owner.
+func (service *VideoService) CanReadStream(ctx context.Context, identity *auth.Identity, stream *videoStream) error {
+	if isStreamOwner(identity, stream) {
+		return nil
+	}
+	// the name of the video resolves in the tenant of the caller, where another video may have it
+	if service.tenants.locate(identity, stream.VideoName) != service.tenants.locate(stream.Owner, stream.VideoName) {
+		return ErrVideoNotFound
+	}
+	return service.CanReadVideo(ctx, identity, stream.VideoName)
+}
+
+func isStreamOwner(identity *auth.Identity, stream *videoStream) bool {
+	return identity != nil && identity.UserID != "" && stream.Owner != nil && stream.Owner.UserID == identity.UserID
+}
+
+// canModifyStream tells whether identity may record the stream.
+func canModifyStream(identity *auth.Identity, stream *videoStream) bool {
+	return isStreamOwner(identity, stream) || isAdmin(identity)
+}
+
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
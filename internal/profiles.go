@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"video-handler/configs"
+
+	cmdCommand "video-handler/pkg"
+)
+
+const (
+	// single pass EBU R128 normalisation: -23 LUFS, -1 dBTP
+	loudnormFilter     string = "loudnorm=I=-23:TP=-1:LRA=7"
+	loudnormSampleRate int    = 48000
+)
+
+var (
+	ErrUnknownProfile = errors.New("unknown conversion profile")
+)
+
+// ProfileInfo is a conversion profile as listed to the clients.
+type ProfileInfo struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+	configs.ConversionProfile
+}
+
+// profiles returns the configured profiles, with the default profile made of FFMPEG_CONVERSION_CODEC
+// and FFMPEG_CONVERSION_BITRATE unless it's configured.
+func (service *VideoService) profiles() map[string]configs.ConversionProfile {
+	profiles := make(map[string]configs.ConversionProfile, len(service.Envs.ConversionProfiles)+1)
+	profiles[configs.DefaultProfileName] = configs.ConversionProfile{
+		VideoCodec: service.Envs.FfmpegConversionCodec,
+		Crf:        service.Envs.FfmpegConversionBitrate,
+	}
+	for name, profile := range service.Envs.ConversionProfiles {
+		profiles[name] = profile
+	}
+	return profiles
+}
+
+// conversionProfile returns the profile named name, DEFAULT_CONVERSION_PROFILE when name is empty.
+func (service *VideoService) conversionProfile(name string) (string, configs.ConversionProfile, error) {
+	if name == "" {
+		name = service.Envs.DefaultConversionProfile
+	}
+	profile, ok := service.profiles()[name]
+	if !ok {
+		return name, profile, fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+	}
+	return name, profile, nil
+}
+
+// ConversionProfiles lists the profiles by name.
+func (service *VideoService) ConversionProfiles() []ProfileInfo {
+	profiles := service.profiles()
+	infos := make([]ProfileInfo, 0, len(profiles))
+	for name, profile := range profiles {
+		infos = append(infos, ProfileInfo{
+			Name:              name,
+			Default:           name == service.Envs.DefaultConversionProfile,
+			ConversionProfile: profile,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// checkProfiles fails on a missing default profile or on a profile ffmpeg can't be run with.
+func (service *VideoService) checkProfiles() error {
+	if _, _, err := service.conversionProfile(""); err != nil {
+		return fmt.Errorf("DEFAULT_CONVERSION_PROFILE: %w", err)
+	}
+	if _, ok := service.Envs.ConversionProfiles[remuxProfileName]; ok {
+		return fmt.Errorf("conversion profile %s: the name is reserved for remuxes", remuxProfileName)
+	}
+	for name, profile := range service.profiles() {
+		if _, err := service.conversionCommand(profileCheckUrl, profile).Args(); err != nil {
+			return fmt.Errorf("conversion profile %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// conversionCommand converts the video at videoUrl to pipe:1 with profile. The input is an URL rather
+// than a pipe so that ffmpeg can seek to the index of a MP4 written after its media data.
+func (service *VideoService) conversionCommand(videoUrl string, profile configs.ConversionProfile) cmdCommand.Ffmpeg {
+	output := cmdCommand.FfmpegOutput{
+		Url:              "pipe:1",
+		Format:           profile.Container,
+		VideoCodec:       profile.VideoCodec,
+		Crf:              profile.Crf,
+		VideoBitrate:     profile.Bitrate,
+		KeyframeInterval: profile.Gop,
+		AudioCodec:       profile.AudioCodec,
+		AudioBitrate:     profile.AudioBitrate,
+		AudioChannels:    profile.AudioChannels,
+		// a single audio track is kept, a video without sound is converted too
+		Maps: []cmdCommand.FfmpegMap{
+			{Stream: "V:0"},
+			{Stream: "a:" + strconv.Itoa(profile.AudioTrack), Optional: true},
+		},
+	}
+	if output.Format == "" {
+		output.Format = "mpegts"
+	}
+	if output.AudioCodec == "" {
+		output.AudioCodec = defaultAudioCodec(output.Format)
+	}
+	if profile.Loudnorm {
+		output.AudioFilters = append(output.AudioFilters, loudnormFilter)
+		// loudnorm resamples to 192 kHz
+		output.AudioSampleRate = loudnormSampleRate
+	}
+	if profile.MaxHeight > 0 {
+		// -2 keeps the width even, which most encoders need
+		output.VideoFilters = append(output.VideoFilters, fmt.Sprintf("scale=-2:'min(ih,%d)'", profile.MaxHeight))
+	}
+	if profile.FrameRate > 0 {
+		output.FrameRate = strconv.FormatFloat(profile.FrameRate, 'f', -1, 64)
+	}
+	if output.Format == "mp4" {
+		// a pipe can't be seeked back to write the index
+		output.Options = append(output.Options, cmdCommand.FfmpegOption{Name: "movflags", Value: "frag_keyframe+empty_moov+default_base_moof"})
+	}
+
+	input := cmdCommand.FfmpegInput{Url: videoUrl}
+	if output.VideoCodec == cmdCommand.CodecCopy {
+		// a copied stream keeps the timestamps of its container, which an AVI may lack
+		input.Options = append(input.Options, cmdCommand.FfmpegOption{Name: "fflags", Value: "+genpts"})
+	}
+
+	return cmdCommand.Ffmpeg{
+		StatsPeriod: service.Envs.FfmpegProgressPeriod,
+		Inputs:      []cmdCommand.FfmpegInput{input},
+		Outputs:     []cmdCommand.FfmpegOutput{output},
+	}
+}
+
+// profileCheckUrl stands for the original when the profiles are checked at startup
+const profileCheckUrl string = "http://localhost/original"
+
+// defaultAudioCodec stores the audio as AAC, or as Opus in a WebM which can't hold AAC.
+func defaultAudioCodec(container string) string {
+	if container == "webm" {
+		return "libopus"
+	}
+	return "aac"
+}
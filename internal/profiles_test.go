@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"video-handler/configs"
+)
+
+func TestCheckProfiles(t *testing.T) {
+	x264 := configs.ConversionProfile{VideoCodec: "libx264", Crf: "23"}
+
+	tests := []struct {
+		name           string
+		codec          string
+		bitrate        string
+		defaultProfile string
+		profiles       configs.ConversionProfiles
+		err            string
+	}{
+		{name: "the default profile", codec: "libx264", bitrate: "23", defaultProfile: configs.DefaultProfileName},
+		{name: "profiles", codec: "libx264", defaultProfile: "720p", profiles: configs.ConversionProfiles{
+			"720p": {VideoCodec: "libx264", Crf: "23", MaxHeight: 720, Loudnorm: true, Container: "mp4"},
+			"web":  {VideoCodec: "libvpx-vp9", Bitrate: "1M", Container: "webm"},
+			"copy": {VideoCodec: "copy", Container: "matroska"},
+		}},
+		{name: "a default profile which isn't configured", codec: "libx264", defaultProfile: "1080p", profiles: configs.ConversionProfiles{"720p": x264}, err: "DEFAULT_CONVERSION_PROFILE"},
+		{name: "a profile named like the remuxes", codec: "libx264", defaultProfile: configs.DefaultProfileName, profiles: configs.ConversionProfiles{remuxProfileName: x264}, err: "reserved for remuxes"},
+		{name: "a copy scaled down", codec: "libx264", defaultProfile: configs.DefaultProfileName, profiles: configs.ConversionProfiles{"720p": {VideoCodec: "copy", MaxHeight: 720}}, err: "conversion profile 720p"},
+		{name: "a copy with a crf", codec: "libx264", defaultProfile: configs.DefaultProfileName, profiles: configs.ConversionProfiles{"copy": {VideoCodec: "copy", Crf: "23"}}, err: "conversion profile copy"},
+		{name: "a default profile made of a copy with a crf", codec: "copy", bitrate: "23", defaultProfile: configs.DefaultProfileName, err: "conversion profile default"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := &VideoService{Envs: &configs.EnvVariables{
+				FfmpegConversionCodec:    test.codec,
+				FfmpegConversionBitrate:  test.bitrate,
+				DefaultConversionProfile: test.defaultProfile,
+				ConversionProfiles:       test.profiles,
+			}}
+
+			err := service.checkProfiles()
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("checkProfiles returned %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("checkProfiles returned %v, want %q", err, test.err)
+			}
+		})
+	}
+}
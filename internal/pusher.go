@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"video-handler/external/auth"
+	"video-handler/internal/metrics"
+	"video-handler/internal/tracing"
+)
+
+const (
+	StreamStarting   string = "starting"
+	StreamRunning    string = "running"
+	StreamRestarting string = "restarting"
+	StreamFailed     string = "failed"
+	StreamEnded      string = "ended"
+
+	// a pusher which ran that long before failing starts over with the first backoff
+	pusherStableAfter = time.Minute
+	// delay between the reconnections of a WebRTC track to a restarting stream
+	consumerRetryDelay = time.Second
+)
+
+// pusherFailure classifies why a pusher stopped, from its error and the end of the ffmpeg output.
+type pusherFailure string
+
+const (
+	failureSource      pusherFailure = "source"
+	failureAuth        pusherFailure = "auth"
+	failureConnection  pusherFailure = "connection"
+	failureInterrupted pusherFailure = "interrupted"
+	failureUnknown     pusherFailure = "unknown"
+)
+
+var pusherFailurePatterns = []struct {
+	failure  pusherFailure
+	patterns []string
+}{
+	{failureAuth, []string{"401 unauthorized", "403 forbidden"}},
+	{failureSource, []string{
+		"invalid data found when processing input",
+		"moov atom not found",
+		"could not find codec parameters",
+		"does not contain any stream",
+		"no such file or directory",
+	}},
+	{failureConnection, []string{
+		"connection refused",
+		"connection reset",
+		"connection timed out",
+		"broken pipe",
+		"network is unreachable",
+		"server returned",
+		"i/o error",
+	}},
+	{failureInterrupted, []string{"received signal", "exiting normally"}},
+}
+
+func classifyPusherFailure(output []byte, err error) pusherFailure {
+	switch {
+	case errors.Is(err, ErrVideoNotFound), errors.Is(err, ErrForbidden):
+		return failureSource
+	case errors.Is(err, context.Canceled):
+		return failureInterrupted
+	}
+
+	tail := strings.ToLower(string(output))
+	for _, candidate := range pusherFailurePatterns {
+		for _, pattern := range candidate.patterns {
+			if strings.Contains(tail, pattern) {
+				return candidate.failure
+			}
+		}
+	}
+	return failureUnknown
+}
+
+// retryable tells whether restarting the pusher may help.
+func (failure pusherFailure) retryable() bool {
+	return failure == failureConnection || failure == failureUnknown
+}
+
+// streamState is what the viewers are told about the pusher of a stream.
+type streamState struct {
+	State    string
+	Restarts int
+	Error    string
+}
+
+func (stream *videoStream) setState(state streamState) {
+	stream.stateMutex.Lock()
+	defer stream.stateMutex.Unlock()
+
+	stream.state = state
+}
+
+func (stream *videoStream) currentState() streamState {
+	stream.stateMutex.Lock()
+	defer stream.stateMutex.Unlock()
+
+	return stream.state
+}
+
+// finished tells whether the pusher stopped for good.
+func (stream *videoStream) finished() bool {
+	state := stream.currentState().State
+	return state == StreamFailed || state == StreamEnded
+}
+
+// OnStateChange registers a callback for the state changes of the streams, like a pusher restart.
+func (service *StreamerService) OnStateChange(callback func(stream *videoStream)) {
+	service.onStateChange = callback
+}
+
+func (service *StreamerService) updateState(stream *videoStream, state streamState) {
+	stream.setState(state)
+	if service.onStateChange != nil {
+		service.onStateChange(stream)
+	}
+}
+
+// backoff returns the delay before the attempt-th restart, doubling from StreamRestartBackoff.
+func (service *StreamerService) backoff(attempt int) time.Duration {
+	delay := service.Envs.StreamRestartBackoff
+	for i := 1; i < attempt && delay < service.Envs.StreamRestartMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, service.Envs.StreamRestartMaxBackoff)
+}
+
+// superviseVideoPusher pushes the video of the stream and restarts the pusher with backoff when it
+// fails, from where it stopped. A failing stream never affects the other streams.
+func (service *StreamerService) superviseVideoPusher(ctx context.Context, identity *auth.Identity, stream *videoStream) {
+	// the pusher outlives the websocket which started it, until the service stops
+	ctx = tracing.Detach(ctx, service.pushers)
+
+	var position time.Duration
+	restarts := 0
+	attempt := 0
+	for {
+		service.updateState(stream, streamState{State: StreamRunning, Restarts: restarts})
+
+		started := time.Now()
+		output, err := service.VideoService.streamVideoToServer(ctx, identity, stream.VideoName, stream.publishUrl(), position)
+		if err == nil {
+			service.updateState(stream, streamState{State: StreamEnded, Restarts: restarts})
+			return
+		}
+
+		position += ffmpegProgress(output)
+		failure := classifyPusherFailure(output, err)
+		if service.pushers.Err() != nil {
+			failure = failureInterrupted
+		}
+
+		service.Logger.Error("stream pusher stopped", "stream_id", stream.ID, "failure", string(failure), "position", position.String(), "err", err.Error())
+
+		if !failure.retryable() {
+			service.updateState(stream, streamState{State: StreamFailed, Restarts: restarts, Error: err.Error()})
+			return
+		}
+
+		if time.Since(started) > pusherStableAfter {
+			attempt = 0
+		}
+		attempt++
+		if attempt > service.Envs.StreamRestartLimit {
+			service.updateState(stream, streamState{State: StreamFailed, Restarts: restarts, Error: err.Error()})
+			return
+		}
+
+		delay := service.backoff(attempt)
+		service.updateState(stream, streamState{State: StreamRestarting, Restarts: restarts, Error: err.Error()})
+		service.Logger.Info("restarting stream pusher", "stream_id", stream.ID, "attempt", attempt, "delay", delay.String(), "position", position.String())
+
+		select {
+		case <-time.After(delay):
+		case <-service.pushers.Done():
+			service.updateState(stream, streamState{State: StreamFailed, Restarts: restarts, Error: ErrShuttingDown.Error()})
+			return
+		}
+
+		restarts++
+		metrics.PusherRestarts.WithLabelValues(string(failure)).Inc()
+	}
+}
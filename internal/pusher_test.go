@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"video-handler/configs"
+	"video-handler/external/auth"
+
+	cmdCommand "video-handler/pkg"
+)
+
+func TestClassifyPusherFailure(t *testing.T) {
+	exitStatus := errors.New("exit status 1")
+
+	tests := []struct {
+		name      string
+		output    string
+		err       error
+		failure   pusherFailure
+		retryable bool
+	}{
+		{"refused by the RTSP server", "[rtsp @ 0x5583] method ANNOUNCE failed: 401 Unauthorized\n", exitStatus, failureAuth, false},
+		{"forbidden by the RTSP server", "Server returned 403 Forbidden (access denied)\n", exitStatus, failureAuth, false},
+		{"a corrupt source", "https://minio/videos/movie.ts: Invalid data found when processing input\n", exitStatus, failureSource, false},
+		{"a truncated mp4", "[mov,mp4,m4a,3gp,3g2,mj2 @ 0x55] moov atom not found\n", exitStatus, failureSource, false},
+		{"a deleted video", "", fmt.Errorf("stat movie.ts: %w", ErrVideoNotFound), failureSource, false},
+		{"a video which isn't shared anymore", "", ErrForbidden, failureSource, false},
+		{"the RTSP server is down", "[tcp @ 0x55] Connection to tcp://localhost:8554 failed: Connection refused\n", exitStatus, failureConnection, true},
+		{"the connection drops", "av_interleaved_write_frame(): Broken pipe\n", exitStatus, failureConnection, true},
+		{"the source stalls", "https://minio/videos/movie.ts: I/O error\n", exitStatus, failureConnection, true},
+		{"the server went away", "Server returned 5XX Server Error reply\n", exitStatus, failureConnection, true},
+		{"the pusher is killed", "Exiting normally, received signal 15.\n", exitStatus, failureInterrupted, false},
+		{"the context is cancelled", "frame=  250 fps= 25 q=-1.0 size=N/A time=00:00:10.00 bitrate=N/A speed=1x\n", context.Canceled, failureInterrupted, false},
+		{"the patterns are matched case insensitively", "CONNECTION RESET BY PEER\n", exitStatus, failureConnection, true},
+		{"the stats only", "frame=  250 fps= 25 q=-1.0 size=N/A time=00:00:10.00 bitrate=N/A speed=1x\n", exitStatus, failureUnknown, true},
+		{"no output", "", exitStatus, failureUnknown, true},
+	}
+
+	for _, test := range tests {
+		failure := classifyPusherFailure([]byte(test.output), test.err)
+		if failure != test.failure {
+			t.Errorf("%s: classified as %s, want %s", test.name, failure, test.failure)
+		}
+		if failure.retryable() != test.retryable {
+			t.Errorf("%s: retryable is %v, want %v", test.name, failure.retryable(), test.retryable)
+		}
+	}
+}
+
+func TestPusherBackoff(t *testing.T) {
+	tests := []struct {
+		backoff    time.Duration
+		maxBackoff time.Duration
+		attempt    int
+		want       time.Duration
+	}{
+		{time.Second, 30 * time.Second, 1, time.Second},
+		{time.Second, 30 * time.Second, 2, 2 * time.Second},
+		{time.Second, 30 * time.Second, 3, 4 * time.Second},
+		{time.Second, 30 * time.Second, 5, 16 * time.Second},
+		{time.Second, 30 * time.Second, 6, 30 * time.Second},
+		{time.Second, 30 * time.Second, 1000, 30 * time.Second},
+		{3 * time.Second, 10 * time.Second, 2, 6 * time.Second},
+		{3 * time.Second, 10 * time.Second, 3, 10 * time.Second},
+		{time.Minute, 30 * time.Second, 1, 30 * time.Second},
+	}
+
+	for _, test := range tests {
+		service := &StreamerService{Envs: &configs.EnvVariables{
+			StreamRestartBackoff:    test.backoff,
+			StreamRestartMaxBackoff: test.maxBackoff,
+		}}
+		if got := service.backoff(test.attempt); got != test.want {
+			t.Errorf("backoff of attempt %d from %s up to %s is %s, want %s", test.attempt, test.backoff, test.maxBackoff, got, test.want)
+		}
+	}
+}
+
+func TestPusherRestartLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		err      error
+		restarts int
+	}{
+		{"without restarts", 0, errors.New("exit status 1"), 0},
+		{"up to the limit", 3, errors.New("exit status 1"), 3},
+		{"a fatal failure", 3, ErrForbidden, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServer(t, &fakeTranscoder{Result: cmdCommand.ProbeResult{VideoCodec: "h264", Formats: "mpegts"}})
+			ts.streamerService.Envs.StreamRestartLimit = test.limit
+			ts.streamerService.Envs.StreamRestartBackoff = time.Millisecond
+			ts.streamerService.Envs.StreamRestartMaxBackoff = time.Millisecond
+
+			identity := &auth.Identity{UserID: "viewer"}
+			if _, err := ts.videoService.UploadVideo(context.Background(), identity, strings.NewReader("a MPEG-TS in H264"), "movie.ts", "video/mp2t", false, nil); err != nil {
+				t.Fatal(err)
+			}
+			// every attempt of the pusher fails from now on
+			ts.transcoder.Err = test.err
+
+			stream, err := ts.streamerService.createVideoStream(context.Background(), identity, "movie.ts")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for !stream.finished() && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			state := stream.currentState()
+			if state.State != StreamFailed || state.Restarts != test.restarts {
+				t.Errorf("the stream is %s after %d restarts, want %s after %d", state.State, state.Restarts, StreamFailed, test.restarts)
+			}
+			if state.Error == "" {
+				t.Errorf("the stream doesn't tell why it failed")
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+	"video-handler/external/auth"
+	"video-handler/internal/rtspserver"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	recordingsPrefix       string = "recordings/"
+	recordingContentType   string = "video/mp4"
+	recordingSegmentFormat string = "segment_%05d.m4s"
+	// segments waiting for their upload, a recording which falls further behind fails
+	recordingQueueSize int = 16
+)
+
+var ErrRecordingBehind = errors.New("recording failed: the bucket can't keep up with the stream")
+
+type recordedObject struct {
+	name string
+	data []byte
+}
+
+// streamRecorder writes the packets published on a RTSP server into fMP4 segments,
+// uploads them to the bucket and joins them into a single video when stopped.
+type streamRecorder struct {
+	ID        string
+	StreamID  string
+	StartedAt time.Time
+	Owner     *auth.Identity
+
+	videoService *VideoService
+	server       *rtspserver.Server
+	logger       *slog.Logger
+
+	writer *h264SegmentWriter
+	prefix string
+
+	uploads chan recordedObject
+	done    chan struct{}
+	objects []string
+
+	errMutex sync.Mutex
+	err      error
+}
+
+func newStreamRecorder(videoService *VideoService, server *rtspserver.Server, streamID string, owner *auth.Identity, segmentDuration time.Duration) (*streamRecorder, error) {
+	desc := server.Description()
+	if desc == nil {
+		return nil, fmt.Errorf("stream %s is not published yet", streamID)
+	}
+
+	rec := &streamRecorder{
+		ID:           uuid.New().String(),
+		StreamID:     streamID,
+		StartedAt:    time.Now(),
+		Owner:        owner,
+		videoService: videoService,
+		server:       server,
+		logger:       videoService.Logger,
+		uploads:      make(chan recordedObject, recordingQueueSize),
+		done:         make(chan struct{}),
+	}
+	rec.prefix = fmt.Sprintf("%s%s/%s/", recordingsPrefix, streamID, rec.ID)
+
+	writer, err := newH264SegmentWriter(desc, segmentDuration, rec.logger,
+		func(init []byte) error {
+			return rec.enqueue("init.mp4", init)
+		},
+		func(seq uint32, segment []byte, duration time.Duration) error {
+			return rec.enqueue(fmt.Sprintf(recordingSegmentFormat, seq), segment)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	rec.writer = writer
+
+	go rec.uploadSegments()
+
+	server.AddPublishHandler(rec.ID, writer.handlePublish)
+	server.AddPacketHandler(rec.ID, writer.handlePacket)
+
+	rec.logger.Info("recording started", "stream_id", streamID, "recording_id", rec.ID)
+	return rec, nil
+}
+
+// enqueue hands a segment to the uploads without blocking, it runs in the goroutine which forwards
+// the packets to the viewers. A segment which doesn't fit in the queue fails the recording.
+func (rec *streamRecorder) enqueue(name string, data []byte) error {
+	if err := rec.failure(); err != nil {
+		return err
+	}
+
+	select {
+	case rec.uploads <- recordedObject{name: rec.prefix + name, data: data}:
+		return nil
+	default:
+		rec.fail(ErrRecordingBehind)
+		return ErrRecordingBehind
+	}
+}
+
+func (rec *streamRecorder) fail(err error) {
+	rec.errMutex.Lock()
+	defer rec.errMutex.Unlock()
+
+	if rec.err == nil {
+		rec.err = err
+		rec.logger.Error("recording failed", "recording_id", rec.ID, "stream_id", rec.StreamID, "err", err.Error())
+	}
+}
+
+func (rec *streamRecorder) failure() error {
+	rec.errMutex.Lock()
+	defer rec.errMutex.Unlock()
+
+	return rec.err
+}
+
+func (rec *streamRecorder) uploadSegments() {
+	defer close(rec.done)
+
+	for object := range rec.uploads {
+		// a recording missing a segment can't be joined, the rest isn't uploaded
+		if rec.failure() != nil {
+			continue
+		}
+
+		_, err := rec.videoService.PutObject(object.name, bytes.NewReader(object.data), int64(len(object.data)), minio.PutObjectOptions{
+			ContentType: recordingContentType,
+		})
+		if err != nil {
+			rec.logger.Error("failed to upload recording segment", "recording_id", rec.ID, "segment", object.name, "err", err.Error())
+			rec.fail(err)
+			continue
+		}
+
+		rec.objects = append(rec.objects, object.name)
+	}
+}
+
+// removeSegments removes the uploaded segments, once joined or when the recording failed.
+func (rec *streamRecorder) removeSegments() {
+	for _, object := range rec.objects {
+		if err := rec.videoService.RemoveObject(object); err != nil {
+			rec.logger.Error("failed to remove recording segment", "segment", object, "err", err.Error())
+		}
+	}
+}
+
+// stop flushes the last segment and joins all uploaded segments into videoName.
+func (rec *streamRecorder) stop(videoName string) (minio.UploadInfo, error) {
+	rec.server.RemovePacketHandler(rec.ID)
+	rec.server.RemovePublishHandler(rec.ID)
+
+	if err := rec.writer.close(); err != nil {
+		rec.logger.Error("failed to flush recording", "recording_id", rec.ID, "err", err.Error())
+	}
+
+	close(rec.uploads)
+	<-rec.done
+
+	if err := rec.failure(); err != nil {
+		rec.removeSegments()
+		return minio.UploadInfo{}, err
+	}
+	if len(rec.objects) < 2 {
+		rec.removeSegments()
+		return minio.UploadInfo{}, errors.New("nothing was recorded")
+	}
+
+	uploadInfo, err := rec.join(videoName)
+	if err != nil {
+		rec.removeSegments()
+		return minio.UploadInfo{}, err
+	}
+
+	rec.removeSegments()
+
+	rec.logger.Info("recording saved", "recording_id", rec.ID, "video_name", uploadInfo.Key, "video_size", uploadInfo.Size)
+	return uploadInfo, nil
+}
+
+// join concatenates the init segment and the media segments, which is a valid fragmented MP4,
+// and stores the result as a video of the owner.
+func (rec *streamRecorder) join(videoName string) (minio.UploadInfo, error) {
+	readers := make([]io.Reader, 0, len(rec.objects))
+	for _, object := range rec.objects {
+		video, err := rec.videoService.GetVideo(object)
+		if err != nil {
+			return minio.UploadInfo{}, err
+		}
+		defer video.Close()
+
+		readers = append(readers, video)
+	}
+
+	return rec.videoService.uploadUserObject(rec.videoService.Context, rec.Owner, io.MultiReader(readers...), videoName, -1, false, minio.PutObjectOptions{
+		ContentType: recordingContentType,
+		UserMetadata: map[string]string{
+			"source":       "recording",
+			"stream-id":    rec.StreamID,
+			"recording-id": rec.ID,
+		},
+	})
+}
+
+func recordingVideoName(sourceVideoName string, startedAt time.Time) string {
+	name, _ := extractFileNameComponents(sourceVideoName)
+	if name == "" {
+		name = sourceVideoName
+	}
+	return fmt.Sprintf("%s-recording-%s.mp4", name, startedAt.Format("20060102-150405"))
+}
+
+func (rec *streamRecorder) info() RecordingInfo {
+	return RecordingInfo{
+		ID:        rec.ID,
+		StreamID:  rec.StreamID,
+		StartedAt: rec.StartedAt,
+	}
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"io"
+	"strings"
+	"video-handler/configs"
+
+	cmdCommand "video-handler/pkg"
+)
+
+const (
+	// remuxProfileName is the profile of the renditions remuxed without conversion
+	remuxProfileName string = "remux"
+)
+
+var (
+	// codecs by the names of ffprobe which are streamed without conversion
+	supportedCodecs = map[string]bool{"h264": true, "hevc": true, "vp8": true, "vp9": true}
+
+	// codecs by the names of ffprobe which the containers can hold without conversion
+	mp4VideoCodecs  = map[string]bool{"h264": true, "hevc": true, "vp9": true, "av1": true}
+	mp4AudioCodecs  = map[string]bool{"aac": true, "mp3": true, "opus": true, "ac3": true, "eac3": true, "alac": true, "flac": true}
+	webmVideoCodecs = map[string]bool{"vp8": true, "vp9": true, "av1": true}
+	webmAudioCodecs = map[string]bool{"opus": true, "vorbis": true}
+)
+
+// supportedCodec tells whether videoCodec, as named by ffprobe, is stored without conversion.
+func supportedCodec(videoCodec string) bool {
+	return supportedCodecs[strings.ToLower(videoCodec)]
+}
+
+// hasFormat tells whether formats, the container names of ffprobe like "matroska,webm", have format.
+func hasFormat(formats, format string) bool {
+	for _, name := range strings.Split(formats, ",") {
+		if name == format {
+			return true
+		}
+	}
+	return false
+}
+
+// streamableContainer tells whether a video in a supported codec can be stored as is: its container
+// can be played and pushed while it's read. A MKV isn't, unless it's a WebM.
+func streamableContainer(probe cmdCommand.ProbeResult, video io.ReadSeeker) (bool, error) {
+	videoCodec := strings.ToLower(probe.VideoCodec)
+	audioCodec := strings.ToLower(probe.AudioCodec)
+
+	switch {
+	case hasFormat(probe.Formats, "mpegts"):
+		return true, nil
+	case hasFormat(probe.Formats, "mp4"):
+		return cmdCommand.Mp4FastStart(video)
+	case hasFormat(probe.Formats, "webm"):
+		return webmVideoCodecs[videoCodec] && (audioCodec == "" || webmAudioCodecs[audioCodec]), nil
+	}
+	return false, nil
+}
+
+// remuxProfile copies the video stream into a fragmented MP4, or into a WebM for codecs MP4 can't hold.
+// Only a sound the container can't hold is converted. ok is false when neither container fits.
+func remuxProfile(probe cmdCommand.ProbeResult) (profile configs.ConversionProfile, ok bool) {
+	videoCodec := strings.ToLower(probe.VideoCodec)
+	audioCodec := strings.ToLower(probe.AudioCodec)
+
+	profile = configs.ConversionProfile{VideoCodec: cmdCommand.CodecCopy, AudioCodec: cmdCommand.CodecCopy}
+	switch {
+	case mp4VideoCodecs[videoCodec]:
+		profile.Container = "mp4"
+		if audioCodec != "" && !mp4AudioCodecs[audioCodec] {
+			profile.AudioCodec = "aac"
+		}
+	case webmVideoCodecs[videoCodec]:
+		profile.Container = "webm"
+		if audioCodec != "" && !webmAudioCodecs[audioCodec] {
+			profile.AudioCodec = "libopus"
+		}
+	default:
+		return profile, false
+	}
+	return profile, true
+}
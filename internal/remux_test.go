@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"testing"
+	"video-handler/configs"
+
+	cmdCommand "video-handler/pkg"
+)
+
+func TestSupportedCodec(t *testing.T) {
+	tests := []struct {
+		codec string
+		want  bool
+	}{
+		{codec: "h264", want: true},
+		{codec: "H264", want: true},
+		{codec: "hevc", want: true},
+		{codec: "vp8", want: true},
+		{codec: "vp9", want: true},
+		// the names ffprobe doesn't use, and parts of the supported ones
+		{codec: "h265", want: false},
+		{codec: "264", want: false},
+		{codec: "h26", want: false},
+		{codec: "vp", want: false},
+		{codec: "", want: false},
+		{codec: "mpeg4", want: false},
+		{codec: "av1", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := supportedCodec(tt.codec); got != tt.want {
+			t.Errorf("supportedCodec(%q) = %v, want %v", tt.codec, got, tt.want)
+		}
+	}
+}
+
+func TestRemuxProfile(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe cmdCommand.ProbeResult
+		want  configs.ConversionProfile
+		ok    bool
+	}{
+		{
+			name:  "hevc in matroska",
+			probe: cmdCommand.ProbeResult{VideoCodec: "hevc", AudioCodec: "aac", Formats: "matroska,webm"},
+			want:  configs.ConversionProfile{VideoCodec: "copy", AudioCodec: "copy", Container: "mp4"},
+			ok:    true,
+		},
+		{
+			name:  "h264 with pcm in avi",
+			probe: cmdCommand.ProbeResult{VideoCodec: "h264", AudioCodec: "pcm_s16le", Formats: "avi"},
+			want:  configs.ConversionProfile{VideoCodec: "copy", AudioCodec: "aac", Container: "mp4"},
+			ok:    true,
+		},
+		{
+			name:  "vp8 with vorbis in avi",
+			probe: cmdCommand.ProbeResult{VideoCodec: "vp8", AudioCodec: "vorbis", Formats: "avi"},
+			want:  configs.ConversionProfile{VideoCodec: "copy", AudioCodec: "copy", Container: "webm"},
+			ok:    true,
+		},
+		{
+			name:  "vp8 with mp3",
+			probe: cmdCommand.ProbeResult{VideoCodec: "vp8", AudioCodec: "mp3", Formats: "avi"},
+			want:  configs.ConversionProfile{VideoCodec: "copy", AudioCodec: "libopus", Container: "webm"},
+			ok:    true,
+		},
+		{
+			name:  "mpeg4",
+			probe: cmdCommand.ProbeResult{VideoCodec: "mpeg4", Formats: "avi"},
+			ok:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := remuxProfile(tt.probe)
+			if ok != tt.ok || (ok && got != tt.want) {
+				t.Errorf("remuxProfile = %+v, %v, want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
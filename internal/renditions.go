@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"video-handler/configs"
+	"video-handler/external/auth"
+	"video-handler/internal/metrics"
+	"video-handler/internal/tracing"
+
+	cmdCommand "video-handler/pkg"
+
+	"github.com/minio/minio-go/v7"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErrRenditionConflict refuses a conversion whose rendition would replace another video.
+var ErrRenditionConflict = errors.New("the rendition would replace another video")
+
+const (
+	// converted uploads are kept as is under originals/, to be converted again later
+	originalsPrefix string = "originals/"
+
+	// name of the original of a rendition
+	metadataOriginal string = "original"
+	// duration of an original, in seconds
+	metadataDuration string = "duration"
+)
+
+// containerFormat is the file extension and the content type of the output of a container.
+type containerFormat struct {
+	extension   string
+	contentType string
+}
+
+var containerFormats = map[string]containerFormat{
+	"mpegts":   {".ts", "video/mp2t"},
+	"mp4":      {".mp4", "video/mp4"},
+	"matroska": {".mkv", "video/x-matroska"},
+	"webm":     {".webm", "video/webm"},
+}
+
+func profileFormat(profile configs.ConversionProfile) containerFormat {
+	if format, ok := containerFormats[profile.Container]; ok {
+		return format
+	}
+	return containerFormats["mpegts"]
+}
+
+// renditionName derives the name of the rendition of a video with a profile, like movie.720p.mp4,
+// the names of the default profile and of remuxes are left out.
+func renditionName(videoName, profileName string, profile configs.ConversionProfile) string {
+	name := strings.TrimSuffix(path.Base(videoName), path.Ext(videoName))
+	if profileName != configs.DefaultProfileName && profileName != remuxProfileName {
+		name += "." + profileName
+	}
+	return name + profileFormat(profile).extension
+}
+
+// checkRendition refuses to write the rendition videoName of originalName over another video: its
+// original, a video stored as is or the rendition of another original with the same base name, like
+// movie.avi and movie.mkv which both become movie.ts.
+func (service *VideoService) checkRendition(ctx context.Context, identity *auth.Identity, videoName, originalName string) error {
+	if videoName == originalName {
+		return fmt.Errorf("%w: %s is its original", ErrRenditionConflict, videoName)
+	}
+
+	location := service.tenants.locate(identity, videoName)
+	ctx, end := startStorage(ctx, "stat", location.bucket, location.key)
+	info, err := service.MinioClient.StatObject(ctx, location.bucket, location.key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			end(nil)
+			return nil
+		}
+		end(err)
+		return err
+	}
+	end(nil)
+
+	if metadataValue(info.UserMetadata, metadataOriginal) != originalName {
+		return fmt.Errorf("%w: %s already exists", ErrRenditionConflict, videoName)
+	}
+	return nil
+}
+
+// uploadContentType returns the content type of an uploaded file, from its header or its extension.
+func uploadContentType(videoInfo *multipart.FileHeader) string {
+	if contentType := videoInfo.Header.Get("Content-Type"); contentType != "" && contentType != "application/octet-stream" {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(path.Ext(videoInfo.Filename)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// storeOriginal keeps an upload which is converted under originals/ and returns its name.
+func (service *VideoService) storeOriginal(ctx context.Context, identity *auth.Identity, video multipart.File, videoInfo *multipart.FileHeader, shared bool, duration time.Duration) (string, error) {
+	originalName := originalsPrefix + videoInfo.Filename
+
+	metadata := map[string]string{}
+	if duration > 0 {
+		metadata[metadataDuration] = strconv.FormatFloat(duration.Seconds(), 'f', 3, 64)
+	}
+
+	video.Seek(0, 0)
+	_, err := service.uploadUserObject(ctx, identity, video, originalName, videoInfo.Size, shared, minio.PutObjectOptions{
+		ContentType:  uploadContentType(videoInfo),
+		UserMetadata: metadata,
+	})
+	return originalName, err
+}
+
+// TranscodeVideo converts the original of a video again with another profile, into a new rendition.
+// A video stored as is is its own original.
+func (service *VideoService) TranscodeVideo(ctx context.Context, identity *auth.Identity, videoName, profileName string) (*Job, error) {
+	_, info, err := service.statUserVideo(ctx, identity, videoName)
+	if err != nil {
+		return nil, err
+	}
+	if !canModify(identity, info) {
+		return nil, ErrForbidden
+	}
+
+	originalName := videoName
+	original := info
+	if name := metadataValue(info.UserMetadata, metadataOriginal); name != "" {
+		originalName = name
+		if _, original, err = service.statUserVideo(ctx, identity, originalName); err != nil {
+			return nil, fmt.Errorf("original %s: %w", originalName, err)
+		}
+	}
+
+	profileName, profile, err := service.conversionProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := service.limits.acquire(limitConversions, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	seconds, _ := strconv.ParseFloat(metadataValue(original.UserMetadata, metadataDuration), 64)
+	shared := metadataValue(original.UserMetadata, metadataShared) == "true"
+	return service.startConversion(ctx, identity, originalName, shared, profileName, profile, time.Duration(seconds*float64(time.Second)), release)
+}
+
+// startConversion converts an original in the background into its rendition with profile, and
+// returns the job of the conversion. release frees the conversion limit once it's done.
+func (service *VideoService) startConversion(ctx context.Context, identity *auth.Identity, originalName string, shared bool, profileName string, profile configs.ConversionProfile, duration time.Duration, release func()) (*Job, error) {
+	videoName := renditionName(strings.TrimPrefix(originalName, originalsPrefix), profileName, profile)
+	if err := service.checkRendition(ctx, identity, videoName, originalName); err != nil {
+		release()
+		return nil, err
+	}
+
+	job, jobCtx, err := service.jobs.start(JobConversion, identity, videoName)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	started := *job
+
+	// the conversion outlives the request, but stays in its trace
+	convertCtx, convertSpan := tracing.Start(tracing.Detach(ctx, jobCtx), "convert video",
+		attribute.String("job.id", job.ID),
+		attribute.String("video.name", videoName),
+		attribute.String("video.original", originalName),
+		attribute.String("video.output_codec", profile.VideoCodec),
+		attribute.String("conversion.profile", profileName),
+	)
+
+	errChan := make(chan error)
+	go func() {
+		defer close(errChan)
+		defer release()
+		start := time.Now()
+
+		// ffmpeg reads the original with range requests, a MP4 may have its index at the end
+		originalUrl, err := service.presignUserVideo(convertCtx, identity, originalName)
+		if err != nil {
+			errChan <- err
+			return
+		}
+
+		outputVideo, err := service.ConvertVideoCodec(convertCtx, originalUrl.String(), profile, func(progress cmdCommand.Progress) {
+			service.jobs.progress(job, newJobProgress(progress, duration))
+		})
+		if err != nil {
+			service.Logger.ErrorContext(convertCtx, ErrorExecutingFfmpegCommand, "err", err.Error())
+			errChan <- err
+			return
+		}
+
+		uploadInfo, err := service.UploadVideo(convertCtx, identity, outputVideo, videoName, profileFormat(profile).contentType, shared, map[string]string{
+			metadataProfile:  profileName,
+			metadataOriginal: originalName,
+		})
+		if err != nil {
+			errChan <- err
+			return
+		}
+
+		metrics.ConversionDuration.Observe(time.Since(start).Seconds())
+		service.Logger.InfoContext(convertCtx, "video uploaded successfully", "video_name", uploadInfo.Key, "video_size", uploadInfo.Size, "original", originalName)
+
+		errChan <- nil
+	}()
+
+	go func() {
+		err := <-errChan
+		if err != nil {
+			metrics.ConversionFailures.Inc()
+			service.Logger.ErrorContext(convertCtx, "error converting video", "job_id", job.ID, "err", err.Error())
+		}
+		service.jobs.finish(job, err)
+		tracing.End(convertSpan, err)
+	}()
+
+	return &started, nil
+}
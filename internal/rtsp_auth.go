@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"video-handler/external/auth"
+	"video-handler/internal/rtspserver"
+)
+
+// rtspCredentials are generated for each stream and let the internal pusher and readers use Digest authentication.
+type rtspCredentials struct {
+	user string
+	pass string
+}
+
+func newRtspCredentials(user string) (rtspCredentials, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return rtspCredentials{}, err
+	}
+	return rtspCredentials{user: user, pass: hex.EncodeToString(random)}, nil
+}
+
+// withCredentials returns rtspUrl with the credentials as user info, as expected by ffmpeg and gortsplib clients.
+func (c rtspCredentials) withCredentials(rtspUrl string) string {
+	u, err := url.Parse(rtspUrl)
+	if err != nil {
+		return rtspUrl
+	}
+	u.User = url.UserPassword(c.user, c.pass)
+	return u.String()
+}
+
+// redactUrl hides the password of rtspUrl for logging.
+func redactUrl(rtspUrl string) string {
+	u, err := url.Parse(rtspUrl)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+// streamAuthorizer gives access to the RTSP server of a stream.
+// The internal credentials are accepted with Basic and Digest authentication, other users authenticate
+// with Basic credentials made of their username and a session token issued by the HTTP API,
+// or of any user name and a playback token.
+type streamAuthorizer struct {
+	stream       *videoStream
+	authService  auth.Authentificatior
+	videoService *VideoService
+	roles        []string
+}
+
+func (sa *streamAuthorizer) Secret(user string, action rtspserver.Action, path string) (string, bool) {
+	if user == sa.stream.publisher.user {
+		return sa.stream.publisher.pass, true
+	}
+	if user == sa.stream.reader.user && action == rtspserver.ActionRead {
+		return sa.stream.reader.pass, true
+	}
+	return "", false
+}
+
+func (sa *streamAuthorizer) Authorize(user, pass string, action rtspserver.Action, path string, ip net.IP) error {
+	if secret, ok := sa.Secret(user, action, path); ok {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(pass)) != 1 {
+			return auth.ErrInvalidCredentials
+		}
+		return nil
+	}
+
+	// playback tokens only allow reading, whatever the user name
+	if action == rtspserver.ActionRead {
+		if grant, err := sa.authService.VerifyPlaybackToken(pass); err == nil {
+			return checkPlaybackGrant(sa.videoService.Context, sa.videoService, grant, sa.stream, ip)
+		}
+	}
+
+	identity, err := sa.authService.VerifySessionToken(sa.videoService.Context, pass)
+	if err != nil {
+		return err
+	}
+	if user != identity.Username && user != identity.UserID {
+		return auth.ErrInvalidCredentials
+	}
+
+	switch action {
+	case rtspserver.ActionPublish:
+		owner := sa.stream.Owner
+		if !isAdmin(identity) && (owner == nil || owner.UserID != identity.UserID) {
+			return ErrForbidden
+		}
+		if !(auth.Policy{Roles: sa.roles, Scope: auth.ScopeStreamsPublish}).Allows(identity) {
+			return ErrForbidden
+		}
+		return nil
+
+	default:
+		return sa.videoService.CanReadStream(sa.videoService.Context, identity, sa.stream)
+	}
+}
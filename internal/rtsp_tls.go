@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+
+	cmdCommand "video-handler/pkg"
+)
+
+// rtspTLS holds the TLS configurations of the RTSP servers and of the internal readers.
+// With TLS the RTP packets are interleaved in the encrypted RTSP connection, UDP transports are disabled.
+type rtspTLS struct {
+	server *tls.Config
+	client *tls.Config
+}
+
+// loadRtspTLS returns nil when no certificate is configured.
+// The internal readers trust caFile, or the certificate itself when it's self-signed and caFile is empty.
+func loadRtspTLS(certFile, keyFile, caFile string) (*rtspTLS, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if caFile == "" {
+		caFile = certFile
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificate found in " + caFile)
+	}
+
+	return &rtspTLS{
+		server: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+		client: &tls.Config{
+			RootCAs:    roots,
+			MinVersion: tls.VersionTLS12,
+		},
+	}, nil
+}
+
+func (rt *rtspTLS) serverConfig() *tls.Config {
+	if rt == nil {
+		return nil
+	}
+	return rt.server
+}
+
+// clientConfig returns a copy for each client, gortsplib sets the server name on it.
+func (rt *rtspTLS) clientConfig() *tls.Config {
+	if rt == nil {
+		return nil
+	}
+	return rt.client.Clone()
+}
+
+// urlPattern switches the scheme of the stream urls to rtsps when TLS is enabled.
+func (rt *rtspTLS) urlPattern(pattern string) string {
+	if rt == nil {
+		return pattern
+	}
+	return strings.Replace(pattern, "rtsp://", "rtsps://", 1)
+}
+
+// rtspOutput is the ffmpeg output publishing to streamAddress, rtsps only works over TCP.
+func rtspOutput(protocol, streamAddress string) cmdCommand.FfmpegOutput {
+	output := cmdCommand.FfmpegOutput{
+		Url:    streamAddress,
+		Format: protocol,
+	}
+	if strings.HasPrefix(streamAddress, "rtsps://") {
+		output.Options = []cmdCommand.FfmpegOption{{Name: "rtsp_transport", Value: "tcp"}}
+	}
+	return output
+}
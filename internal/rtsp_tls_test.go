@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+	"video-handler/internal/rtspserver"
+
+	cmdCommand "video-handler/pkg"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/pion/rtp"
+)
+
+// writeSelfSignedCert writes a certificate for localhost signed by its own key, and the key, in PEM.
+func writeSelfSignedCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestRtspsPublishAndRead(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t)
+	rtspTLS, err := loadRtspTLS(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	port, err := findFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := rtspserver.ConfigureRtspServer(":"+strconv.Itoa(port), nil, rtspTLS.serverConfig(), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	streamUrl := fmt.Sprintf("%s:%d/stream", rtspTLS.urlPattern("rtsp://localhost"), port)
+	if streamUrl != fmt.Sprintf("rtsps://localhost:%d/stream", port) {
+		t.Fatalf("the stream url is %s, want rtsps", streamUrl)
+	}
+
+	// the publisher trusts the self-signed certificate like the pushers do
+	publisher := &fakeTranscoder{Frames: 10 * fakeFrameRate, TLSConfig: rtspTLS.clientConfig()}
+	published := make(chan error, 1)
+	go func() {
+		_, err := publisher.Push(ctx, cmdCommand.Ffmpeg{
+			Inputs:  []cmdCommand.FfmpegInput{{Url: "movie.mp4", Realtime: true}},
+			Outputs: []cmdCommand.FfmpegOutput{rtspOutput("rtsp", streamUrl)},
+		}, nil)
+		published <- err
+	}()
+
+	if _, err := server.WaitForPublisher(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := base.ParseURL(streamUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader which doesn't trust the certificate can't connect
+	untrusted := gortsplib.Client{TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}}
+	if err := untrusted.Start(u.Scheme, u.Host); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := untrusted.Describe(u); err == nil {
+		t.Error("a reader without the certificate described the stream")
+	}
+	untrusted.Close()
+
+	transport := gortsplib.TransportTCP
+	reader := gortsplib.Client{TLSConfig: rtspTLS.clientConfig(), Transport: &transport}
+	if err := reader.Start(u.Scheme, u.Host); err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	desc, _, err := reader.Describe(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forma *format.H264
+	if desc.FindFormat(&forma) == nil {
+		t.Fatalf("the stream has no H264 media: %+v", desc.Medias)
+	}
+	if err := reader.SetupAll(desc.BaseURL, desc.Medias); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *rtp.Packet, 1)
+	reader.OnPacketRTPAny(func(medi *description.Media, forma format.Format, pkt *rtp.Packet) {
+		select {
+		case received <- pkt:
+		default:
+		}
+	})
+	if _, err := reader.Play(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pkt := <-received:
+		if pkt.PayloadType != fakePayloadTyp {
+			t.Errorf("received the payload type %d, want %d", pkt.PayloadType, fakePayloadTyp)
+		}
+	case err := <-published:
+		t.Fatalf("the publisher stopped before a packet was read: %v", err)
+	case <-ctx.Done():
+		t.Fatal("no packet received from the stream")
+	}
+
+	commands := publisher.Commands()
+	if len(commands) != 1 || commands[0].Outputs[0].Options[0].Name != "rtsp_transport" {
+		t.Errorf("the publisher doesn't force TCP: %+v", commands)
+	}
+}
@@ -0,0 +1,98 @@
+package rtspserver
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/url"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/auth"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/headers"
+)
+
+const (
+	authRealm string = "video-handler"
+)
+
+var errUnknownUser = errors.New("unknown user")
+
+// Action is what a client asks to do on a path.
+type Action string
+
+const (
+	ActionPublish Action = "publish"
+	ActionRead    Action = "read"
+)
+
+// Authorizer validates the credentials of RTSP clients.
+type Authorizer interface {
+	// Secret returns the password of user allowed to do action on path, used to check Digest responses.
+	// ok is false when the user has no shared secret and must use Basic authentication.
+	Secret(user string, action Action, path string) (pass string, ok bool)
+	// Authorize checks Basic credentials of user for action on path, sent from ip, or a token of the
+	// query without user.
+	Authorize(user, pass string, action Action, path string, ip net.IP) error
+}
+
+// authenticate returns nil when the request is allowed, or the response to send otherwise.
+// Accepted users are stored in the connection, see connUser.
+func (sh *serverHandler) authenticate(conn *gortsplib.ServerConn, req *base.Request, action Action, path, query string) *base.Response {
+	if sh.authorizer == nil {
+		return nil
+	}
+
+	user, err := sh.validate(req, action, path, query, remoteIP(conn.NetConn().RemoteAddr()))
+	if err != nil {
+		if req.Header["Authorization"] != nil {
+			log.Printf("%s rejected on %s: %v", action, path, err)
+		}
+		return &base.Response{
+			StatusCode: base.StatusUnauthorized,
+			Header: base.Header{
+				"WWW-Authenticate": auth.GenerateWWWAuthenticate(nil, authRealm, sh.nonce),
+			},
+		}
+	}
+
+	conn.SetUserData(user)
+	return nil
+}
+
+func (sh *serverHandler) validate(req *base.Request, action Action, path, query string, ip net.IP) (string, error) {
+	// clients like ffmpeg answer the challenge with Digest, which can't carry a token, they send it in ?token=
+	if req.Header["Authorization"] == nil {
+		if values, err := url.ParseQuery(query); err == nil && values.Get("token") != "" {
+			return "", sh.authorizer.Authorize("", values.Get("token"), action, path, ip)
+		}
+	}
+
+	var authorization headers.Authorization
+	err := authorization.Unmarshal(req.Header["Authorization"])
+	if err != nil {
+		return "", err
+	}
+
+	if authorization.Method == headers.AuthMethodBasic {
+		return authorization.BasicUser, sh.authorizer.Authorize(authorization.BasicUser, authorization.BasicPass, action, path, ip)
+	}
+
+	pass, ok := sh.authorizer.Secret(authorization.Username, action, path)
+	if !ok {
+		return "", errUnknownUser
+	}
+	return authorization.Username, auth.Validate(req, authorization.Username, pass, nil, authRealm, sh.nonce)
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
+func connUser(conn *gortsplib.ServerConn) string {
+	user, _ := conn.UserData().(string)
+	return user
+}
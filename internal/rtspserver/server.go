@@ -2,12 +2,17 @@ package rtspserver
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
 	"sync"
+	"time"
+
+	"video-handler/internal/metrics"
 
 	"github.com/pion/rtp"
 
 	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/auth"
 	"github.com/bluenviron/gortsplib/v4/pkg/base"
 	"github.com/bluenviron/gortsplib/v4/pkg/description"
 	"github.com/bluenviron/gortsplib/v4/pkg/format"
@@ -16,13 +21,91 @@ import (
 // 1. create a RTSP server which accepts plain connections
 // 2. allow a single client to publish a stream with TCP or UDP
 // 3. allow multiple clients to read that stream with TCP, UDP or UDP-multicast
+// 4. when a TLS configuration is set, serve rtsps:// with RTP interleaved in the encrypted connection
+// 5. when an Authorizer is set, require Basic or Digest credentials to publish and read
+
+// PacketHandler is called with every RTP packet received from the publisher.
+type PacketHandler func(medi *description.Media, forma format.Format, pkt *rtp.Packet, pts time.Duration)
+
+// PublishHandler is called with the description of the stream when a publisher starts recording,
+// a publisher which announces the stream again comes with new medias.
+type PublishHandler func(desc *description.Session)
+
+// Server wraps gortsplib.Server and gives access to the published stream.
+type Server struct {
+	*gortsplib.Server
+	h *serverHandler
+}
+
+// Description returns the description of the published stream, or nil if no one is publishing.
+func (s *Server) Description() *description.Session {
+	s.h.mutex.Lock()
+	defer s.h.mutex.Unlock()
+
+	if s.h.stream == nil {
+		return nil
+	}
+	return s.h.stream.Description()
+}
+
+// WaitForPublisher blocks until a client starts publishing and returns the description of its stream.
+func (s *Server) WaitForPublisher(ctx context.Context) (*description.Session, error) {
+	select {
+	case <-s.h.published:
+		return s.Description(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// AddPacketHandler registers a handler that receives the packets of the published stream.
+func (s *Server) AddPacketHandler(id string, handler PacketHandler) {
+	s.h.handlersMutex.Lock()
+	defer s.h.handlersMutex.Unlock()
+
+	s.h.handlers[id] = handler
+}
+
+// RemovePacketHandler unregisters the handler added with the given id.
+func (s *Server) RemovePacketHandler(id string) {
+	s.h.handlersMutex.Lock()
+	defer s.h.handlersMutex.Unlock()
+
+	delete(s.h.handlers, id)
+}
+
+// AddPublishHandler registers a handler that is called every time a publisher starts recording.
+func (s *Server) AddPublishHandler(id string, handler PublishHandler) {
+	s.h.handlersMutex.Lock()
+	defer s.h.handlersMutex.Unlock()
+
+	s.h.publishHandlers[id] = handler
+}
+
+// RemovePublishHandler unregisters the handler added with the given id.
+func (s *Server) RemovePublishHandler(id string) {
+	s.h.handlersMutex.Lock()
+	defer s.h.handlersMutex.Unlock()
+
+	delete(s.h.publishHandlers, id)
+}
 
 type serverHandler struct {
-	s         *gortsplib.Server
-	mutex     sync.Mutex
-	stream    *gortsplib.ServerStream
-	publisher *gortsplib.ServerSession
-	ctx       context.Context
+	s             *gortsplib.Server
+	mutex         sync.Mutex
+	stream        *gortsplib.ServerStream
+	publisher     *gortsplib.ServerSession
+	publisherUser string
+	authorizer    Authorizer
+	nonce         string
+	handlersMutex sync.RWMutex
+	handlers      map[string]PacketHandler
+	// closed when the session of a publisher ends, to stop the forwarding of its packets
+	sessionsDone    map[*gortsplib.ServerSession]chan struct{}
+	publishHandlers map[string]PublishHandler
+	published       chan struct{}
+	publishedOnce   sync.Once
+	ctx             context.Context
 }
 
 // called when a connection is opened.
@@ -67,6 +150,11 @@ func (sh *serverHandler) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionClo
 	sh.mutex.Lock()
 	defer sh.mutex.Unlock()
 
+	if done, ok := sh.sessionsDone[ctx.Session]; ok {
+		close(done)
+		delete(sh.sessionsDone, ctx.Session)
+	}
+
 	// if the session is the publisher,
 	// close the stream and disconnect any reader.
 	if sh.stream != nil && ctx.Session == sh.publisher {
@@ -84,6 +172,10 @@ func (sh *serverHandler) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (
 		log.Printf("describe request")
 	}
 
+	if res := sh.authenticate(ctx.Conn, ctx.Request, ActionRead, ctx.Path, ctx.Query); res != nil {
+		return res, nil, nil
+	}
+
 	sh.mutex.Lock()
 	defer sh.mutex.Unlock()
 
@@ -109,11 +201,21 @@ func (sh *serverHandler) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (
 		log.Printf("announce request")
 	}
 
+	if res := sh.authenticate(ctx.Conn, ctx.Request, ActionPublish, ctx.Path, ctx.Query); res != nil {
+		return res, nil
+	}
+
 	sh.mutex.Lock()
 	defer sh.mutex.Unlock()
 
-	// disconnect existing publisher
+	// only the same user may take over the stream, e.g. a reconnecting pusher
 	if sh.stream != nil {
+		if connUser(ctx.Conn) != sh.publisherUser {
+			return &base.Response{
+				StatusCode: base.StatusForbidden,
+			}, nil
+		}
+
 		sh.stream.Close()
 		sh.publisher.Close()
 	}
@@ -121,6 +223,8 @@ func (sh *serverHandler) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (
 	// create the stream and save the publisher
 	sh.stream = gortsplib.NewServerStream(sh.s, ctx.Description)
 	sh.publisher = ctx.Session
+	sh.publisherUser = connUser(ctx.Conn)
+	sh.publishedOnce.Do(func() { close(sh.published) })
 
 	return &base.Response{
 		StatusCode: base.StatusOK,
@@ -136,6 +240,21 @@ func (sh *serverHandler) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.
 		log.Printf("setup request")
 	}
 
+	// the publisher sets up the medias it announced
+	action := ActionRead
+	if ctx.Session.State() == gortsplib.ServerSessionStatePreRecord {
+		action = ActionPublish
+	}
+	if res := sh.authenticate(ctx.Conn, ctx.Request, action, ctx.Path, ctx.Query); res != nil {
+		return res, nil, nil
+	}
+
+	if action == ActionPublish {
+		return &base.Response{
+			StatusCode: base.StatusOK,
+		}, nil, nil
+	}
+
 	// no one is publishing yet
 	if sh.stream == nil {
 		return &base.Response{
@@ -172,29 +291,60 @@ func (sh *serverHandler) OnRecord(ctx *gortsplib.ServerHandlerOnRecordCtx) (*bas
 	}
 
 	type pktAndMedi struct {
-		medi *description.Media
-		pkt  *rtp.Packet
+		medi  *description.Media
+		forma format.Format
+		pkt   *rtp.Packet
+		pts   time.Duration
+	}
+
+	// the stream of this publisher, a restarted publisher gets a new one
+	done := make(chan struct{})
+	sh.mutex.Lock()
+	stream := sh.stream
+	sh.sessionsDone[ctx.Session] = done
+	sh.mutex.Unlock()
+
+	sh.handlersMutex.RLock()
+	for _, handler := range sh.publishHandlers {
+		handler(stream.Description())
 	}
+	sh.handlersMutex.RUnlock()
 
 	pktPool := make(chan pktAndMedi, 100)
 	// called when receiving a RTP packet
 	ctx.Session.OnPacketRTPAny(func(medi *description.Media, forma format.Format, pkt *rtp.Packet) {
+		pts, _ := ctx.Session.PacketPTS(medi, pkt)
+
 		// route the RTP packet to all readers
 		select {
 		case pktPool <- pktAndMedi{
-			medi: medi,
-			pkt:  pkt,
+			medi:  medi,
+			forma: forma,
+			pkt:   pkt,
+			pts:   pts,
 		}:
 			//success
 		default:
+			metrics.PacketsDropped.WithLabelValues(metrics.PathRtspServer).Inc()
 			log.Println("Packet dropped due to full buffer")
 		}
 	})
 
 	go func() {
-		defer close(pktPool)
-		for pktAndMedi := range pktPool {
-			sh.stream.WritePacketRTP(pktAndMedi.medi, pktAndMedi.pkt)
+		for {
+			select {
+			case pktAndMedi := <-pktPool:
+				stream.WritePacketRTP(pktAndMedi.medi, pktAndMedi.pkt)
+				metrics.PacketsForwarded.WithLabelValues(metrics.PathRtspServer).Inc()
+
+				sh.handlersMutex.RLock()
+				for _, handler := range sh.handlers {
+					handler(pktAndMedi.medi, pktAndMedi.forma, pktAndMedi.pkt, pktAndMedi.pts)
+				}
+				sh.handlersMutex.RUnlock()
+			case <-done:
+				return
+			}
 		}
 	}()
 
@@ -203,6 +353,23 @@ func (sh *serverHandler) OnRecord(ctx *gortsplib.ServerHandlerOnRecordCtx) (*bas
 	}, nil
 }
 
+func newServerHandler(authorizer Authorizer, ctx context.Context) (*serverHandler, error) {
+	nonce, err := auth.GenerateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	return &serverHandler{
+		handlers:        map[string]PacketHandler{},
+		sessionsDone:    map[*gortsplib.ServerSession]chan struct{}{},
+		publishHandlers: map[string]PublishHandler{},
+		published:       make(chan struct{}),
+		authorizer:      authorizer,
+		nonce:           nonce,
+		ctx:             ctx,
+	}, nil
+}
+
 func ConfigureServer(
 	rtspAddress,
 	udpRtpAddress,
@@ -210,11 +377,14 @@ func ConfigureServer(
 	multicastIpRange string,
 	multicastRtpPort,
 	multicastRtcpPort int,
+	authorizer Authorizer,
+	tlsConfig *tls.Config,
 	ctx context.Context,
-) *gortsplib.Server {
+) (*Server, error) {
 
-	h := &serverHandler{
-		ctx: ctx,
+	h, err := newServerHandler(authorizer, ctx)
+	if err != nil {
+		return nil, err
 	}
 	h.s = &gortsplib.Server{
 		Handler:           h,
@@ -224,23 +394,28 @@ func ConfigureServer(
 		MulticastIPRange:  multicastIpRange,
 		MulticastRTPPort:  multicastRtpPort,
 		MulticastRTCPPort: multicastRtcpPort,
+		TLSConfig:         tlsConfig,
 	}
 
 	log.Printf("RTSP server is ready and running on port: " + rtspAddress)
 
-	return h.s
+	return &Server{Server: h.s, h: h}, nil
 }
 
-func ConfigureRtspServer(rtspAddress string, ctx context.Context) *gortsplib.Server {
-	h := &serverHandler{
-		ctx: ctx,
+// ConfigureRtspServer creates a server for a single stream, authorizer may be nil to accept any client
+// and tlsConfig nil to serve plain RTSP.
+func ConfigureRtspServer(rtspAddress string, authorizer Authorizer, tlsConfig *tls.Config, ctx context.Context) (*Server, error) {
+	h, err := newServerHandler(authorizer, ctx)
+	if err != nil {
+		return nil, err
 	}
 	h.s = &gortsplib.Server{
 		Handler:     h,
 		RTSPAddress: rtspAddress,
+		TLSConfig:   tlsConfig,
 	}
 
 	log.Printf("RTSP server is ready and running on port: " + rtspAddress)
 
-	return h.s
+	return &Server{Server: h.s, h: h}, nil
 }
@@ -2,66 +2,462 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"strconv"
 	"sync"
+	"time"
 	"video-handler/configs"
+	"video-handler/external/auth"
+	"video-handler/internal/metrics"
 	"video-handler/internal/rtspserver"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	publisherWaitTimeout = 30 * time.Second
 )
 
+type videoStream struct {
+	ID        string
+	VideoName string
+	RtspUrl   string
+	StartedAt time.Time
+	SourceID  string
+	Owner     *auth.Identity
+	server    *rtspserver.Server
+	publisher rtspCredentials
+	reader    rtspCredentials
+	recorder  *streamRecorder
+	dvr       *dvrBuffer
+	// ended is set once endStream released the stream, under streamsLock
+	ended bool
+
+	stateMutex sync.Mutex
+	state      streamState
+}
+
+// publishUrl is the URL the internal pusher publishes to.
+func (stream *videoStream) publishUrl() string {
+	return stream.publisher.withCredentials(stream.RtspUrl)
+}
+
+// readUrl is the URL the internal readers play.
+func (stream *videoStream) readUrl() string {
+	return stream.reader.withCredentials(stream.RtspUrl)
+}
+
 type StreamerService struct {
 	VideoService *VideoService
+	AuthService  auth.Authentificatior
 	Envs         *configs.EnvVariables
 	Logger       *slog.Logger
 	Context      context.Context
-	CtxCancel    context.CancelFunc
+	streamsLock  sync.RWMutex
+	streams      map[string]*videoStream
+	rtspTLS      *rtspTLS
+	// pushers ends before the RTSP servers close, supervisors counts the goroutines running the pushers
+	pushers     context.Context
+	stopPushers context.CancelFunc
+	supervisors sync.WaitGroup
+	// onStateChange is called when the pusher of a stream starts, restarts or stops
+	onStateChange func(stream *videoStream)
 }
 
-func NewStreamerService(service *VideoService, envs *configs.EnvVariables, logger *slog.Logger, ctx context.Context, ctxCancel context.CancelFunc) *StreamerService {
+func NewStreamerService(service *VideoService, authService auth.Authentificatior, envs *configs.EnvVariables, logger *slog.Logger, ctx context.Context) (*StreamerService, error) {
+	rtspTLS, err := loadRtspTLS(envs.RtspTLSCert, envs.RtspTLSKey, envs.RtspTLSCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load RTSP TLS certificate: %w", err)
+	}
+
+	pushers, stopPushers := context.WithCancel(ctx)
 	return &StreamerService{
 		VideoService: service,
+		AuthService:  authService,
 		Envs:         envs,
 		Logger:       logger,
 		Context:      ctx,
-		CtxCancel:    ctxCancel,
-	}
+		streams:      map[string]*videoStream{},
+		rtspTLS:      rtspTLS,
+		pushers:      pushers,
+		stopPushers:  stopPushers,
+	}, nil
 }
 
-func (service *StreamerService) createVideoStream(videoName string) (string, error) {
+// newVideoStream configures the RTSP server of a new stream, protected by credentials generated for it.
+func (service *StreamerService) newVideoStream(identity *auth.Identity, videoName string) (*videoStream, error) {
 	freePort, err := findFreePort()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var wg sync.WaitGroup
+	stream := &videoStream{
+		ID:        uuid.New().String(),
+		VideoName: videoName,
+		RtspUrl:   fmt.Sprintf("%s:%d", service.rtspTLS.urlPattern(service.Envs.RtspStreamUrlPattern), freePort),
+		StartedAt: time.Now(),
+		Owner:     identity,
+		state:     streamState{State: StreamStarting},
+	}
+
+	stream.publisher, err = newRtspCredentials("publisher-" + stream.ID)
+	if err != nil {
+		return nil, err
+	}
+	stream.reader, err = newRtspCredentials("reader-" + stream.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	stream.server, err = rtspserver.ConfigureRtspServer(":"+strconv.Itoa(freePort), &streamAuthorizer{
+		stream:       stream,
+		authService:  service.AuthService,
+		videoService: service.VideoService,
+		roles:        service.Envs.PublisherRoles,
+	}, service.rtspTLS.serverConfig(), service.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (service *StreamerService) createVideoStream(ctx context.Context, identity *auth.Identity, videoName string) (*videoStream, error) {
+	release, err := service.VideoService.limits.acquire(limitStreams, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := service.newVideoStream(identity, videoName)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	if err := stream.server.Start(); err != nil {
+		release()
+		return nil, err
+	}
+
+	service.Logger.Debug("RTSP server configured and running", "RTSP_URL", stream.RtspUrl)
+
+	// listed before the pusher starts, which removes it when it stops
+	if err := service.addStream(stream); err != nil {
+		stream.server.Close()
+		release()
+		return nil, err
+	}
 
-	wg.Add(1)
 	go func() {
-		wg.Done()
-		rtspServer := rtspserver.ConfigureRtspServer(":"+strconv.Itoa(freePort), service.Context)
-		err := rtspServer.StartAndWait()
-		if err != nil {
-			service.CtxCancel()
-		}
+		defer service.supervisors.Done()
+		// the quota is held as long as the pusher runs
+		defer release()
+		metrics.ActiveStreams.Inc()
+		defer metrics.ActiveStreams.Dec()
+
+		service.superviseVideoPusher(ctx, identity, stream)
+		service.endStream(stream)
 	}()
 
-	rtspUrl := fmt.Sprintf("%s:%d", service.Envs.RtspStreamUrlPattern, freePort)
-	service.Logger.Debug("RTSP server configured and running", "RTSP_URL", rtspUrl)
+	if service.Envs.DvrWindow > 0 {
+		go service.startDvr(stream)
+	}
+
+	return stream, nil
+}
+
+// startDvr waits for the pusher to start publishing and keeps the last DvrWindow of the stream on disk.
+func (service *StreamerService) startDvr(stream *videoStream) {
+	ctx, cancel := context.WithTimeout(service.Context, publisherWaitTimeout)
+	defer cancel()
+
+	_, err := stream.server.WaitForPublisher(ctx)
+	if err != nil {
+		service.Logger.Error("stream was not published, DVR is disabled", "stream_id", stream.ID, "err", err.Error())
+		return
+	}
+
+	dvr, err := newDvrBuffer(stream.server, stream.ID, service.Envs.DvrDirectory, service.Envs.DvrWindow, service.Envs.RecordSegmentDuration, service.Logger)
+	if err != nil {
+		service.Logger.Error("failed to start DVR buffer", "stream_id", stream.ID, "err", err.Error())
+		return
+	}
+
+	service.streamsLock.Lock()
+	// the stream may have ended meanwhile
+	ended := stream.ended
+	if !ended {
+		stream.dvr = dvr
+	}
+	service.streamsLock.Unlock()
+
+	if ended {
+		dvr.close()
+	}
+}
+
+// endStream removes a stream once its pusher stopped for good and releases what it holds: a running
+// recording is saved, the DVR buffer closed, its time-shift streams play until its end, and the RTSP
+// server closed.
+func (service *StreamerService) endStream(stream *videoStream) {
+	service.streamsLock.Lock()
+	// Close and the pusher may both end the stream
+	if stream.ended {
+		service.streamsLock.Unlock()
+		return
+	}
+	stream.ended = true
+	delete(service.streams, stream.ID)
+	recorder := stream.recorder
+	stream.recorder = nil
+	dvr := stream.dvr
+	stream.dvr = nil
+	service.streamsLock.Unlock()
+
+	if recorder != nil {
+		if _, err := recorder.stop(recordingVideoName(stream.VideoName, recorder.StartedAt)); err != nil {
+			service.Logger.Error("failed to save recording", "stream_id", stream.ID, "recording_id", recorder.ID, "err", err.Error())
+		}
+	}
+	if dvr != nil {
+		dvr.close()
+	}
+	stream.server.Close()
+}
+
+func (service *StreamerService) getDvr(streamID string) (*dvrBuffer, error) {
+	stream, err := service.getStream(streamID)
+	if err != nil {
+		return nil, err
+	}
+
+	service.streamsLock.RLock()
+	defer service.streamsLock.RUnlock()
+
+	if stream.dvr == nil {
+		return nil, fmt.Errorf("DVR is not enabled for stream %s", streamID)
+	}
+	return stream.dvr, nil
+}
+
+// createTimeShiftStream starts a new stream which plays the source stream from offset ago
+// and catches up with the live edge by reading the DVR buffer faster than realtime.
+// identity must be allowed to watch the source stream.
+func (service *StreamerService) createTimeShiftStream(ctx context.Context, identity *auth.Identity, sourceID string, offset time.Duration) (*videoStream, error) {
+	source, err := service.getStream(sourceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := service.VideoService.CanReadStream(ctx, identity, source); err != nil {
+		return nil, err
+	}
+
+	dvr, err := service.getDvr(sourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	seq, err := dvr.seekSegment(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := service.VideoService.limits.acquire(limitStreams, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := service.newVideoStream(identity, source.VideoName)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	stream.SourceID = source.ID
+
+	if err := stream.server.Start(); err != nil {
+		release()
+		return nil, err
+	}
+
+	if err := service.addStream(stream); err != nil {
+		stream.server.Close()
+		release()
+		return nil, err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	// the reader stops with the pusher, even while it waits for the live edge
+	readerCtx, stopReader := context.WithCancel(service.pushers)
 
-	wg.Add(1)
 	go func() {
-		wg.Done()
-		err = service.VideoService.streamVideoToServer(videoName, rtspUrl)
+		err := dvr.timeShift(readerCtx, seq, pipeWriter)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) && !errors.Is(err, context.Canceled) {
+			service.Logger.Error("time-shift reader stopped", "stream_id", stream.ID, "err", err.Error())
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	go func() {
+		defer service.supervisors.Done()
+		defer service.endStream(stream)
+		defer release()
+		defer stopReader()
+		defer pipeReader.Close()
+		metrics.ActiveStreams.Inc()
+		defer metrics.ActiveStreams.Dec()
+
+		// the DVR buffer can't be replayed, a time-shift pusher isn't restarted
+		service.updateState(stream, streamState{State: StreamRunning})
+		_, err := service.VideoService.StreamTimeShiftAsRTSP(pipeReader, service.Envs.FfmpegProtocol, stream.publishUrl(), service.Envs.DvrCatchUpRate)
 		if err != nil {
-			service.CtxCancel()
+			service.Logger.Error("time-shift pusher stopped", "stream_id", stream.ID, "err", err.Error())
+			service.updateState(stream, streamState{State: StreamFailed, Error: err.Error()})
+			return
 		}
+		service.updateState(stream, streamState{State: StreamEnded})
 	}()
 
-	wg.Wait()
+	service.Logger.Debug("time-shift stream started", "stream_id", stream.ID, "source_id", source.ID, "offset", offset.String())
+	return stream, nil
+}
+
+func (service *StreamerService) getStream(streamID string) (*videoStream, error) {
+	service.streamsLock.RLock()
+	defer service.streamsLock.RUnlock()
+
+	stream, ok := service.streams[streamID]
+	if !ok {
+		return nil, fmt.Errorf("stream %s not found", streamID)
+	}
+	return stream, nil
+}
+
+// listStreams lists the streams identity may watch.
+func (service *StreamerService) listStreams(ctx context.Context, identity *auth.Identity) []StreamInfo {
+	service.streamsLock.RLock()
+	all := make([]*videoStream, 0, len(service.streams))
+	for _, stream := range service.streams {
+		all = append(all, stream)
+	}
+	service.streamsLock.RUnlock()
+
+	streams := make([]StreamInfo, 0, len(all))
+	for _, stream := range all {
+		if service.VideoService.CanReadStream(ctx, identity, stream) != nil {
+			continue
+		}
+		streams = append(streams, service.streamInfo(stream))
+	}
+	return streams
+}
+
+// streamInfo describes stream, its recorder and DVR are read under streamsLock since they change
+// while it runs.
+func (service *StreamerService) streamInfo(stream *videoStream) StreamInfo {
+	service.streamsLock.RLock()
+	recording := stream.recorder != nil
+	dvr := stream.dvr != nil
+	service.streamsLock.RUnlock()
+
+	state := stream.currentState()
+	return StreamInfo{
+		ID:        stream.ID,
+		VideoName: stream.VideoName,
+		RtspUrl:   stream.RtspUrl,
+		StartedAt: stream.StartedAt,
+		Recording: recording,
+		Dvr:       dvr,
+		SourceID:  stream.SourceID,
+		State:     state.State,
+		Restarts:  state.Restarts,
+		Error:     state.Error,
+	}
+}
+
+// startRecording starts writing the stream into segments stored in the bucket, which is allowed
+// to the owner of the stream and to admins only.
+func (service *StreamerService) startRecording(identity *auth.Identity, streamID string) (RecordingInfo, error) {
+	stream, err := service.getStream(streamID)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	if !canModifyStream(identity, stream) {
+		return RecordingInfo{}, ErrForbidden
+	}
+
+	service.streamsLock.Lock()
+	defer service.streamsLock.Unlock()
+
+	if stream.recorder != nil {
+		return RecordingInfo{}, fmt.Errorf("stream %s is already being recorded", streamID)
+	}
+
+	recorder, err := newStreamRecorder(service.VideoService, stream.server, stream.ID, stream.Owner, service.Envs.RecordSegmentDuration)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	stream.recorder = recorder
+
+	return recorder.info(), nil
+}
+
+// stopRecording stops the recording and stores it as a new video of the owner of the stream.
+func (service *StreamerService) stopRecording(identity *auth.Identity, streamID string) (minio.UploadInfo, error) {
+	stream, err := service.getStream(streamID)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	if !canModifyStream(identity, stream) {
+		return minio.UploadInfo{}, ErrForbidden
+	}
 
-	return rtspUrl, nil
+	service.streamsLock.Lock()
+	recorder := stream.recorder
+	stream.recorder = nil
+	service.streamsLock.Unlock()
+
+	if recorder == nil {
+		return minio.UploadInfo{}, fmt.Errorf("stream %s is not being recorded", streamID)
+	}
+
+	return recorder.stop(recordingVideoName(stream.VideoName, recorder.StartedAt))
+}
+
+// Close saves the running recordings and closes the RTSP servers of all streams.
+// Close stops the pushers and waits for them to end their streams, which saves the recordings, before
+// the RTSP servers close: a pusher mustn't be restarted against a closed server.
+func (service *StreamerService) Close() {
+	service.streamsLock.Lock()
+	service.stopPushers()
+	service.streamsLock.Unlock()
+	service.supervisors.Wait()
+
+	service.streamsLock.Lock()
+	streams := service.streams
+	service.streams = map[string]*videoStream{}
+	service.streamsLock.Unlock()
+
+	for _, stream := range streams {
+		service.endStream(stream)
+	}
+}
+
+// addStream lists a stream whose pusher is about to start, unless the service is closing.
+func (service *StreamerService) addStream(stream *videoStream) error {
+	service.streamsLock.Lock()
+	defer service.streamsLock.Unlock()
+
+	if service.pushers.Err() != nil {
+		return ErrShuttingDown
+	}
+	service.streams[stream.ID] = stream
+	service.supervisors.Add(1)
+	return nil
 }
 
 func findFreePort() (int, error) {
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"video-handler/external/auth"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	TenantIsolationNone   string = ""
+	TenantIsolationPrefix string = "prefix"
+	TenantIsolationBucket string = "bucket"
+
+	tenantsPrefix string = "tenants/"
+
+	metadataOwner     string = "owner"
+	metadataOwnerName string = "owner-name"
+	metadataTenant    string = "tenant"
+	metadataShared    string = "shared"
+	// conversion profile of a rendition
+	metadataProfile string = "profile"
+)
+
+var (
+	ErrVideoNotFound = errors.New("video not found")
+	ErrForbidden     = errors.New("access denied")
+)
+
+// videoLocation is where a video of a tenant is stored.
+type videoLocation struct {
+	bucket string
+	key    string
+}
+
+// tenantStorage resolves the bucket and the key prefix of the tenant of an identity.
+type tenantStorage struct {
+	isolation      string
+	defaultBucket  string
+	bucketPrefix   string
+	createdBuckets sync.Map
+}
+
+func (ts *tenantStorage) bucket(identity *auth.Identity) string {
+	if ts.isolation == TenantIsolationBucket && identity != nil && identity.Tenant != "" {
+		return ts.bucketPrefix + strings.ToLower(identity.Tenant)
+	}
+	return ts.defaultBucket
+}
+
+func (ts *tenantStorage) prefix(identity *auth.Identity) string {
+	if ts.isolation == TenantIsolationPrefix && identity != nil && identity.Tenant != "" {
+		return tenantsPrefix + identity.Tenant + "/"
+	}
+	return ""
+}
+
+func (ts *tenantStorage) locate(identity *auth.Identity, videoName string) videoLocation {
+	return videoLocation{
+		bucket: ts.bucket(identity),
+		key:    ts.prefix(identity) + videoName,
+	}
+}
+
+// metadataValue reads user metadata both from StatObject (Owner) and ListObjects (X-Amz-Meta-Owner) results.
+func metadataValue(metadata map[string]string, key string) string {
+	for k, v := range metadata {
+		k = strings.TrimPrefix(strings.ToLower(k), "x-amz-meta-")
+		if k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+func ownershipMetadata(identity *auth.Identity, shared bool) map[string]string {
+	metadata := map[string]string{
+		metadataShared: "false",
+	}
+	if shared {
+		metadata[metadataShared] = "true"
+	}
+	if identity != nil {
+		metadata[metadataOwner] = identity.UserID
+		metadata[metadataOwnerName] = identity.Username
+		metadata[metadataTenant] = identity.Tenant
+	}
+	return metadata
+}
+
+// isServiceObject tells whether a key holds service data rather than a video.
+func isServiceObject(key string) bool {
+	return strings.HasPrefix(key, catalogPrefix) || strings.HasPrefix(key, recordingsPrefix)
+}
+
+func isAdmin(identity *auth.Identity) bool {
+	return identity != nil && identity.HasRole(auth.RoleAdmin)
+}
+
+func isOwner(identity *auth.Identity, metadata map[string]string) bool {
+	return identity != nil && identity.UserID != "" && metadataValue(metadata, metadataOwner) == identity.UserID
+}
+
+// canRead tells whether the identity may list and stream a video.
+// Videos uploaded before ownership was recorded have no owner and stay visible to everyone,
+// shared videos are visible within the tenant of their owner.
+func canRead(identity *auth.Identity, info minio.ObjectInfo) bool {
+	owner := metadataValue(info.UserMetadata, metadataOwner)
+	return owner == "" ||
+		isOwner(identity, info.UserMetadata) ||
+		isAdmin(identity) ||
+		metadataValue(info.UserMetadata, metadataShared) == "true" && sameTenant(identity, info.UserMetadata)
+}
+
+func sameTenant(identity *auth.Identity, metadata map[string]string) bool {
+	tenant := ""
+	if identity != nil {
+		tenant = identity.Tenant
+	}
+	return metadataValue(metadata, metadataTenant) == tenant
+}
+
+// canModify tells whether the identity may delete a video or change its sharing.
+func canModify(identity *auth.Identity, info minio.ObjectInfo) bool {
+	return isOwner(identity, info.UserMetadata) || isAdmin(identity)
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"testing"
+	"video-handler/external/auth"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestCanRead(t *testing.T) {
+	alice := &auth.Identity{UserID: "alice", Tenant: "acme"}
+	bob := &auth.Identity{UserID: "bob", Tenant: "acme"}
+	eve := &auth.Identity{UserID: "eve", Tenant: "globex"}
+	admin := &auth.Identity{UserID: "admin", Roles: []string{auth.RoleAdmin}}
+
+	private := ownershipMetadata(alice, false)
+	shared := ownershipMetadata(alice, true)
+	sharedWithoutTenant := ownershipMetadata(&auth.Identity{UserID: "carol"}, true)
+
+	tests := []struct {
+		name     string
+		identity *auth.Identity
+		metadata map[string]string
+		read     bool
+		modify   bool
+	}{
+		{"the owner of a private video", alice, private, true, true},
+		{"another user of the tenant on a private video", bob, private, false, false},
+		{"another user of the tenant on a shared video", bob, shared, true, false},
+		{"a user of another tenant on a shared video", eve, shared, false, false},
+		{"a user without tenant on a shared video of a tenant", &auth.Identity{UserID: "dave"}, shared, false, false},
+		{"anonymous on a shared video of a tenant", nil, shared, false, false},
+		{"a user without tenant on a shared video without tenant", &auth.Identity{UserID: "dave"}, sharedWithoutTenant, true, false},
+		{"a user of a tenant on a shared video without tenant", eve, sharedWithoutTenant, false, false},
+		{"an admin on a private video", admin, private, true, true},
+		{"a user on a video without owner", eve, map[string]string{}, true, false},
+		{"the listing metadata of a shared video", bob, map[string]string{"X-Amz-Meta-Owner": "alice", "X-Amz-Meta-Tenant": "acme", "X-Amz-Meta-Shared": "true"}, true, false},
+		{"the listing metadata of a shared video of another tenant", eve, map[string]string{"X-Amz-Meta-Owner": "alice", "X-Amz-Meta-Tenant": "acme", "X-Amz-Meta-Shared": "true"}, false, false},
+	}
+
+	for _, test := range tests {
+		info := minio.ObjectInfo{UserMetadata: test.metadata}
+		if got := canRead(test.identity, info); got != test.read {
+			t.Errorf("%s: canRead returned %v, want %v", test.name, got, test.read)
+		}
+		if got := canModify(test.identity, info); got != test.modify {
+			t.Errorf("%s: canModify returned %v, want %v", test.name, got, test.modify)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+	"video-handler/internal/tracing"
+
+	cmdCommand "video-handler/pkg"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans registers a provider which keeps the spans in memory until the end of the test.
+func recordSpans(t *testing.T) func() tracetest.SpanStubs {
+	t.Helper()
+
+	previous := otel.GetTracerProvider()
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := tracing.NewProvider(exporter, "video-handler", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(previous)
+	})
+
+	return func() tracetest.SpanStubs {
+		provider.ForceFlush(context.Background())
+		return exporter.GetSpans()
+	}
+}
+
+// findSpan returns the span named name with the parent and the attribute, if any.
+func findSpan(spans tracetest.SpanStubs, name string, parent trace.SpanContext, attr attribute.KeyValue) *tracetest.SpanStub {
+	for i, span := range spans {
+		if span.Name != name || span.Parent.SpanID() != parent.SpanID() {
+			continue
+		}
+		for _, kv := range span.Attributes {
+			if kv == attr {
+				return &spans[i]
+			}
+		}
+	}
+	return nil
+}
+
+func TestConvertFlowSpans(t *testing.T) {
+	spans := recordSpans(t)
+	ts := newTestServer(t, &fakeTranscoder{
+		Result: cmdCommand.ProbeResult{VideoCodec: "mpeg4", AudioCodec: "mp3", Formats: "avi", Duration: 2 * time.Second},
+		Frames: 2 * fakeFrameRate,
+	})
+
+	ts.upload(t, "movie.avi", []byte("an AVI in MPEG-4 part 2"))
+	if job := ts.waitForJob(t, "movie.ts"); job.Status != JobSucceeded {
+		t.Fatalf("the conversion ended with %s: %s", job.Status, job.Error)
+	}
+
+	// the span of the conversion ends once the job is finished
+	var convert *tracetest.SpanStub
+	var recorded tracetest.SpanStubs
+	for deadline := time.Now().Add(5 * time.Second); convert == nil && time.Now().Before(deadline); {
+		recorded = spans()
+		for i := range recorded {
+			if recorded[i].Name == "convert video" {
+				convert = &recorded[i]
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if convert == nil {
+		t.Fatal("no convert video span")
+	}
+
+	request := findSpan(recorded, "POST /upload", trace.SpanContext{}, attribute.String("http.route", "/upload"))
+	if request == nil {
+		t.Fatal("no root span for POST /upload")
+	}
+	process := findSpan(recorded, "process video container", request.SpanContext, attribute.String("video.name", "movie.avi"))
+	if process == nil {
+		t.Fatal("no process video container span under the request")
+	}
+	for _, attr := range []attribute.KeyValue{
+		attribute.String("video.codec", "mpeg4"),
+		attribute.String("video.container", "avi"),
+		attribute.Bool("video.conversion_needed", true),
+	} {
+		if findSpan(recorded, process.Name, request.SpanContext, attr) == nil {
+			t.Errorf("process video container misses %s=%s", attr.Key, attr.Value.Emit())
+		}
+	}
+	if findSpan(recorded, "minio put", process.SpanContext, attribute.String("minio.key", originalsPrefix+"movie.avi")) == nil {
+		t.Error("the original isn't stored under process video container")
+	}
+
+	// the conversion outlives the request but stays in its trace
+	if convert.Parent.SpanID() != process.SpanContext.SpanID() || convert.SpanContext.TraceID() != request.SpanContext.TraceID() {
+		t.Errorf("convert video is under %s, want process video container", convert.Parent.SpanID())
+	}
+	if findSpan(recorded, convert.Name, process.SpanContext, attribute.String("video.name", "movie.ts")) == nil {
+		t.Error("convert video doesn't name the rendition")
+	}
+	if findSpan(recorded, "minio put", convert.SpanContext, attribute.String("minio.key", "movie.ts")) == nil {
+		t.Error("the rendition isn't stored under convert video")
+	}
+	if findSpan(recorded, "minio get", convert.SpanContext, attribute.String("minio.key", originalsPrefix+"movie.avi")) == nil &&
+		findSpan(recorded, "minio stat", convert.SpanContext, attribute.String("minio.key", originalsPrefix+"movie.avi")) == nil {
+		t.Error("the original isn't read under convert video")
+	}
+}
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"video-handler/external/auth"
+)
+
+const (
+	usageUsersCatalog   string = "usage/users/"
+	usageTenantsCatalog string = "usage/tenants/"
+
+	// room for the multipart headers and form fields around the video
+	multipartOverhead int64 = 64 * 1024
+)
+
+var (
+	ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+// Usage is the storage used by a user or a tenant.
+type Usage struct {
+	UserID    string    `json:"user_id,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Videos    int       `json:"videos"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// usageAccounting keeps the stored bytes and videos of the users and tenants in the catalog.
+type usageAccounting struct {
+	catalog *Catalog
+	mutex   sync.Mutex
+}
+
+func usageKey(prefix, id string) string {
+	// user ids like apikey:{id} or tenants with slashes must stay a single key
+	return prefix + strings.ReplaceAll(id, "/", "_") + ".json"
+}
+
+// add records a change of the videos of an owner, identified by the metadata of the video.
+func (ua *usageAccounting) add(ctx context.Context, userID, tenant string, bytes int64, videos int) error {
+	ua.mutex.Lock()
+	defer ua.mutex.Unlock()
+
+	if userID != "" {
+		if err := ua.update(ctx, usageKey(usageUsersCatalog, userID), Usage{UserID: userID, Tenant: tenant}, bytes, videos); err != nil {
+			return err
+		}
+	}
+	if tenant != "" {
+		if err := ua.update(ctx, usageKey(usageTenantsCatalog, tenant), Usage{Tenant: tenant}, bytes, videos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ua *usageAccounting) update(ctx context.Context, key string, usage Usage, bytes int64, videos int) error {
+	if err := ua.catalog.get(ctx, key, &usage); err != nil && !errors.Is(err, ErrCatalogNotFound) {
+		return err
+	}
+
+	usage.Bytes = max(usage.Bytes+bytes, 0)
+	usage.Videos = max(usage.Videos+videos, 0)
+	usage.UpdatedAt = time.Now()
+
+	return ua.catalog.put(ctx, key, usage)
+}
+
+func (ua *usageAccounting) get(ctx context.Context, prefix, id string) (Usage, error) {
+	var usage Usage
+	err := ua.catalog.get(ctx, usageKey(prefix, id), &usage)
+	if errors.Is(err, ErrCatalogNotFound) {
+		return usage, nil
+	}
+	return usage, err
+}
+
+func (ua *usageAccounting) list(ctx context.Context, prefix string) ([]Usage, error) {
+	keys, err := ua.catalog.keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	usages := make([]Usage, 0, len(keys))
+	for _, key := range keys {
+		var usage Usage
+		if err := ua.catalog.get(ctx, key, &usage); err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// checkQuota returns an error when storing size more bytes would exceed the quotas of identity,
+// size is negative when unknown and only the current usage is checked.
+func (service *VideoService) checkQuota(ctx context.Context, identity *auth.Identity, size int64) error {
+	size = max(size, 0)
+
+	if quota := service.Envs.QuotaUserBytes; quota > 0 && identity != nil {
+		usage, err := service.usage.get(ctx, usageUsersCatalog, identity.UserID)
+		if err != nil {
+			return err
+		}
+		if usage.Bytes+size > quota || (size == 0 && usage.Bytes >= quota) {
+			return fmt.Errorf("%w: %d of %d bytes used", ErrStorageQuotaExceeded, usage.Bytes, quota)
+		}
+	}
+
+	if quota := service.Envs.QuotaTenantBytes; quota > 0 && identity != nil && identity.Tenant != "" {
+		usage, err := service.usage.get(ctx, usageTenantsCatalog, identity.Tenant)
+		if err != nil {
+			return err
+		}
+		if usage.Bytes+size > quota || (size == 0 && usage.Bytes >= quota) {
+			return fmt.Errorf("%w: %d of %d bytes used by the tenant", ErrStorageQuotaExceeded, usage.Bytes, quota)
+		}
+	}
+
+	return nil
+}
+
+// remainingQuota returns how many bytes identity may still store, -1 when unlimited.
+func (service *VideoService) remainingQuota(ctx context.Context, identity *auth.Identity) (int64, error) {
+	remaining := int64(-1)
+
+	if quota := service.Envs.QuotaUserBytes; quota > 0 && identity != nil {
+		usage, err := service.usage.get(ctx, usageUsersCatalog, identity.UserID)
+		if err != nil {
+			return 0, err
+		}
+		remaining = max(quota-usage.Bytes, 0)
+	}
+
+	if quota := service.Envs.QuotaTenantBytes; quota > 0 && identity != nil && identity.Tenant != "" {
+		usage, err := service.usage.get(ctx, usageTenantsCatalog, identity.Tenant)
+		if err != nil {
+			return 0, err
+		}
+		if left := max(quota-usage.Bytes, 0); remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+
+	return remaining, nil
+}
+
+// GetUsage returns the usage of identity and its tenant, or of every user and tenant for admins.
+func (service *VideoService) GetUsage(ctx context.Context, identity *auth.Identity) (UsageReport, error) {
+	if isAdmin(identity) {
+		users, err := service.usage.list(ctx, usageUsersCatalog)
+		if err != nil {
+			return UsageReport{}, err
+		}
+		tenants, err := service.usage.list(ctx, usageTenantsCatalog)
+		if err != nil {
+			return UsageReport{}, err
+		}
+		return UsageReport{Users: users, Tenants: tenants}, nil
+	}
+
+	report := UsageReport{}
+
+	user, err := service.usage.get(ctx, usageUsersCatalog, identity.UserID)
+	if err != nil {
+		return UsageReport{}, err
+	}
+	user.UserID = identity.UserID
+	report.Users = []Usage{user}
+
+	if identity.Tenant != "" {
+		tenant, err := service.usage.get(ctx, usageTenantsCatalog, identity.Tenant)
+		if err != nil {
+			return UsageReport{}, err
+		}
+		tenant.Tenant = identity.Tenant
+		report.Tenants = []Usage{tenant}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"video-handler/external/auth"
+
+	cmdCommand "video-handler/pkg"
+)
+
+func TestCheckQuota(t *testing.T) {
+	ts := newTestServer(t, &fakeTranscoder{Result: cmdCommand.ProbeResult{VideoCodec: "h264", Formats: "mpegts"}})
+	ts.videoService.Envs.QuotaUserBytes = 1000
+	ts.videoService.Envs.QuotaTenantBytes = 1500
+
+	ctx := context.Background()
+	alice := &auth.Identity{UserID: "alice", Tenant: "acme"}
+	bob := &auth.Identity{UserID: "bob", Tenant: "acme"}
+	full := &auth.Identity{UserID: "full"}
+	if err := ts.videoService.usage.add(ctx, alice.UserID, alice.Tenant, 900, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.videoService.usage.add(ctx, bob.UserID, bob.Tenant, 400, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.videoService.usage.add(ctx, full.UserID, "", 1000, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		identity *auth.Identity
+		size     int64
+		err      error
+	}{
+		{"up to the user quota", alice, 100, nil},
+		{"a byte over the user quota", alice, 101, ErrStorageQuotaExceeded},
+		{"an unknown size under the user quota", alice, -1, nil},
+		{"an unknown size at the user quota", full, -1, ErrStorageQuotaExceeded},
+		{"an empty video at the user quota", full, 0, ErrStorageQuotaExceeded},
+		{"up to the tenant quota", bob, 200, nil},
+		{"a byte over the tenant quota", bob, 201, ErrStorageQuotaExceeded},
+		{"a user without usage", &auth.Identity{UserID: "carol"}, 1000, nil},
+		{"a user without usage over the quota", &auth.Identity{UserID: "carol"}, 1001, ErrStorageQuotaExceeded},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := ts.videoService.checkQuota(ctx, test.identity, test.size); !errors.Is(err, test.err) {
+				t.Errorf("checkQuota returned %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	remaining, err := ts.videoService.remainingQuota(ctx, bob)
+	if err != nil || remaining != 200 {
+		t.Errorf("remainingQuota of bob returned %d, %v, want the 200 bytes left to the tenant", remaining, err)
+	}
+}
@@ -5,15 +5,26 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"net/url"
 	"strings"
+	"time"
 	"video-handler/configs"
+	"video-handler/external/auth"
+	"video-handler/internal/metrics"
+	"video-handler/internal/tracing"
+
+	cmdCommand "video-handler/pkg"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
 	RTSP_SERVER_SUPPORTED_CODECS string = "H264,H265,VP8,VP9,MPEG2,MP3,AAC,Opus,PCM,JPEG"
+
+	// a presigned URL must outlive a run of the pusher, a restarted pusher gets a new one
+	presignedVideoExpiry = 12 * time.Hour
 )
 
 type VideoService struct {
@@ -22,35 +33,101 @@ type VideoService struct {
 	Envs        *configs.EnvVariables
 	MinioEnvs   *configs.MinioEnvs
 	Logger      *slog.Logger
+	// Transcoder runs ffmpeg and ffprobe
+	Transcoder cmdCommand.Transcoder
+	tenants    *tenantStorage
+	limits     *limits
+	catalog    *Catalog
+	usage      *usageAccounting
+	jobs       *jobRegistry
 }
 
-func NewVideoService(ctx context.Context, envs *configs.EnvVariables, minioEnvs *configs.MinioEnvs, logger *slog.Logger) (*VideoService, error) {
+// NewVideoService connects to the bucket of minioEnvs, transcoder runs the media work: a
+// pkg.ExecTranscoder runs the ffmpeg binaries.
+func NewVideoService(ctx context.Context, envs *configs.EnvVariables, minioEnvs *configs.MinioEnvs, transcoder cmdCommand.Transcoder, logger *slog.Logger) (*VideoService, error) {
 	minioClient, err := GetMinioConnection(minioEnvs.AccessKey, minioEnvs.SecretKey, minioEnvs.Endpoint, minioEnvs.SSL)
 	if err != nil {
 		return nil, err
 	}
-	return &VideoService{
+	service := &VideoService{
 		Context:     ctx,
 		Envs:        envs,
 		MinioEnvs:   minioEnvs,
 		Logger:      logger,
 		MinioClient: minioClient,
-	}, nil
+		Transcoder:  transcoder,
+		tenants: &tenantStorage{
+			isolation:     minioEnvs.TenantIsolation,
+			defaultBucket: minioEnvs.Bucket,
+			bucketPrefix:  minioEnvs.TenantBucketPrefix,
+		},
+		limits: newLimits(envs),
+	}
+	service.catalog = &Catalog{service: service}
+	service.usage = &usageAccounting{catalog: service.catalog}
+	service.jobs = newJobRegistry(service.catalog, logger)
+
+	if err := service.checkProfiles(); err != nil {
+		return nil, err
+	}
+
+	return service, nil
 }
 
-func (service *VideoService) streamVideoToServer(sourseVideName, rtspUrl string) error {
-	video, err := service.MinioClient.GetObject(service.Context, service.MinioEnvs.Bucket, sourseVideName, minio.GetObjectOptions{})
+// OnJobChange registers a callback for the progress reports of the jobs and their end.
+func (service *VideoService) OnJobChange(callback func(job Job)) {
+	service.jobs.onChange = callback
+}
+
+// DrainJobs refuses new jobs and waits for the running ones until ctx ends, the remaining ones
+// are cancelled and recorded as failed.
+func (service *VideoService) DrainJobs(ctx context.Context) error {
+	return service.jobs.drain(ctx)
+}
+
+// Catalog returns the store of the service records.
+func (service *VideoService) Catalog() *Catalog {
+	return service.catalog
+}
+
+// recordUsage accounts a change of the videos of the owner of metadata, failures are only logged
+// since the videos are already stored or removed.
+func (service *VideoService) recordUsage(metadata map[string]string, bytes int64, videos int) {
+	userID := metadataValue(metadata, metadataOwner)
+	tenant := metadataValue(metadata, metadataTenant)
+
+	if err := service.usage.add(context.Background(), userID, tenant, bytes, videos); err != nil {
+		service.Logger.Error("failed to update storage usage", "user_id", userID, "tenant", tenant, "bytes", bytes, "err", err.Error())
+	}
+}
+
+// streamVideoToServer pushes the video to the RTSP server from offset, it returns the end of the
+// ffmpeg output, nil when the video couldn't be opened.
+func (service *VideoService) streamVideoToServer(ctx context.Context, identity *auth.Identity, sourseVideName, rtspUrl string, offset time.Duration) ([]byte, error) {
+	videoUrl, err := service.presignUserVideo(ctx, identity, sourseVideName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = service.StreamVideoAsRTSP(video, service.Envs.FfmpegProtocol, rtspUrl)
+	probe, err := service.Transcoder.ProbeUrl(ctx, videoUrl.String())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	service.Logger.Info("video successfully downloded from minio")
-	return nil
+	return service.StreamVideoAsRTSP(ctx, videoUrl.String(), probe.VideoCodec, service.Envs.FfmpegProtocol, rtspUrl, offset)
+}
+
+// startStorage starts the span and the latency measure of a MinIO operation, end must be called with its result.
+func startStorage(ctx context.Context, operation, bucket, key string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "minio "+operation,
+		attribute.String("minio.bucket", bucket),
+		attribute.String("minio.key", key),
+	)
+	return ctx, func(err error) {
+		metrics.ObserveStorage(operation, start)
+		tracing.End(span, err)
+	}
 }
 
 func extractFileNameComponents(fileName string) (string, string) {
@@ -74,44 +151,257 @@ func GetMinioConnection(accessKey, secretKey, endpoint string, ssl bool) (*minio
 }
 
 func (service *VideoService) CreateBucket(ctx context.Context) error {
-	exists, err := service.MinioClient.BucketExists(context.Background(), service.MinioEnvs.Bucket)
+	return service.createBucket(ctx, service.MinioEnvs.Bucket)
+}
+
+func (service *VideoService) createBucket(ctx context.Context, bucket string) error {
+	exists, err := service.MinioClient.BucketExists(ctx, bucket)
 	if err != nil {
 		return err
 	}
 	if exists {
 		return nil
 	}
-	err = service.MinioClient.MakeBucket(context.Background(), service.MinioEnvs.Bucket, minio.MakeBucketOptions{
+	err = service.MinioClient.MakeBucket(ctx, bucket, minio.MakeBucketOptions{
 		ObjectLocking: true,
 	})
 	return err
 }
 
-func (service *VideoService) UploadVideo(video io.Reader, videoName string) (minio.UploadInfo, error) {
-	return service.MinioClient.PutObject(service.Context, service.MinioEnvs.Bucket, videoName, video, -1, minio.PutObjectOptions{
-		ContentType: "video/mp4",
+// ensureTenantBucket creates the bucket of the tenant on its first upload.
+func (service *VideoService) ensureTenantBucket(bucket string) error {
+	if bucket == service.MinioEnvs.Bucket {
+		return nil
+	}
+	if _, ok := service.tenants.createdBuckets.Load(bucket); ok {
+		return nil
+	}
+
+	if err := service.createBucket(service.Context, bucket); err != nil {
+		return err
+	}
+	service.tenants.createdBuckets.Store(bucket, struct{}{})
+	return nil
+}
+
+// UploadVideo stores a video owned by identity in its tenant location, with metadata like its
+// conversion profile.
+func (service *VideoService) UploadVideo(ctx context.Context, identity *auth.Identity, video io.Reader, videoName, contentType string, shared bool, metadata map[string]string) (minio.UploadInfo, error) {
+	return service.uploadUserObject(ctx, identity, video, videoName, -1, shared, minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: metadata,
 	})
 }
 
-func (service *VideoService) DeleteVideo(videoName string) error {
-	return service.MinioClient.RemoveObject(context.Background(), service.MinioEnvs.Bucket, videoName, minio.RemoveObjectOptions{})
+func (service *VideoService) uploadUserObject(ctx context.Context, identity *auth.Identity, reader io.Reader, videoName string, size int64, shared bool, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	location := service.tenants.locate(identity, videoName)
+	if err := service.ensureTenantBucket(location.bucket); err != nil {
+		return minio.UploadInfo{}, err
+	}
+
+	metadata := ownershipMetadata(identity, shared)
+	for k, v := range opts.UserMetadata {
+		metadata[k] = v
+	}
+	opts.UserMetadata = metadata
+
+	// only the owner of a video may overwrite it, which doesn't count twice
+	_, endStat := startStorage(ctx, "stat", location.bucket, location.key)
+	previous, statErr := service.MinioClient.StatObject(ctx, location.bucket, location.key, minio.StatObjectOptions{})
+	if statErr != nil && minio.ToErrorResponse(statErr).Code != "NoSuchKey" {
+		endStat(statErr)
+		return minio.UploadInfo{}, statErr
+	}
+	endStat(nil)
+	if statErr == nil && !canModify(identity, previous) {
+		return minio.UploadInfo{}, ErrForbidden
+	}
+
+	_, endPut := startStorage(ctx, "put", location.bucket, location.key)
+	info, err := service.MinioClient.PutObject(ctx, location.bucket, location.key, reader, size, opts)
+	endPut(err)
+	if err != nil {
+		return info, err
+	}
+	metrics.UploadBytes.Add(float64(info.Size))
+
+	if statErr == nil {
+		service.recordUsage(previous.UserMetadata, -previous.Size, -1)
+	}
+	service.recordUsage(metadata, info.Size, 1)
+
+	return info, nil
+}
+
+// PutObject stores service data, like recording segments, in the main bucket.
+func (service *VideoService) PutObject(objectName string, reader io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	ctx, end := startStorage(service.Context, "put", service.MinioEnvs.Bucket, objectName)
+	info, err := service.MinioClient.PutObject(ctx, service.MinioEnvs.Bucket, objectName, reader, size, opts)
+	end(err)
+	return info, err
 }
 
-func (service *VideoService) GetVideoList() ([]string, error) {
-	service.Logger.Info("Getting video list from Minio bucket", "bucket", service.MinioEnvs.Bucket)
-	objects := service.MinioClient.ListObjects(context.Background(), service.MinioEnvs.Bucket, minio.ListObjectsOptions{
+// RemoveObject removes service data from the main bucket.
+func (service *VideoService) RemoveObject(objectName string) error {
+	ctx, end := startStorage(context.Background(), "remove", service.MinioEnvs.Bucket, objectName)
+	err := service.MinioClient.RemoveObject(ctx, service.MinioEnvs.Bucket, objectName, minio.RemoveObjectOptions{})
+	end(err)
+	return err
+}
+
+// statUserVideo returns the location and the metadata of a video visible to identity.
+func (service *VideoService) statUserVideo(ctx context.Context, identity *auth.Identity, videoName string) (videoLocation, minio.ObjectInfo, error) {
+	location := service.tenants.locate(identity, videoName)
+	if isServiceObject(videoName) {
+		return location, minio.ObjectInfo{}, ErrVideoNotFound
+	}
+
+	ctx, end := startStorage(ctx, "stat", location.bucket, location.key)
+	info, err := service.MinioClient.StatObject(ctx, location.bucket, location.key, minio.StatObjectOptions{})
+	end(err)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return location, info, ErrVideoNotFound
+		}
+		return location, info, err
+	}
+
+	if !canRead(identity, info) {
+		// don't reveal the existence of private videos of other users
+		return location, info, ErrVideoNotFound
+	}
+
+	return location, info, nil
+}
+
+// presignUserVideo returns a temporary URL of a video visible to identity. Unlike a pipe, ffmpeg can
+// seek in it with range requests.
+func (service *VideoService) presignUserVideo(ctx context.Context, identity *auth.Identity, videoName string) (*url.URL, error) {
+	location, _, err := service.statUserVideo(ctx, identity, videoName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, end := startStorage(ctx, "presign", location.bucket, location.key)
+	videoUrl, err := service.MinioClient.PresignedGetObject(ctx, location.bucket, location.key, presignedVideoExpiry, nil)
+	end(err)
+	return videoUrl, err
+}
+
+// DeleteVideo removes a video, which is allowed to its owner and to admins only.
+func (service *VideoService) DeleteVideo(ctx context.Context, identity *auth.Identity, videoName string) error {
+	location, info, err := service.statUserVideo(ctx, identity, videoName)
+	if err != nil {
+		return err
+	}
+
+	if !canModify(identity, info) {
+		return ErrForbidden
+	}
+
+	// the video is removed even when the client goes away
+	ctx, end := startStorage(context.WithoutCancel(ctx), "remove", location.bucket, location.key)
+	err = service.MinioClient.RemoveObject(ctx, location.bucket, location.key, minio.RemoveObjectOptions{})
+	end(err)
+	if err != nil {
+		return err
+	}
+
+	service.recordUsage(info.UserMetadata, -info.Size, -1)
+	return nil
+}
+
+// ShareVideo changes whether the other users of the tenant can see the video.
+func (service *VideoService) ShareVideo(ctx context.Context, identity *auth.Identity, videoName string, shared bool) error {
+	location, info, err := service.statUserVideo(ctx, identity, videoName)
+	if err != nil {
+		return err
+	}
+
+	if !canModify(identity, info) {
+		return ErrForbidden
+	}
+
+	metadata := map[string]string{
+		"Content-Type": info.ContentType,
+	}
+	// the other metadata, like the original of a rendition, is kept
+	for key, value := range info.UserMetadata {
+		metadata[strings.TrimPrefix(strings.ToLower(key), "x-amz-meta-")] = value
+	}
+	metadata[metadataShared] = "false"
+	if shared {
+		metadata[metadataShared] = "true"
+	}
+
+	ctx, end := startStorage(ctx, "copy", location.bucket, location.key)
+	_, err = service.MinioClient.CopyObject(ctx,
+		minio.CopyDestOptions{
+			Bucket:          location.bucket,
+			Object:          location.key,
+			UserMetadata:    metadata,
+			ReplaceMetadata: true,
+		},
+		minio.CopySrcOptions{
+			Bucket: location.bucket,
+			Object: location.key,
+		},
+	)
+	end(err)
+	return err
+}
+
+// GetVideoList lists the videos of the tenant which identity owns or which are shared.
+func (service *VideoService) GetVideoList(ctx context.Context, identity *auth.Identity) ([]string, error) {
+	bucket := service.tenants.bucket(identity)
+	prefix := service.tenants.prefix(identity)
+
+	service.Logger.InfoContext(ctx, "Getting video list from Minio bucket", "bucket", bucket, "prefix", prefix)
+	ctx, end := startStorage(ctx, "list", bucket, prefix)
+	objects := service.MinioClient.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		Prefix:       prefix,
 		WithMetadata: true,
 	})
 
 	var videos []string
 	for obj := range objects {
-		videos = append(videos, obj.Key)
+		if obj.Err != nil {
+			end(obj.Err)
+			return nil, obj.Err
+		}
+		// skip prefixes like recordings/ which hold service data
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		if !canRead(identity, obj) {
+			continue
+		}
+		videos = append(videos, strings.TrimPrefix(obj.Key, prefix))
 	}
 
-	service.Logger.Info("Video list obtained from Minio bucket", "bucket", service.MinioEnvs.Bucket, "videos", videos)
+	end(nil)
+	service.Logger.InfoContext(ctx, "Video list obtained from Minio bucket", "bucket", bucket, "videos", videos)
 	return videos, nil
 }
 
+// CanReadVideo returns an error when the video doesn't exist or isn't visible to identity.
+func (service *VideoService) CanReadVideo(ctx context.Context, identity *auth.Identity, videoName string) error {
+	_, _, err := service.statUserVideo(ctx, identity, videoName)
+	return err
+}
+
+// GetUserVideo opens a video visible to identity.
+func (service *VideoService) GetUserVideo(ctx context.Context, identity *auth.Identity, videoName string) (*minio.Object, error) {
+	location, _, err := service.statUserVideo(ctx, identity, videoName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the object is read after ctx ends, by the stream pushers
+	return service.MinioClient.GetObject(service.Context, location.bucket, location.key, minio.GetObjectOptions{})
+}
+
+// GetVideo opens service data from the main bucket.
 func (service *VideoService) GetVideo(videoName string) (*minio.Object, error) {
 	return service.MinioClient.GetObject(service.Context, service.MinioEnvs.Bucket, videoName, minio.GetObjectOptions{})
 }
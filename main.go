@@ -3,16 +3,20 @@ package main
 import (
 	"context"
 	"errors"
-	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/go-chi/chi"
 
 	"video-handler/configs"
 	"video-handler/external/auth"
 	"video-handler/internal"
+	"video-handler/internal/tracing"
+
+	cmdCommand "video-handler/pkg"
 
 	_ "github.com/joho/godotenv/autoload"
 )
@@ -22,15 +26,23 @@ func main() {
 	minioConfig := configs.MustConfigMinio()
 	externalAuthService := configs.MustConfigAuthService()
 
-	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+	logger := slog.New(tracing.NewLogHandler(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
 		AddSource: true,
-	}))
+	})))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	ctx := context.Background()
-	ctxTimeout, cancel := context.WithCancel(ctx)
+	ctxTimeout, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	videoService, err := internal.NewVideoService(ctxTimeout, envs, minioConfig, logger)
+	shutdownTracing, err := tracing.Setup(ctxTimeout, envs.OtlpEndpoint, envs.OtelServiceName, envs.TraceSampleRatio)
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	videoService, err := internal.NewVideoService(ctxTimeout, envs, minioConfig, &cmdCommand.ExecTranscoder{Logger: logger}, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -42,15 +54,63 @@ func main() {
 
 	r := chi.NewRouter()
 
-	authRepository := auth.NewAuthRepository(externalAuthService, logger)
+	catalog := videoService.Catalog()
+	auditLog := internal.NewAuditLog(ctxTimeout, catalog, logger)
 
-	streamerService := internal.NewStreamerService(videoService, envs, logger, ctxTimeout, cancel)
+	authRepository, err := auth.NewAuthRepository(externalAuthService, catalog, logger)
+	if err != nil {
+		panic(err)
+	}
+	authRepository.OnAuthenticationFailure(func(r *http.Request, err error) {
+		auditLog.Record(r, nil, internal.AuditLoginFailure, r.URL.Path, err)
+	})
 
-	webrtcRespository := internal.NewWebrtcRepository(r, streamerService, videoService, authRepository, envs, logger, ctxTimeout)
-	if handler, err := webrtcRespository.SetupHandler(r); err == nil {
+	streamerService, err := internal.NewStreamerService(videoService, authRepository, envs, logger, ctxTimeout)
+	if err != nil {
+		panic(err)
+	}
+
+	webrtcRespository := internal.NewWebrtcRepository(r, streamerService, videoService, authRepository, auditLog, envs, logger, ctxTimeout)
+	handler, err := webrtcRespository.SetupHandler(r)
+	if err != nil {
+		panic(errors.New("failed to start server on port" + envs.ServerPort))
+	}
+
+	server := &http.Server{
+		Addr:    envs.ServerHost + ":" + envs.ServerPort,
+		Handler: handler,
+	}
+
+	go func() {
 		logger.Info("server started and running on port :" + envs.ServerPort)
-		log.Fatal(http.ListenAndServe(envs.ServerHost+":"+envs.ServerPort, handler))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("server stopped", "err", err.Error())
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	// a second signal kills the process
+	stop()
+	logger.Info("shutting down", "timeout", envs.ShutdownTimeout.String())
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), envs.ShutdownTimeout)
+	defer cancelShutdown()
+
+	// refuse new work first, then let the running requests and conversions end. The stream pushers
+	// are stopped before their RTSP servers close, so that none is restarted
+	webrtcRespository.StopAccepting()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to shut the HTTP server down", "err", err.Error())
+	}
+	if err := webrtcRespository.Shutdown(shutdownCtx); err != nil {
+		logger.Error("shutdown deadline exceeded", "err", err.Error())
 	}
 
-	log.Fatal(errors.New("failed to start server on port" + envs.ServerPort))
+	// stops the RTSP consumers, the audit log writes the events still queued
+	cancel()
+	if err := auditLog.Wait(shutdownCtx); err != nil {
+		logger.Error("audit events lost at shutdown", "err", err.Error())
+	}
+	logger.Info("shutdown complete")
 }
@@ -3,4 +3,6 @@ package pkg
 const (
 	FFMPEG_COMMAND         string = "ffmpeg-command"
 	FFMPEG_COMMAND_SUCCESS string = "ffmpeg command executed successfully"
+
+	tracerName string = "video-handler/pkg"
 )
@@ -1,62 +1,241 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
+	"net/url"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type CmdCommand struct {
 	App    string
 	Args   []string
-	Pipe   io.ReadSeekCloser
+	Pipe   io.Reader
 	Logger slog.Logger
+	// Context carries the trace of the caller and interrupts the process when done, optional
+	Context context.Context
+	// OnProgress receives the progress reports of a process started with Ffmpeg.Progress, optional
+	OnProgress func(Progress)
+}
+
+const (
+	// time given to an interrupted process to exit before it's killed
+	interruptWaitDelay = 5 * time.Second
+
+	// end of the output kept by ExecuteWithOutputTail
+	outputTailSize = 16 * 1024
+)
+
+// command interrupts the process when ctx is done, letting ffmpeg finalize its output.
+func (cc *CmdCommand) command(ctx context.Context) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, cc.App, cc.Args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = interruptWaitDelay
+	return cmd
+}
+
+// Version returns the first line printed by app -version, like "ffmpeg version 6.1.1".
+func Version(ctx context.Context, app string) (string, error) {
+	out, err := exec.CommandContext(ctx, app, "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", app, err)
+	}
+
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line), nil
+}
+
+// commandLine renders the process for the logs, without the credentials of its urls: the password of
+// the publisher and the query of the presigned urls, which holds their signature.
+func (cc *CmdCommand) commandLine() string {
+	args := make([]string, len(cc.Args))
+	for i, arg := range cc.Args {
+		args[i] = arg
+		if u, err := url.Parse(arg); err == nil && u.Scheme != "" && u.Host != "" {
+			if u.RawQuery != "" {
+				u.RawQuery = "xxxxx"
+			}
+			args[i] = u.Redacted()
+		}
+	}
+	return cc.App + " " + strings.Join(args, " ")
+}
+
+// startSpan traces the process, the arguments are left out since they may hold credentials.
+func (cc *CmdCommand) startSpan() (context.Context, trace.Span) {
+	ctx := cc.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return otel.Tracer(tracerName).Start(ctx, "exec "+cc.App, trace.WithAttributes(
+		attribute.String("process.executable.name", cc.App),
+	))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
 }
 
 func (cc *CmdCommand) ExecuteCommand() ([]byte, error) {
-	cmd := exec.Command(cc.App, cc.Args...)
+	ctx, span := cc.startSpan()
+
+	cmd := cc.command(ctx)
 	if cc.Pipe != nil {
 		cmd.Stdin = cc.Pipe
 	}
 
-	cc.Logger.Info(FFMPEG_COMMAND_SUCCESS, "ffmpeg-command", fmt.Sprintf("%s %s", cc.App, cc.Args[:]))
+	cc.Logger.InfoContext(ctx, FFMPEG_COMMAND_SUCCESS, "ffmpeg-command", cc.commandLine())
 
+	runningProcesses.WithLabelValues(cc.App).Inc()
 	stdout, err := cmd.CombinedOutput()
+	runningProcesses.WithLabelValues(cc.App).Dec()
+	endSpan(span, err)
 	if err != nil {
-		cc.Logger.Error(err.Error())
+		cc.Logger.ErrorContext(ctx, err.Error())
 		return stdout, nil
 	}
 
 	videoCodec := strings.TrimSpace(string(stdout))
 
-	cc.Logger.Info(FFMPEG_COMMAND_SUCCESS, "msg", videoCodec, "ffmpeg-command", fmt.Sprintf("%s %s", cc.App, cc.Args[:]))
+	cc.Logger.InfoContext(ctx, FFMPEG_COMMAND_SUCCESS, "msg", videoCodec, "ffmpeg-command", cc.commandLine())
 	return []byte(videoCodec), nil
 }
 
+// ExecuteWithOutputTail runs a long running process, like a stream pusher, and returns its exit error
+// with the end of its output, which tells why it stopped.
+func (cc *CmdCommand) ExecuteWithOutputTail() ([]byte, error) {
+	ctx, span := cc.startSpan()
+
+	cmd := cc.command(ctx)
+	if cc.Pipe != nil {
+		cmd.Stdin = cc.Pipe
+	}
+	output := &tailBuffer{size: outputTailSize}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	cc.Logger.InfoContext(ctx, "starting process", "ffmpeg-command", cc.commandLine())
+
+	runningProcesses.WithLabelValues(cc.App).Inc()
+	err := cmd.Run()
+	runningProcesses.WithLabelValues(cc.App).Dec()
+	endSpan(span, err)
+	if err != nil {
+		cc.Logger.ErrorContext(ctx, "process exited", "app", cc.App, "err", err.Error())
+	}
+
+	return output.bytes(), err
+}
+
 func (cc *CmdCommand) ExecuteWithPipeCreation() (io.ReadCloser, error) {
-	cmd := exec.Command(cc.App, cc.Args...)
+	ctx, span := cc.startSpan()
+
+	cmd := cc.command(ctx)
 	cmd.Stdin = cc.Pipe
 
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
+		endSpan(span, err)
 		return nil, err
 	}
 
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
+		endSpan(span, err)
 		return nil, err
 	}
 
 	if err := cmd.Start(); err != nil {
+		endSpan(span, err)
 		return nil, err
 	}
+	runningProcesses.WithLabelValues(cc.App).Inc()
 
 	go func() {
+		if cc.OnProgress != nil {
+			ScanProgress(stderrPipe, os.Stderr, cc.OnProgress)
+			return
+		}
 		io.Copy(os.Stderr, stderrPipe)
 	}()
 
-	return stdoutPipe, nil
+	return &processOutput{ReadCloser: stdoutPipe, cmd: cmd, app: cc.App, span: span}, nil
+}
+
+// processOutput waits for the process once its output is consumed, Wait must not be called before.
+// A failed process turns the end of its output into an error.
+type processOutput struct {
+	io.ReadCloser
+	cmd     *exec.Cmd
+	app     string
+	span    trace.Span
+	once    sync.Once
+	waitErr error
+}
+
+func (po *processOutput) Read(p []byte) (int, error) {
+	n, err := po.ReadCloser.Read(p)
+	if err == io.EOF {
+		if waitErr := po.wait(); waitErr != nil {
+			return n, fmt.Errorf("%s failed: %w", po.app, waitErr)
+		}
+	}
+	return n, err
+}
+
+func (po *processOutput) Close() error {
+	err := po.ReadCloser.Close()
+	po.wait()
+	return err
+}
+
+func (po *processOutput) wait() error {
+	po.once.Do(func() {
+		po.waitErr = po.cmd.Wait()
+		runningProcesses.WithLabelValues(po.app).Dec()
+		endSpan(po.span, po.waitErr)
+	})
+	return po.waitErr
+}
+
+// tailBuffer keeps the last size bytes written to it.
+type tailBuffer struct {
+	mutex sync.Mutex
+	data  []byte
+	size  int
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	tb.data = append(tb.data, p...)
+	if len(tb.data) > tb.size {
+		tb.data = tb.data[len(tb.data)-tb.size:]
+	}
+	return len(p), nil
+}
+
+func (tb *tailBuffer) bytes() []byte {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	return append([]byte(nil), tb.data...)
 }
@@ -0,0 +1,331 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CodecCopy string = "copy"
+)
+
+var (
+	ErrInvalidFfmpegCommand = errors.New("invalid ffmpeg command")
+
+	// options with a typed field, they can't be given as raw options
+	reservedFfmpegOptions = map[string]bool{
+		"i": true, "f": true, "ss": true, "re": true, "readrate": true, "map": true,
+		"c": true, "codec": true, "c:v": true, "codec:v": true, "vcodec": true, "c:a": true, "codec:a": true, "acodec": true,
+		"b:v": true, "b:a": true, "crf": true, "preset": true, "tune": true, "r": true, "g": true,
+		"vf": true, "filter:v": true, "af": true, "filter:a": true, "bsf:v": true, "an": true, "ac": true, "ar": true,
+		"progress": true, "stats_period": true, "nostats": true,
+	}
+)
+
+// Ffmpeg describes an ffmpeg invocation, Args validates it and renders its arguments.
+type Ffmpeg struct {
+	// Progress writes the progress reports to stderr instead of the stats line, see ScanProgress
+	Progress bool
+	// StatsPeriod is the period of the progress reports, 500ms by default
+	StatsPeriod time.Duration
+
+	Inputs  []FfmpegInput
+	Outputs []FfmpegOutput
+}
+
+type FfmpegInput struct {
+	// Url is a file, a stream url or pipe:0
+	Url    string
+	Format string
+	// Seek starts reading at this position
+	Seek time.Duration
+	// Realtime reads the input at its native rate, like a live source
+	Realtime bool
+	// ReadRate reads the input at this multiple of its native rate, 0 when unlimited
+	ReadRate float64
+	Options  []FfmpegOption
+}
+
+type FfmpegOutput struct {
+	// Url is a file, a stream url or pipe:1
+	Url    string
+	Format string
+	// Maps selects the streams of the inputs, ffmpeg picks one video and one audio stream when empty
+	Maps []FfmpegMap
+
+	// Codec applies to every stream, it excludes VideoCodec and AudioCodec
+	Codec string
+
+	VideoCodec   string
+	VideoBitrate string
+	Crf          string
+	Preset       string
+	Tune         string
+	FrameRate    string
+	// KeyframeInterval is the number of frames between keyframes
+	KeyframeInterval     int
+	VideoFilters         []string
+	VideoBitstreamFilter string
+
+	AudioCodec   string
+	AudioBitrate string
+	// AudioChannels mixes the audio down or up, 2 downmixes surround to stereo
+	AudioChannels   int
+	AudioSampleRate int
+	AudioFilters    []string
+	// NoAudio drops the audio streams
+	NoAudio bool
+
+	// Options are the format specific options, like hls_time
+	Options []FfmpegOption
+}
+
+// FfmpegMap selects the Stream streams of the Input-th input, like v:0, all of them when Stream is empty.
+type FfmpegMap struct {
+	Input  int
+	Stream string
+	// Optional ignores the mapping when the input has no such stream
+	Optional bool
+}
+
+// FfmpegOption is an option without its leading dash, Value is empty for flags.
+type FfmpegOption struct {
+	Name  string
+	Value string
+}
+
+func (m FfmpegMap) String() string {
+	spec := strconv.Itoa(m.Input)
+	if m.Stream != "" {
+		spec += ":" + m.Stream
+	}
+	if m.Optional {
+		spec += "?"
+	}
+	return spec
+}
+
+// Args renders the arguments of the command, or fails on options which contradict each other.
+func (f Ffmpeg) Args() ([]string, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	var args []string
+	if f.Progress {
+		args = append(args, "-nostats", "-progress", "pipe:2")
+	}
+	if f.StatsPeriod > 0 {
+		args = append(args, "-stats_period", strconv.FormatFloat(f.StatsPeriod.Seconds(), 'f', -1, 64))
+	}
+	for _, input := range f.Inputs {
+		args = append(args, input.args()...)
+	}
+	for _, output := range f.Outputs {
+		args = append(args, output.args()...)
+	}
+	return args, nil
+}
+
+func (f Ffmpeg) validate() error {
+	if len(f.Inputs) == 0 {
+		return fmt.Errorf("%w: no input", ErrInvalidFfmpegCommand)
+	}
+	if len(f.Outputs) == 0 {
+		return fmt.Errorf("%w: no output", ErrInvalidFfmpegCommand)
+	}
+
+	var errs []error
+	if f.StatsPeriod < 0 {
+		errs = append(errs, fmt.Errorf("%w: negative stats period", ErrInvalidFfmpegCommand))
+	}
+	for i, input := range f.Inputs {
+		for _, err := range input.validate() {
+			errs = append(errs, fmt.Errorf("%w: input %d: %w", ErrInvalidFfmpegCommand, i, err))
+		}
+	}
+	for i, output := range f.Outputs {
+		for _, err := range output.validate(len(f.Inputs)) {
+			errs = append(errs, fmt.Errorf("%w: output %d: %w", ErrInvalidFfmpegCommand, i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (input FfmpegInput) validate() []error {
+	var errs []error
+	if input.Url == "" {
+		errs = append(errs, errors.New("no url"))
+	}
+	if input.Seek < 0 {
+		errs = append(errs, errors.New("negative seek"))
+	}
+	if input.ReadRate < 0 {
+		errs = append(errs, errors.New("negative read rate"))
+	}
+	if input.Realtime && input.ReadRate > 0 {
+		errs = append(errs, errors.New("-re and -readrate both set"))
+	}
+	return append(errs, validateOptions(input.Options)...)
+}
+
+func (output FfmpegOutput) validate(inputs int) []error {
+	var errs []error
+	if output.Url == "" {
+		errs = append(errs, errors.New("no url"))
+	}
+	if strings.HasPrefix(output.Url, "pipe:") && output.Format == "" {
+		errs = append(errs, errors.New("a pipe needs a format"))
+	}
+
+	for _, m := range output.Maps {
+		if m.Input < 0 || m.Input >= inputs {
+			errs = append(errs, fmt.Errorf("map %s: no input %d", m, m.Input))
+		}
+	}
+
+	if output.Codec != "" && (output.VideoCodec != "" || output.AudioCodec != "") {
+		errs = append(errs, errors.New("-c set with -c:v or -c:a"))
+	}
+
+	videoCodec := output.VideoCodec
+	if videoCodec == "" {
+		videoCodec = output.Codec
+	}
+	if videoCodec == CodecCopy {
+		encoding := []struct {
+			name string
+			set  bool
+		}{
+			{"-b:v", output.VideoBitrate != ""},
+			{"-crf", output.Crf != ""},
+			{"-preset", output.Preset != ""},
+			{"-tune", output.Tune != ""},
+			{"-r", output.FrameRate != ""},
+			{"-g", output.KeyframeInterval > 0},
+			{"-vf", len(output.VideoFilters) > 0},
+		}
+		for _, option := range encoding {
+			if option.set {
+				errs = append(errs, fmt.Errorf("%s needs encoding, the video is copied", option.name))
+			}
+		}
+	}
+
+	audioCodec := output.AudioCodec
+	if audioCodec == "" {
+		audioCodec = output.Codec
+	}
+	audioEncoding := []struct {
+		name string
+		set  bool
+	}{
+		{"-b:a", output.AudioBitrate != ""},
+		{"-ac", output.AudioChannels > 0},
+		{"-ar", output.AudioSampleRate > 0},
+		{"-af", len(output.AudioFilters) > 0},
+	}
+	if output.AudioChannels < 0 || output.AudioSampleRate < 0 {
+		errs = append(errs, errors.New("negative audio channels or sample rate"))
+	}
+	if output.NoAudio && output.AudioCodec != "" {
+		errs = append(errs, errors.New("-an set with audio options"))
+	}
+	for _, option := range audioEncoding {
+		switch {
+		case !option.set:
+		case output.NoAudio:
+			errs = append(errs, fmt.Errorf("-an set with %s", option.name))
+		case audioCodec == CodecCopy:
+			errs = append(errs, fmt.Errorf("%s needs encoding, the audio is copied", option.name))
+		}
+	}
+
+	return append(errs, validateOptions(output.Options)...)
+}
+
+func validateOptions(options []FfmpegOption) []error {
+	var errs []error
+	for _, option := range options {
+		name := strings.TrimPrefix(option.Name, "-")
+		if name == "" {
+			errs = append(errs, errors.New("option without name"))
+		} else if reservedFfmpegOptions[name] {
+			errs = append(errs, fmt.Errorf("-%s has a field of its own", name))
+		}
+	}
+	return errs
+}
+
+func (input FfmpegInput) args() []string {
+	var args []string
+	if input.Realtime {
+		args = append(args, "-re")
+	}
+	if input.ReadRate > 0 {
+		args = append(args, "-readrate", strconv.FormatFloat(input.ReadRate, 'f', -1, 64))
+	}
+	if input.Seek > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(input.Seek.Seconds(), 'f', 3, 64))
+	}
+	args = appendOptions(args, input.Options)
+	args = appendOption(args, "-f", input.Format)
+	return append(args, "-i", input.Url)
+}
+
+func (output FfmpegOutput) args() []string {
+	var args []string
+	for _, m := range output.Maps {
+		args = append(args, "-map", m.String())
+	}
+
+	args = appendOption(args, "-c", output.Codec)
+	args = appendOption(args, "-c:v", output.VideoCodec)
+	args = appendOption(args, "-b:v", output.VideoBitrate)
+	args = appendOption(args, "-crf", output.Crf)
+	args = appendOption(args, "-preset", output.Preset)
+	args = appendOption(args, "-tune", output.Tune)
+	args = appendOption(args, "-r", output.FrameRate)
+	if output.KeyframeInterval > 0 {
+		args = append(args, "-g", strconv.Itoa(output.KeyframeInterval))
+	}
+	args = appendOption(args, "-vf", strings.Join(output.VideoFilters, ","))
+	args = appendOption(args, "-bsf:v", output.VideoBitstreamFilter)
+
+	if output.NoAudio {
+		args = append(args, "-an")
+	}
+	args = appendOption(args, "-c:a", output.AudioCodec)
+	args = appendOption(args, "-b:a", output.AudioBitrate)
+	if output.AudioChannels > 0 {
+		args = append(args, "-ac", strconv.Itoa(output.AudioChannels))
+	}
+	if output.AudioSampleRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(output.AudioSampleRate))
+	}
+	args = appendOption(args, "-af", strings.Join(output.AudioFilters, ","))
+
+	args = appendOptions(args, output.Options)
+	args = appendOption(args, "-f", output.Format)
+	return append(args, output.Url)
+}
+
+func appendOption(args []string, name, value string) []string {
+	if value == "" {
+		return args
+	}
+	return append(args, name, value)
+}
+
+func appendOptions(args []string, options []FfmpegOption) []string {
+	for _, option := range options {
+		args = append(args, "-"+strings.TrimPrefix(option.Name, "-"))
+		if option.Value != "" {
+			args = append(args, option.Value)
+		}
+	}
+	return args
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFfmpegArgsRefusesContradictions(t *testing.T) {
+	input := FfmpegInput{Url: "pipe:0"}
+	output := FfmpegOutput{Url: "pipe:1", Format: "mpegts"}
+
+	tests := []struct {
+		name    string
+		command Ffmpeg
+	}{
+		{
+			name: "-c with -c:v",
+			command: Ffmpeg{Inputs: []FfmpegInput{input}, Outputs: []FfmpegOutput{
+				{Url: "pipe:1", Format: "mpegts", Codec: CodecCopy, VideoCodec: "libx264"},
+			}},
+		},
+		{
+			name: "-c with -c:a",
+			command: Ffmpeg{Inputs: []FfmpegInput{input}, Outputs: []FfmpegOutput{
+				{Url: "pipe:1", Format: "mpegts", Codec: CodecCopy, AudioCodec: "aac"},
+			}},
+		},
+		{
+			name: "copy with -crf",
+			command: Ffmpeg{Inputs: []FfmpegInput{input}, Outputs: []FfmpegOutput{
+				{Url: "pipe:1", Format: "mpegts", VideoCodec: CodecCopy, Crf: "23"},
+			}},
+		},
+		{
+			name: "copy with -vf",
+			command: Ffmpeg{Inputs: []FfmpegInput{input}, Outputs: []FfmpegOutput{
+				{Url: "pipe:1", Format: "mpegts", Codec: CodecCopy, VideoFilters: []string{"scale=-2:720"}},
+			}},
+		},
+		{
+			name: "audio copy with -ar",
+			command: Ffmpeg{Inputs: []FfmpegInput{input}, Outputs: []FfmpegOutput{
+				{Url: "pipe:1", Format: "mpegts", AudioCodec: CodecCopy, AudioSampleRate: 48000},
+			}},
+		},
+		{
+			name: "-an with -c:a",
+			command: Ffmpeg{Inputs: []FfmpegInput{input}, Outputs: []FfmpegOutput{
+				{Url: "pipe:1", Format: "mpegts", NoAudio: true, AudioCodec: "aac"},
+			}},
+		},
+		{
+			name:    "-re with -readrate",
+			command: Ffmpeg{Inputs: []FfmpegInput{{Url: "pipe:0", Realtime: true, ReadRate: 2}}, Outputs: []FfmpegOutput{output}},
+		},
+		{
+			name:    "negative seek",
+			command: Ffmpeg{Inputs: []FfmpegInput{{Url: "pipe:0", Seek: -time.Second}}, Outputs: []FfmpegOutput{output}},
+		},
+		{
+			name:    "pipe without format",
+			command: Ffmpeg{Inputs: []FfmpegInput{input}, Outputs: []FfmpegOutput{{Url: "pipe:1"}}},
+		},
+		{
+			name: "map of a missing input",
+			command: Ffmpeg{Inputs: []FfmpegInput{input}, Outputs: []FfmpegOutput{
+				{Url: "pipe:1", Format: "mpegts", Maps: []FfmpegMap{{Input: 1, Stream: "v:0"}}},
+			}},
+		},
+		{
+			name: "reserved output option",
+			command: Ffmpeg{Inputs: []FfmpegInput{input}, Outputs: []FfmpegOutput{
+				{Url: "pipe:1", Format: "mpegts", Options: []FfmpegOption{{Name: "c:v", Value: "libx264"}}},
+			}},
+		},
+		{
+			name:    "reserved input option with a dash",
+			command: Ffmpeg{Inputs: []FfmpegInput{{Url: "pipe:0", Options: []FfmpegOption{{Name: "-ss", Value: "10"}}}}, Outputs: []FfmpegOutput{output}},
+		},
+		{
+			name:    "no input",
+			command: Ffmpeg{Outputs: []FfmpegOutput{output}},
+		},
+		{
+			name:    "no output",
+			command: Ffmpeg{Inputs: []FfmpegInput{input}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := tt.command.Args()
+			if !errors.Is(err, ErrInvalidFfmpegCommand) {
+				t.Fatalf("Args() = %q, %v, want %v", args, err, ErrInvalidFfmpegCommand)
+			}
+		})
+	}
+}
+
+func TestFfmpegArgs(t *testing.T) {
+	command := Ffmpeg{
+		StatsPeriod: 500 * time.Millisecond,
+		Progress:    true,
+		Inputs: []FfmpegInput{{
+			Url:      "pipe:0",
+			Seek:     1500 * time.Millisecond,
+			Realtime: true,
+			Options:  []FfmpegOption{{Name: "fflags", Value: "+genpts"}},
+		}},
+		Outputs: []FfmpegOutput{{
+			Url:                  "rtsp://localhost:8554/stream",
+			Format:               "rtsp",
+			Maps:                 []FfmpegMap{{Stream: "V:0"}, {Stream: "a:0", Optional: true}},
+			VideoCodec:           CodecCopy,
+			VideoBitstreamFilter: "h264_mp4toannexb",
+			AudioCodec:           "libopus",
+			AudioChannels:        2,
+			Options:              []FfmpegOption{{Name: "rtsp_transport", Value: "tcp"}},
+		}},
+	}
+
+	args, err := command.Args()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"-nostats", "-progress", "pipe:2", "-stats_period", "0.5",
+		"-re", "-ss", "1.500", "-fflags", "+genpts", "-i", "pipe:0",
+		"-map", "0:V:0", "-map", "0:a:0?", "-c:v", "copy", "-bsf:v", "h264_mp4toannexb",
+		"-c:a", "libopus", "-ac", "2", "-rtsp_transport", "tcp", "-f", "rtsp", "rtsp://localhost:8554/stream",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("Args() = %q, want %q", args, want)
+	}
+}
@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is a report written by ffmpeg with -progress, every stats period and once at the end.
+type Progress struct {
+	Frame   int64
+	Fps     float64
+	Bitrate string
+	OutTime time.Duration
+	Speed   float64
+	// Done is set on the last report
+	Done bool
+}
+
+var progressLine = regexp.MustCompile(`^[a-z0-9_]+=\S*$`)
+
+// ScanProgress parses the reports mixed in the ffmpeg output into onProgress until r ends,
+// the other lines, like warnings, are copied to log.
+func ScanProgress(r io.Reader, log io.Writer, onProgress func(Progress)) {
+	var progress Progress
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !progressLine.MatchString(line) {
+			io.WriteString(log, scanner.Text()+"\n")
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, "=")
+		if value == "N/A" {
+			continue
+		}
+		switch key {
+		case "frame":
+			progress.Frame, _ = strconv.ParseInt(value, 10, 64)
+		case "fps":
+			progress.Fps, _ = strconv.ParseFloat(value, 64)
+		case "bitrate":
+			progress.Bitrate = value
+		// out_time_ms is in microseconds as well
+		case "out_time_us", "out_time_ms":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				progress.OutTime = time.Duration(us) * time.Microsecond
+			}
+		case "speed":
+			progress.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "progress":
+			progress.Done = value == "end"
+			onProgress(progress)
+			progress = Progress{}
+		}
+	}
+	// keep the process from blocking on a full pipe
+	io.Copy(io.Discard, r)
+}
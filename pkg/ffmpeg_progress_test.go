@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestScanProgress(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []Progress
+		log    string
+	}{
+		{
+			name: "a report and the last one",
+			output: "frame=25\nfps=25.00\nbitrate=1024.5kbits/s\nout_time_us=1000000\nout_time=00:00:01.000000\nspeed=1.01x\nprogress=continue\n" +
+				"frame=50\nfps=25.00\nbitrate=1000.0kbits/s\nout_time_us=2000000\nspeed=1x\nprogress=end\n",
+			want: []Progress{
+				{Frame: 25, Fps: 25, Bitrate: "1024.5kbits/s", OutTime: time.Second, Speed: 1.01},
+				{Frame: 50, Fps: 25, Bitrate: "1000.0kbits/s", OutTime: 2 * time.Second, Speed: 1, Done: true},
+			},
+		},
+		{
+			name:   "out_time_ms in microseconds",
+			output: "out_time_ms=1500000\nprogress=continue\n",
+			want:   []Progress{{OutTime: 1500 * time.Millisecond}},
+		},
+		{
+			name:   "N/A values",
+			output: "frame=0\nfps=0.00\nbitrate=N/A\nout_time_us=N/A\nspeed=N/A\nprogress=continue\n",
+			want:   []Progress{{}},
+		},
+		{
+			name:   "N/A values don't carry the previous report",
+			output: "frame=25\nbitrate=512kbits/s\nspeed=2x\nprogress=continue\nframe=50\nbitrate=N/A\nspeed=N/A\nprogress=continue\n",
+			want:   []Progress{{Frame: 25, Bitrate: "512kbits/s", Speed: 2}, {Frame: 50}},
+		},
+		{
+			name:   "invalid numbers",
+			output: "frame=\nfps=abc\nout_time_us=-\nspeed=fastx\nprogress=continue\n",
+			want:   []Progress{{}},
+		},
+		{
+			name:   "the last line without newline",
+			output: "frame=50\nprogress=end",
+			want:   []Progress{{Frame: 50, Done: true}},
+		},
+		{
+			name:   "a report cut short",
+			output: "frame=25\nprogress=continue\nframe=50\nfps=25.0",
+			want:   []Progress{{Frame: 25}},
+		},
+		{
+			name:   "warnings between the reports",
+			output: "[mpegts @ 0x55] Packet corrupt (stream = 0, dts = 1234).\nframe=25\n  Stream #0:0: Video: h264\nprogress=continue\n",
+			want:   []Progress{{Frame: 25}},
+			log:    "[mpegts @ 0x55] Packet corrupt (stream = 0, dts = 1234).\n  Stream #0:0: Video: h264\n",
+		},
+		{
+			name:   "the stats line of the console",
+			output: "frame=  250 fps= 25 q=-1.0 size=N/A time=00:00:10.00 bitrate=N/A speed=1x\n",
+			log:    "frame=  250 fps= 25 q=-1.0 size=N/A time=00:00:10.00 bitrate=N/A speed=1x\n",
+		},
+		{
+			name:   "a trailing carriage return",
+			output: "frame=25\r\nprogress=end\r\n",
+			want:   []Progress{{Frame: 25, Done: true}},
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// ffmpeg writes its output in pieces, lines are split across the reads
+			var got []Progress
+			var log strings.Builder
+			ScanProgress(iotest.OneByteReader(strings.NewReader(test.output)), &log, func(progress Progress) {
+				got = append(got, progress)
+			})
+
+			if len(got) != len(test.want) {
+				t.Fatalf("reported %+v, want %+v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("report %d is %+v, want %+v", i, got[i], test.want[i])
+				}
+			}
+			if log.String() != test.log {
+				t.Errorf("logged %q, want %q", log.String(), test.log)
+			}
+		})
+	}
+}
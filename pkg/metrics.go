@@ -0,0 +1,12 @@
+package pkg
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var runningProcesses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "video_handler",
+	Name:      "processes_running",
+	Help:      "Running external processes like ffmpeg and ffprobe.",
+}, []string{"app"})
@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Mp4FastStart tells whether a MP4 can be played while it's read: its index, the moov box, comes
+// before the media data, or it's fragmented. It reads the top level boxes and seeks back to the start.
+func Mp4FastStart(video io.ReadSeeker) (bool, error) {
+	defer video.Seek(0, io.SeekStart)
+
+	if _, err := video.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	header := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(video, header[:8]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		switch string(header[4:8]) {
+		case "moov", "moof":
+			return true, nil
+		case "mdat":
+			return false, nil
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// the box lasts until the end of the file
+			return false, nil
+		case 1:
+			if _, err := io.ReadFull(video, header[8:16]); err != nil {
+				return false, nil
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize {
+			return false, nil
+		}
+
+		if _, err := video.Seek(size-headerSize, io.SeekCurrent); err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// ProbeResult is what ffprobe tells about a video, zero values when it doesn't know.
+type ProbeResult struct {
+	VideoCodec string
+	// AudioCodec is empty for a video without sound
+	AudioCodec string
+	// Formats are the names of the container, like "mov,mp4,m4a,3gp,3g2,mj2"
+	Formats  string
+	Duration time.Duration
+}
+
+// Transcoder runs the media work of the service: the ffmpeg and ffprobe binaries, or a fake in tests.
+type Transcoder interface {
+	// Probe inspects video, an unparsable video gives a zero result.
+	Probe(ctx context.Context, video io.Reader) (ProbeResult, error)
+	// ProbeUrl inspects the video at videoUrl, which ffprobe can seek in unlike a pipe.
+	ProbeUrl(ctx context.Context, videoUrl string) (ProbeResult, error)
+	// Transcode runs command on video, which writes to pipe:1, and returns its output.
+	// onProgress receives the progress reports every command.StatsPeriod, it may be nil.
+	Transcode(ctx context.Context, command Ffmpeg, video io.Reader, onProgress func(Progress)) (io.ReadCloser, error)
+	// Push runs command on video until it ends, like a stream publisher, and returns the end of its output.
+	Push(ctx context.Context, command Ffmpeg, video io.Reader) ([]byte, error)
+}
+
+// ExecTranscoder runs the ffmpeg and ffprobe binaries.
+type ExecTranscoder struct {
+	Logger *slog.Logger
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+	} `json:"format"`
+}
+
+func (et *ExecTranscoder) Probe(ctx context.Context, video io.Reader) (ProbeResult, error) {
+	return et.probe(ctx, "pipe:0", video)
+}
+
+func (et *ExecTranscoder) ProbeUrl(ctx context.Context, videoUrl string) (ProbeResult, error) {
+	return et.probe(ctx, videoUrl, nil)
+}
+
+func (et *ExecTranscoder) probe(ctx context.Context, input string, video io.Reader) (ProbeResult, error) {
+	probeCommand := CmdCommand{
+		App:     "ffprobe",
+		Args:    []string{"-v", "quiet", "-show_entries", "stream=codec_type,codec_name:format=format_name,duration", "-of", "json", input},
+		Pipe:    video,
+		Logger:  *et.Logger,
+		Context: ctx,
+	}
+
+	stdout, err := probeCommand.ExecuteCommand()
+	if err != nil {
+		return ProbeResult{}, err
+	}
+
+	var output ffprobeOutput
+	if err := json.Unmarshal(stdout, &output); err != nil {
+		return ProbeResult{}, fmt.Errorf("unexpected ffprobe output %q: %w", stdout, err)
+	}
+
+	result := ProbeResult{Formats: output.Format.FormatName}
+	for _, stream := range output.Streams {
+		switch {
+		case stream.CodecType == "video" && result.VideoCodec == "":
+			result.VideoCodec = stream.CodecName
+		case stream.CodecType == "audio" && result.AudioCodec == "":
+			result.AudioCodec = stream.CodecName
+		}
+	}
+	if seconds, err := strconv.ParseFloat(output.Format.Duration, 64); err == nil {
+		result.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	return result, nil
+}
+
+func (et *ExecTranscoder) Transcode(ctx context.Context, command Ffmpeg, video io.Reader, onProgress func(Progress)) (io.ReadCloser, error) {
+	command.Progress = onProgress != nil
+	args, err := command.Args()
+	if err != nil {
+		return nil, err
+	}
+
+	transcodeCommand := CmdCommand{
+		App:        "ffmpeg",
+		Args:       args,
+		Pipe:       video,
+		Logger:     *et.Logger,
+		Context:    ctx,
+		OnProgress: onProgress,
+	}
+	return transcodeCommand.ExecuteWithPipeCreation()
+}
+
+func (et *ExecTranscoder) Push(ctx context.Context, command Ffmpeg, video io.Reader) ([]byte, error) {
+	args, err := command.Args()
+	if err != nil {
+		return nil, err
+	}
+
+	pushCommand := CmdCommand{
+		App:     "ffmpeg",
+		Args:    args,
+		Pipe:    video,
+		Logger:  *et.Logger,
+		Context: ctx,
+	}
+	return pushCommand.ExecuteWithOutputTail()
+}
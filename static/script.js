@@ -3,6 +3,8 @@ let ws = new WebSocket("{{.}}");
 function init() {
   // Получаем и отображаем список видео
   updateVideoList();
+  // Загружаем профили конвертации для формы загрузки
+  loadConversionProfiles();
   // Настраиваем WebRTC соединение
   setupWebRTCConnection();
 }
@@ -12,6 +14,7 @@ function setupWebRTCConnection() {
 
   pc.ontrack = function (event) {
     let trackID = event.track.id
+    // Звук приходит в том же потоке, что и видео, и играет в его элементе
     if (event.track.kind === 'audio') {
       return;
     }
@@ -77,6 +80,23 @@ function setupWebRTCConnection() {
         }
         pc.addIceCandidate(candidate);
         return;
+
+      case 'error':
+        console.log('ERROR: ' + msg.data);
+        return;
+
+      case 'stream-state':
+        let state = JSON.parse(msg.data);
+        console.log('stream ' + state.id + ' is ' + state.state + (state.error ? ': ' + state.error : ''));
+        return;
+
+      case 'conversion-progress':
+        showConversionProgress(JSON.parse(msg.data));
+        return;
+
+      case 'shutdown':
+        window.alert("The server is shutting down, streams will stop shortly");
+        return;
     }
   };
 
@@ -12,6 +12,10 @@ function openFileSelector() {
   
     const formData = new FormData();
     formData.append("video", file);
+    const profile = document.getElementById("profileSelect").value;
+    if (profile) {
+      formData.append("profile", profile);
+    }
   
     fetch("http://localhost:8080/upload", {
       method: "POST",
@@ -32,4 +36,54 @@ function openFileSelector() {
       videoFileInput.value = "";
     });
   }
-  
\ No newline at end of file
+  
+
+  // Заполнение списка профилей конвертации
+  function loadConversionProfiles() {
+    fetch("http://localhost:8080/conversion-profiles")
+      .then(response => response.json())
+      .then(response => {
+        const profileSelect = document.getElementById("profileSelect");
+        response.Result.forEach(profile => {
+          const option = document.createElement("option");
+          option.value = profile.name;
+          option.textContent = profile.name + " (" + profile.video_codec + ")";
+          profileSelect.appendChild(option);
+        });
+      })
+      .catch(error => {
+        console.error("Ошибка при загрузке профилей:", error);
+      });
+  }
+
+  // Отображение прогресса конвертации загруженного видео
+  function showConversionProgress(job) {
+    const conversionList = document.getElementById("conversionList");
+    let item = document.getElementById("job-" + job.id);
+    if (!item) {
+      item = document.createElement("li");
+      item.id = "job-" + job.id;
+      item.innerHTML = '<span class="video-title"></span><progress max="100"></progress>';
+      item.querySelector(".video-title").textContent = job.video;
+      conversionList.appendChild(item);
+    }
+
+    const progress = item.querySelector("progress");
+    if (job.progress && job.progress.percent) {
+      progress.value = job.progress.percent;
+    } else {
+      // длительность неизвестна, показываем неопределённый прогресс
+      progress.removeAttribute("value");
+    }
+    if (job.progress) {
+      item.title = job.progress.frame + " frames, " + job.progress.fps + " fps, " + job.progress.speed + "x";
+    }
+
+    if (job.status === "succeeded") {
+      item.remove();
+      updateVideoList();
+    } else if (job.status === "failed") {
+      item.title = job.error;
+      item.classList.add("failed");
+    }
+  }